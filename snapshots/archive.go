@@ -0,0 +1,235 @@
+package snapshots
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/cosmos/cosmos-sdk/snapshots/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
+// A snapshot archive is a tar stream with the following entries, in order:
+//
+//	header      the snapshot height and format, as an encoded types.Snapshot
+//	chunks/<n>  the body of chunk n, for n = 0, 1, ...
+//	snapshot    the full snapshot metadata including checksums, as written by Store.Save
+//
+// The checksums come last so that the archive can be written in a single pass, without buffering
+// more than one chunk.
+const (
+	archiveHeaderName   = "header"
+	archiveSnapshotName = "snapshot"
+)
+
+// archiveChunkName returns the name of the archive entry for the given chunk.
+func archiveChunkName(index uint32) string {
+	return fmt.Sprintf("chunks/%d", index)
+}
+
+// WriteArchive writes a snapshot of the given height and format as a tar archive to w, reading the
+// chunks from the given channel, and returns the snapshot metadata. The metadata is the same that
+// Store.Save would record for the chunks.
+func WriteArchive(
+	w io.Writer, height uint64, format uint32, chunks <-chan io.ReadCloser,
+) (*types.Snapshot, error) {
+	defer DrainChunks(chunks)
+	if height == 0 {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "snapshot height cannot be 0")
+	}
+
+	tw := tar.NewWriter(w)
+	snapshot := &types.Snapshot{
+		Height: height,
+		Format: format,
+	}
+	if err := writeArchiveMessage(tw, archiveHeaderName, snapshot); err != nil {
+		return nil, err
+	}
+
+	index := uint32(0)
+	snapshotHasher := newHasher()
+	chunkHasher := newHasher()
+	for chunkBody := range chunks {
+		// tar headers carry the entry size, so each chunk is buffered before it's written
+		body, err := ioutil.ReadAll(chunkBody)
+		chunkBody.Close()
+		if err != nil {
+			return nil, sdkerrors.Wrapf(err, "failed to generate snapshot chunk %v", index)
+		}
+		if err := writeArchiveEntry(tw, archiveChunkName(index), body); err != nil {
+			return nil, err
+		}
+
+		chunkHasher.Reset()
+		chunkHasher.Write(body)
+		snapshotHasher.Write(body)
+		snapshot.Metadata.ChunkHashes = append(snapshot.Metadata.ChunkHashes, chunkHasher.Sum(nil))
+		index++
+	}
+	snapshot.Chunks = index
+	snapshot.Hash = snapshotHasher.Sum(nil)
+
+	if err := writeArchiveMessage(tw, archiveSnapshotName, snapshot); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, sdkerrors.Wrap(err, "failed to close snapshot archive")
+	}
+	return snapshot, nil
+}
+
+// ReadArchive reads a snapshot archive written by WriteArchive from r. It returns the height and
+// format of the snapshot, and a channel of its chunks which must be drained by the caller.
+//
+// Chunks are verified against the checksums at the end of the archive. The last chunk is held
+// back until they have been verified, and is replaced by a chunk returning the error if they don't
+// match, so a consumer such as a restore fails before it has read all data. Read errors are
+// reported by a failing chunk as well.
+func ReadArchive(r io.Reader) (*types.Snapshot, <-chan io.ReadCloser, error) {
+	tr := tar.NewReader(r)
+	header := &types.Snapshot{}
+	if err := readArchiveMessage(tr, archiveHeaderName, header); err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan io.ReadCloser)
+	go func() {
+		defer close(ch)
+		if err := readArchiveChunks(tr, header, ch); err != nil {
+			pr, pw := io.Pipe()
+			pw.CloseWithError(err)
+			ch <- pr
+		}
+	}()
+
+	return &types.Snapshot{Height: header.Height, Format: header.Format}, ch, nil
+}
+
+// readArchiveChunks reads chunk entries from an archive, sends them to ch and verifies them
+// against the trailing snapshot metadata.
+func readArchiveChunks(tr *tar.Reader, header *types.Snapshot, ch chan<- io.ReadCloser) error {
+	var pending []byte
+	chunkHashes := [][]byte{}
+	snapshotHasher := newHasher()
+	chunkHasher := newHasher()
+	for index := uint32(0); ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return sdkerrors.Wrap(sdkerrors.ErrLogic, "snapshot archive ended before the snapshot metadata")
+		} else if err != nil {
+			return sdkerrors.Wrap(err, "failed to read snapshot archive")
+		}
+
+		if hdr.Name == archiveSnapshotName {
+			snapshot := &types.Snapshot{}
+			if err := decodeArchiveMessage(tr, hdr.Name, snapshot); err != nil {
+				return err
+			}
+			if err := verifyArchive(header, snapshot, index, snapshotHasher.Sum(nil), chunkHashes); err != nil {
+				return err
+			}
+			if pending != nil {
+				ch <- ioutil.NopCloser(bytes.NewReader(pending))
+			}
+			return nil
+		}
+
+		if hdr.Name != archiveChunkName(index) {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic, "expected snapshot archive entry %q, got %q",
+				archiveChunkName(index), hdr.Name)
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return sdkerrors.Wrapf(err, "failed to read snapshot chunk %v", index)
+		}
+		chunkHasher.Reset()
+		chunkHasher.Write(body)
+		snapshotHasher.Write(body)
+		chunkHashes = append(chunkHashes, chunkHasher.Sum(nil))
+
+		if pending != nil {
+			ch <- ioutil.NopCloser(bytes.NewReader(pending))
+		}
+		pending = body
+	}
+}
+
+// verifyArchive checks the snapshot metadata at the end of an archive against its header and the
+// chunks read.
+func verifyArchive(header, snapshot *types.Snapshot, chunks uint32, hash []byte, chunkHashes [][]byte) error {
+	if snapshot.Height != header.Height || snapshot.Format != header.Format {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic,
+			"snapshot archive metadata is for height %v format %v, but header is for height %v format %v",
+			snapshot.Height, snapshot.Format, header.Height, header.Format)
+	}
+	if snapshot.Chunks != chunks || len(snapshot.Metadata.ChunkHashes) != len(chunkHashes) {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "snapshot archive has %v chunks, expected %v",
+			chunks, snapshot.Chunks)
+	}
+	for i, chunkHash := range chunkHashes {
+		if !bytes.Equal(chunkHash, snapshot.Metadata.ChunkHashes[i]) {
+			return sdkerrors.Wrapf(types.ErrChunkHashMismatch, "chunk %v", i)
+		}
+	}
+	if !bytes.Equal(hash, snapshot.Hash) {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "snapshot archive hash %X does not match metadata hash %X",
+			hash, snapshot.Hash)
+	}
+	return nil
+}
+
+// writeArchiveEntry writes a regular file entry to a snapshot archive.
+func writeArchiveEntry(tw *tar.Writer, name string, body []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(body)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return sdkerrors.Wrapf(err, "failed to write snapshot archive entry %q", name)
+	}
+	if _, err := tw.Write(body); err != nil {
+		return sdkerrors.Wrapf(err, "failed to write snapshot archive entry %q", name)
+	}
+	return nil
+}
+
+// writeArchiveMessage writes snapshot metadata as an entry to a snapshot archive.
+func writeArchiveMessage(tw *tar.Writer, name string, snapshot *types.Snapshot) error {
+	bz, err := proto.Marshal(snapshot)
+	if err != nil {
+		return sdkerrors.Wrap(err, "failed to encode snapshot metadata")
+	}
+	return writeArchiveEntry(tw, name, bz)
+}
+
+// readArchiveMessage reads the next entry of a snapshot archive, which must have the given name,
+// as snapshot metadata.
+func readArchiveMessage(tr *tar.Reader, name string, snapshot *types.Snapshot) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return sdkerrors.Wrap(err, "failed to read snapshot archive")
+	}
+	if hdr.Name != name {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "expected snapshot archive entry %q, got %q", name, hdr.Name)
+	}
+	return decodeArchiveMessage(tr, name, snapshot)
+}
+
+// decodeArchiveMessage decodes the current entry of a snapshot archive as snapshot metadata.
+func decodeArchiveMessage(tr *tar.Reader, name string, snapshot *types.Snapshot) error {
+	bz, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return sdkerrors.Wrapf(err, "failed to read snapshot archive entry %q", name)
+	}
+	if err := proto.Unmarshal(bz, snapshot); err != nil {
+		return sdkerrors.Wrapf(err, "failed to decode snapshot archive entry %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package snapshots_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/cosmos-sdk/snapshots"
+	"github.com/cosmos/cosmos-sdk/snapshots/types"
+)
+
+func TestArchive(t *testing.T) {
+	chunks := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+
+	var archive bytes.Buffer
+	snapshot, err := snapshots.WriteArchive(&archive, 3, 1, makeChunks(chunks))
+	require.NoError(t, err)
+	require.Equal(t, &types.Snapshot{
+		Height: 3,
+		Format: 1,
+		Chunks: 3,
+		Hash:   hash(chunks),
+		Metadata: types.Metadata{
+			ChunkHashes: checksums(chunks),
+		},
+	}, snapshot)
+
+	header, ch, err := snapshots.ReadArchive(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, &types.Snapshot{Height: 3, Format: 1}, header)
+	require.Equal(t, chunks, readChunks(ch))
+
+	_, err = snapshots.WriteArchive(&archive, 0, 1, makeChunks(chunks))
+	require.Error(t, err)
+}
+
+func TestReadArchive_Corrupt(t *testing.T) {
+	chunks := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+	var archive bytes.Buffer
+	_, err := snapshots.WriteArchive(&archive, 3, 1, makeChunks(chunks))
+	require.NoError(t, err)
+
+	// corrupt the body of the second chunk, which the checksums at the end of
+	// the archive must catch before the last chunk is handed out
+	corrupt := bytes.Replace(archive.Bytes(), []byte{4, 5, 6}, []byte{6, 5, 4}, 1)
+	_, ch, err := snapshots.ReadArchive(bytes.NewReader(corrupt))
+	require.NoError(t, err)
+	var bodies [][]byte
+	for chunk := range ch {
+		body, err := ioutil.ReadAll(chunk)
+		if err != nil {
+			require.True(t, errors.Is(err, types.ErrChunkHashMismatch))
+			break
+		}
+		bodies = append(bodies, body)
+	}
+	require.Len(t, bodies, 2)
+	for range ch {
+	}
+
+	// a truncated archive fails, as does one that isn't an archive
+	_, ch, err = snapshots.ReadArchive(bytes.NewReader(archive.Bytes()[:archive.Len()/2]))
+	require.NoError(t, err)
+	var readErr error
+	for chunk := range ch {
+		if _, err := ioutil.ReadAll(chunk); err != nil {
+			readErr = err
+		}
+	}
+	require.Error(t, readErr)
+
+	_, _, err = snapshots.ReadArchive(bytes.NewReader([]byte("not an archive")))
+	require.Error(t, err)
+}
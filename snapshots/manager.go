@@ -2,7 +2,6 @@ package snapshots
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -231,9 +230,11 @@ func (m *Manager) RestoreChunk(chunk []byte) (bool, error) {
 	}
 
 	// Verify the chunk hash.
-	hash := sha256.Sum256(chunk)
+	hasher := newHasher()
+	hasher.Write(chunk) // nolint: errcheck
+	hash := hasher.Sum(nil)
 	expected := m.restoreChunkHashes[m.restoreChunkIndex]
-	if !bytes.Equal(hash[:], expected) {
+	if !bytes.Equal(hash, expected) {
 		return false, sdkerrors.Wrapf(types.ErrChunkHashMismatch,
 			"expected %x, got %x", hash, expected)
 	}
@@ -1,7 +1,7 @@
 package snapshots
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"math"
@@ -83,6 +83,11 @@ func (s *Store) Get(height uint64, format uint32) (*types.Snapshot, error) {
 		return nil, sdkerrors.Wrapf(err, "failed to decode snapshot metadata for height %v format %v",
 			height, format)
 	}
+	if snapshot.Height != height || snapshot.Format != format {
+		return nil, sdkerrors.Wrapf(types.ErrInvalidMetadata,
+			"snapshot metadata for height %v format %v is recorded for height %v format %v",
+			height, format, snapshot.Height, snapshot.Format)
+	}
 	if snapshot.Metadata.ChunkHashes == nil {
 		snapshot.Metadata.ChunkHashes = [][]byte{}
 	}
@@ -130,16 +135,22 @@ func (s *Store) List() ([]*types.Snapshot, error) {
 }
 
 // Load loads a snapshot (both metadata and binary chunks). The chunks must be consumed and closed.
-// Returns nil if the snapshot does not exist.
+// Returns nil if the snapshot does not exist. Each chunk is verified against the checksum in the
+// snapshot metadata, and a chunk reader returns ErrChunkHashMismatch before EOF on a mismatch.
 func (s *Store) Load(height uint64, format uint32) (*types.Snapshot, <-chan io.ReadCloser, error) {
 	snapshot, err := s.Get(height, format)
 	if snapshot == nil || err != nil {
 		return nil, nil, err
 	}
+	if uint32(len(snapshot.Metadata.ChunkHashes)) != snapshot.Chunks {
+		return nil, nil, sdkerrors.Wrapf(types.ErrInvalidMetadata,
+			"snapshot has %v chunk hashes, but %v chunks", len(snapshot.Metadata.ChunkHashes), snapshot.Chunks)
+	}
 
 	ch := make(chan io.ReadCloser)
 	go func() {
 		defer close(ch)
+		hasher := newHasher()
 		for i := uint32(0); i < snapshot.Chunks; i++ {
 			pr, pw := io.Pipe()
 			ch <- pr
@@ -149,12 +160,18 @@ func (s *Store) Load(height uint64, format uint32) (*types.Snapshot, <-chan io.R
 				return
 			}
 			defer chunk.Close()
-			_, err = io.Copy(pw, chunk)
+			hasher.Reset()
+			_, err = io.Copy(io.MultiWriter(pw, hasher), chunk)
 			if err != nil {
 				pw.CloseWithError(err)
 				return
 			}
 			chunk.Close()
+			if hash := hasher.Sum(nil); !bytes.Equal(hash, snapshot.Metadata.ChunkHashes[i]) {
+				pw.CloseWithError(sdkerrors.Wrapf(types.ErrChunkHashMismatch,
+					"chunk %v: expected %x, got %x", i, snapshot.Metadata.ChunkHashes[i], hash))
+				return
+			}
 			pw.Close()
 		}
 	}()
@@ -251,21 +268,38 @@ func (s *Store) Save(
 			"snapshot already exists for height %v format %v", height, format)
 	}
 
+	// Chunks are written into a temporary directory, which is moved into place once all chunks
+	// have been written, so that a crash never leaves a partially written snapshot directory
+	// behind. Directories left behind by an interrupted save have no metadata and are replaced.
+	dir, tmpDir := s.pathSnapshot(height, format), s.pathSnapshotTemp(height, format)
+	for _, path := range []string{tmpDir, dir} {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, sdkerrors.Wrapf(err, "failed to remove stale snapshot directory %q", path)
+		}
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, sdkerrors.Wrapf(err, "failed to create snapshot directory %q", tmpDir)
+	}
+
+	// remove the chunks written so far if saving fails, e.g. when the chunk stream is aborted
+	saved := false
+	defer func() {
+		if !saved {
+			os.RemoveAll(tmpDir)
+			os.RemoveAll(dir)
+		}
+	}()
+
 	snapshot := &types.Snapshot{
 		Height: height,
 		Format: format,
 	}
 	index := uint32(0)
-	snapshotHasher := sha256.New()
-	chunkHasher := sha256.New()
+	snapshotHasher := newHasher()
+	chunkHasher := newHasher()
 	for chunkBody := range chunks {
 		defer chunkBody.Close() // nolint: staticcheck
-		dir := s.pathSnapshot(height, format)
-		err = os.MkdirAll(dir, 0755)
-		if err != nil {
-			return nil, sdkerrors.Wrapf(err, "failed to create snapshot directory %q", dir)
-		}
-		path := s.pathChunk(height, format, index)
+		path := filepath.Join(tmpDir, strconv.FormatUint(uint64(index), 10))
 		file, err := os.Create(path)
 		if err != nil {
 			return nil, sdkerrors.Wrapf(err, "failed to create snapshot chunk file %q", path)
@@ -290,7 +324,13 @@ func (s *Store) Save(
 	}
 	snapshot.Chunks = index
 	snapshot.Hash = snapshotHasher.Sum(nil)
-	return snapshot, s.saveSnapshot(snapshot)
+
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return nil, sdkerrors.Wrapf(err, "failed to move snapshot directory %q into place", tmpDir)
+	}
+	err = s.saveSnapshot(snapshot)
+	saved = err == nil
+	return snapshot, err
 }
 
 // saveSnapshot saves snapshot metadata to the database.
@@ -313,6 +353,11 @@ func (s *Store) pathSnapshot(height uint64, format uint32) string {
 	return filepath.Join(s.pathHeight(height), strconv.FormatUint(uint64(format), 10))
 }
 
+// pathSnapshotTemp generates the path a snapshot is written to before being moved into place.
+func (s *Store) pathSnapshotTemp(height uint64, format uint32) string {
+	return s.pathSnapshot(height, format) + ".tmp"
+}
+
 // pathChunk generates a snapshot chunk path.
 func (s *Store) pathChunk(height uint64, format uint32, chunk uint32) string {
 	return filepath.Join(s.pathSnapshot(height, format), strconv.FormatUint(uint64(chunk), 10))
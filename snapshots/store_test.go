@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -118,6 +119,26 @@ func TestStore_Get(t *testing.T) {
 	}, snapshot)
 }
 
+func TestStore_Get_MismatchedMetadata(t *testing.T) {
+	metadataDB := db.NewMemDB()
+	store, err := snapshots.NewStore(metadataDB, t.TempDir())
+	require.NoError(t, err)
+	_, err = store.Save(2, 1, makeChunks([][]byte{{2, 1, 0}}))
+	require.NoError(t, err)
+
+	// record the metadata of format 1 under the key of format 2
+	iter, err := metadataDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.True(t, iter.Valid())
+	key, value := append([]byte{}, iter.Key()...), iter.Value()
+	require.NoError(t, iter.Close())
+	key[len(key)-1] = 2
+	require.NoError(t, metadataDB.Set(key, value))
+
+	_, err = store.Get(2, 2)
+	require.True(t, errors.Is(err, types.ErrInvalidMetadata))
+}
+
 func TestStore_GetLatest(t *testing.T) {
 	store := setupStore(t)
 	// Loading a missing snapshot should return nil
@@ -197,6 +218,32 @@ func TestStore_Load(t *testing.T) {
 	assert.Empty(t, chunks)
 }
 
+func TestStore_Load_ChecksumMismatch(t *testing.T) {
+	tempdir := t.TempDir()
+	store, err := snapshots.NewStore(db.NewMemDB(), tempdir)
+	require.NoError(t, err)
+	_, err = store.Save(1, 1, makeChunks([][]byte{{1, 1, 0}, {1, 1, 1}}))
+	require.NoError(t, err)
+
+	// Corrupt the second chunk on disk
+	err = ioutil.WriteFile(filepath.Join(tempdir, "1", "1", "1"), []byte{9, 9, 9}, 0644)
+	require.NoError(t, err)
+
+	_, chunks, err := store.Load(1, 1)
+	require.NoError(t, err)
+
+	reader := <-chunks
+	_, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	reader = <-chunks
+	_, err = ioutil.ReadAll(reader)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, types.ErrChunkHashMismatch))
+	require.NoError(t, reader.Close())
+}
+
 func TestStore_LoadChunk(t *testing.T) {
 	store := setupStore(t)
 	// Loading a missing snapshot should return nil
@@ -315,6 +362,20 @@ func TestStore_Save(t *testing.T) {
 	require.True(t, errors.Is(err, someErr))
 	assert.Empty(t, ch)
 
+	// The chunks written before the error should have been removed
+	ch = make(chan io.ReadCloser, 2)
+	ch <- ioutil.NopCloser(bytes.NewBuffer([]byte{0xff}))
+	pr, pw = io.Pipe()
+	require.NoError(t, pw.CloseWithError(someErr))
+	ch <- pr
+	close(ch)
+
+	_, err = store.Save(6, 1, ch)
+	require.True(t, errors.Is(err, someErr))
+	chunk, err := store.LoadChunk(6, 1, 0)
+	require.NoError(t, err)
+	assert.Nil(t, chunk)
+
 	// Saving a snapshot should error if a snapshot is already in progress for the same height,
 	// regardless of format. However, a different height should succeed.
 	ch = make(chan io.ReadCloser)
@@ -326,3 +387,43 @@ func TestStore_Save(t *testing.T) {
 	require.NoError(t, err)
 	close(ch)
 }
+
+func TestStore_Save_Atomic(t *testing.T) {
+	dir := t.TempDir()
+	store, err := snapshots.NewStore(db.NewMemDB(), dir)
+	require.NoError(t, err)
+
+	// leftovers of an interrupted save are replaced
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "1", "1.tmp"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "1", "1"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1", "1", "7"), []byte{7}, 0644))
+
+	ch := make(chan io.ReadCloser)
+	done := make(chan error)
+	go func() {
+		_, err := store.Save(1, 1, ch)
+		done <- err
+	}()
+	ch <- ioutil.NopCloser(bytes.NewReader([]byte{1}))
+	ch <- ioutil.NopCloser(bytes.NewReader([]byte{2}))
+
+	// the snapshot directory is only moved into place once all chunks have been written
+	_, err = os.Stat(filepath.Join(dir, "1", "1"))
+	require.True(t, os.IsNotExist(err))
+
+	close(ch)
+	require.NoError(t, <-done)
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "1"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "1", entries[0].Name())
+
+	entries, err = ioutil.ReadDir(filepath.Join(dir, "1", "1"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, chunks, err := store.Load(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{1}, {2}}, readChunks(chunks))
+}
@@ -1,6 +1,22 @@
 package types
 
+import (
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+)
+
 // CurrentFormat is the currently used format for snapshots. Snapshots using the same format
 // must be identical across all nodes for a given height, so this must be bumped when the binary
-// snapshot output changes.
+// snapshot output changes. The format version is recorded in the snapshot metadata as
+// Snapshot.Format, and is checked with ValidateFormat before a snapshot is restored.
 const CurrentFormat uint32 = 1
+
+// ValidateFormat returns ErrUnknownFormat if the given snapshot format version is not one of the
+// supported ones, e.g. for a snapshot taken by an older or newer binary.
+func ValidateFormat(format uint32, supported ...uint32) error {
+	for _, f := range supported {
+		if format == f {
+			return nil
+		}
+	}
+	return sdkerrors.Wrapf(ErrUnknownFormat, "unsupported snapshot format version %v", format)
+}
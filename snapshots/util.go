@@ -1,11 +1,19 @@
 package snapshots
 
 import (
+	"crypto/sha256"
+	"hash"
 	"io"
 
 	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
 )
 
+// newHasher returns the hash function used for snapshot and chunk checksums. Saving, loading and
+// restoring snapshots must all use it so that the checksums can't drift apart.
+func newHasher() hash.Hash {
+	return sha256.New()
+}
+
 // ChunkWriter reads an input stream, splits it into fixed-size chunks, and writes them to a
 // sequence of io.ReadClosers via a channel.
 type ChunkWriter struct {
@@ -53,14 +61,19 @@ func (w *ChunkWriter) Close() error {
 	return nil
 }
 
-// CloseWithError closes the writer and sends an error to the reader.
+// CloseWithError closes the writer and sends an error to the reader. If no chunk has been started
+// yet, a chunk failing with the error is sent, so that the reader doesn't mistake the aborted
+// stream for an empty one.
 func (w *ChunkWriter) CloseWithError(err error) {
 	if !w.closed {
 		w.closed = true
-		close(w.ch)
-		if w.pipe != nil {
-			w.pipe.CloseWithError(err)
+		if w.pipe == nil {
+			pr, pw := io.Pipe()
+			w.ch <- pr
+			w.pipe = pw
 		}
+		w.pipe.CloseWithError(err)
+		close(w.ch)
 	}
 }
 
@@ -74,6 +74,14 @@ func TestChunkWriter(t *testing.T) {
 	assert.Equal(t, theErr, err)
 	assert.Empty(t, ch)
 
+	// closing with an error before writing should return a single failing chunk
+	ch = make(chan io.ReadCloser, 100)
+	snapshots.NewChunkWriter(ch, 2).CloseWithError(theErr)
+	_, err = ioutil.ReadAll(<-ch)
+	assert.Equal(t, theErr, err)
+	_, ok := <-ch
+	assert.False(t, ok)
+
 	// closing immediately should return no chunks
 	ch = make(chan io.ReadCloser, 100)
 	chunkWriter := snapshots.NewChunkWriter(ch, 2)
@@ -2,6 +2,8 @@ package cache
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cosmos/cosmos-sdk/store/cachekv"
 	"github.com/cosmos/cosmos-sdk/store/types"
@@ -13,6 +15,8 @@ var (
 	_ types.CommitKVStore             = (*CommitKVStoreCache)(nil)
 	_ types.MultiStorePersistentCache = (*CommitKVStoreCacheManager)(nil)
 
+	_ types.MultiStorePersistentCacheWithStats = (*CommitKVStoreCacheManager)(nil)
+
 	// DefaultCommitKVStoreCacheSize defines the persistent ARC cache size for a
 	// CommitKVStoreCache.
 	DefaultCommitKVStoreCacheSize uint = 1000
@@ -28,6 +32,10 @@ type (
 	CommitKVStoreCache struct {
 		types.CommitKVStore
 		cache *lru.ARCCache
+		size  int
+
+		// accessed atomically, as reads may be concurrent
+		hits, misses, evictions uint64
 	}
 
 	// CommitKVStoreCacheManager maintains a mapping from a StoreKey to a
@@ -36,7 +44,11 @@ type (
 	// CommitMultiStore.
 	CommitKVStoreCacheManager struct {
 		cacheSize uint
-		caches    map[string]types.CommitKVStore
+
+		// guards caches, as Stats may be called concurrently with the store
+		// manager's use of the caches
+		mtx    sync.RWMutex
+		caches map[string]types.CommitKVStore
 	}
 )
 
@@ -49,6 +61,7 @@ func NewCommitKVStoreCache(store types.CommitKVStore, size uint) *CommitKVStoreC
 	return &CommitKVStoreCache{
 		CommitKVStore: store,
 		cache:         cache,
+		size:          int(size),
 	}
 }
 
@@ -60,10 +73,15 @@ func NewCommitKVStoreCacheManager(size uint) *CommitKVStoreCacheManager {
 }
 
 // GetStoreCache returns a Cache from the CommitStoreCacheManager for a given
-// StoreKey. If no Cache exists for the StoreKey, then one is created and set.
-// The returned Cache is meant to be used in a persistent manner.
+// StoreKey. If no Cache exists for the StoreKey, or the existing Cache wraps a
+// different CommitKVStore, e.g. because the store was reloaded at another
+// version, then a new one is created and set. The returned Cache is meant to be
+// used in a persistent manner.
 func (cmgr *CommitKVStoreCacheManager) GetStoreCache(key types.StoreKey, store types.CommitKVStore) types.CommitKVStore {
-	if cmgr.caches[key.Name()] == nil {
+	cmgr.mtx.Lock()
+	defer cmgr.mtx.Unlock()
+
+	if ckv, ok := cmgr.caches[key.Name()]; !ok || ckv.(*CommitKVStoreCache).CommitKVStore != store {
 		cmgr.caches[key.Name()] = NewCommitKVStoreCache(store, cmgr.cacheSize)
 	}
 
@@ -72,6 +90,9 @@ func (cmgr *CommitKVStoreCacheManager) GetStoreCache(key types.StoreKey, store t
 
 // Unwrap returns the underlying CommitKVStore for a given StoreKey.
 func (cmgr *CommitKVStoreCacheManager) Unwrap(key types.StoreKey) types.CommitKVStore {
+	cmgr.mtx.RLock()
+	defer cmgr.mtx.RUnlock()
+
 	if ckv, ok := cmgr.caches[key.Name()]; ok {
 		return ckv.(*CommitKVStoreCache).CommitKVStore
 	}
@@ -81,6 +102,9 @@ func (cmgr *CommitKVStoreCacheManager) Unwrap(key types.StoreKey) types.CommitKV
 
 // Reset resets in the internal caches.
 func (cmgr *CommitKVStoreCacheManager) Reset() {
+	cmgr.mtx.Lock()
+	defer cmgr.mtx.Unlock()
+
 	// Clear the map.
 	// Please note that we are purposefully using the map clearing idiom.
 	// See https://github.com/cosmos/cosmos-sdk/issues/6681.
@@ -89,6 +113,49 @@ func (cmgr *CommitKVStoreCacheManager) Reset() {
 	}
 }
 
+// Stats returns the statistics of the cache of each store, by store name.
+func (cmgr *CommitKVStoreCacheManager) Stats() map[string]types.PersistentCacheStats {
+	cmgr.mtx.RLock()
+	defer cmgr.mtx.RUnlock()
+
+	stats := make(map[string]types.PersistentCacheStats, len(cmgr.caches))
+	for name, ckv := range cmgr.caches {
+		stats[name] = ckv.(*CommitKVStoreCache).Stats()
+	}
+
+	return stats
+}
+
+// Stats returns the statistics of the cache. The size of the cached keys and
+// values is summed up on each call.
+func (ckv *CommitKVStoreCache) Stats() types.PersistentCacheStats {
+	stats := types.PersistentCacheStats{
+		Hits:      atomic.LoadUint64(&ckv.hits),
+		Misses:    atomic.LoadUint64(&ckv.misses),
+		Evictions: atomic.LoadUint64(&ckv.evictions),
+	}
+
+	for _, key := range ckv.cache.Keys() {
+		if value, ok := ckv.cache.Peek(key); ok {
+			stats.Entries++
+			stats.Bytes += int64(len(key.(string)) + len(value.([]byte)))
+		}
+	}
+
+	return stats
+}
+
+// add adds a key/value pair to the cache, counting the eviction of another
+// entry if the cache is full. The ARC cache has no eviction callback, so a
+// new entry added to a full cache is assumed to evict one.
+func (ckv *CommitKVStoreCache) add(key string, value []byte) {
+	if !ckv.cache.Contains(key) && ckv.cache.Len() >= ckv.size {
+		atomic.AddUint64(&ckv.evictions, 1)
+	}
+
+	ckv.cache.Add(key, value)
+}
+
 // CacheWrap returns the inter-block cache as a cache-wrapped CommitKVStore.
 func (ckv *CommitKVStoreCache) CacheWrap() types.CacheWrap {
 	return cachekv.NewStore(ckv)
@@ -104,12 +171,14 @@ func (ckv *CommitKVStoreCache) Get(key []byte) []byte {
 	valueI, ok := ckv.cache.Get(keyStr)
 	if ok {
 		// cache hit
+		atomic.AddUint64(&ckv.hits, 1)
 		return valueI.([]byte)
 	}
 
 	// cache miss; write to cache
+	atomic.AddUint64(&ckv.misses, 1)
 	value := ckv.CommitKVStore.Get(key)
-	ckv.cache.Add(keyStr, value)
+	ckv.add(keyStr, value)
 
 	return value
 }
@@ -120,7 +189,7 @@ func (ckv *CommitKVStoreCache) Set(key, value []byte) {
 	types.AssertValidKey(key)
 	types.AssertValidValue(value)
 
-	ckv.cache.Add(string(key), value)
+	ckv.add(string(key), value)
 	ckv.CommitKVStore.Set(key, value)
 }
 
@@ -25,6 +25,12 @@ func TestGetOrSetStoreCache(t *testing.T) {
 
 	require.NotNil(t, store2)
 	require.Equal(t, store2, mngr.GetStoreCache(sKey, store))
+
+	// a reloaded store replaces the cache of the previous one
+	store3 := iavlstore.UnsafeNewStore(tree)
+	store4 := mngr.GetStoreCache(sKey, store3)
+	require.False(t, store2 == store4)
+	require.Equal(t, store3, mngr.Unwrap(sKey))
 }
 
 func TestUnwrap(t *testing.T) {
@@ -67,3 +73,50 @@ func TestStoreCache(t *testing.T) {
 		require.Nil(t, store.Get(key))
 	}
 }
+
+func TestStoreCacheStats(t *testing.T) {
+	db := dbm.NewMemDB()
+	mngr := cache.NewCommitKVStoreCacheManager(2)
+
+	sKey := types.NewKVStoreKey("test")
+	tree, err := iavl.NewMutableTree(db, 100)
+	require.NoError(t, err)
+	store := iavlstore.UnsafeNewStore(tree)
+	store.Set([]byte("a"), []byte("1"))
+	kvStore := mngr.GetStoreCache(sKey, store)
+
+	require.Nil(t, kvStore.Get([]byte("missing")))          // miss
+	require.Equal(t, []byte("1"), kvStore.Get([]byte("a"))) // miss
+	require.Equal(t, []byte("1"), kvStore.Get([]byte("a"))) // hit
+	kvStore.Set([]byte("bb"), []byte("22"))                 // evicts an entry
+
+	require.Equal(t, map[string]types.PersistentCacheStats{
+		"test": {Entries: 2, Bytes: 6, Hits: 1, Misses: 2, Evictions: 1},
+	}, mngr.Stats())
+}
+
+func TestStoreCacheStatsConcurrent(t *testing.T) {
+	db := dbm.NewMemDB()
+	mngr := cache.NewCommitKVStoreCacheManager(cache.DefaultCommitKVStoreCacheSize)
+
+	tree, err := iavl.NewMutableTree(db, 100)
+	require.NoError(t, err)
+	store := iavlstore.UnsafeNewStore(tree)
+
+	// run with -race to detect unguarded access to the caches
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			mngr.GetStoreCache(types.NewKVStoreKey(fmt.Sprintf("store%d", i)), store)
+			if i%10 == 0 {
+				mngr.Reset()
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		mngr.Stats()
+	}
+	<-done
+}
@@ -36,7 +36,8 @@ var (
 
 // Store Implements types.KVStore and CommitKVStore.
 type Store struct {
-	tree Tree
+	tree  Tree
+	dirty bool
 }
 
 // LoadStore returns an IAVL Store as a CommitKVStore. Internally, it will load the
@@ -103,6 +104,27 @@ func (st *Store) GetImmutable(version int64) (*Store, error) {
 	}, nil
 }
 
+// Warmup loads the upper levels of the tree into the node cache, so that the
+// first reads after loading the store don't all have to fetch them from the DB.
+// It looks up leaves evenly spread across the tree, each loading the path from
+// the root, and makes no more lookups than the node cache can hold the paths
+// of. It returns the number of lookups made.
+func (st *Store) Warmup() int64 {
+	defer telemetry.MeasureSince(time.Now(), "store", "iavl", "warmup")
+
+	size, height := st.tree.Size(), int64(st.tree.Height())
+	lookups := defaultIAVLCacheSize / (height + 1)
+	if lookups > size {
+		lookups = size
+	}
+
+	for i := int64(0); i < lookups; i++ {
+		st.tree.GetByIndex(i * size / lookups)
+	}
+
+	return lookups
+}
+
 // Commit commits the current store state and returns a CommitID with the new
 // version and hash.
 func (st *Store) Commit() types.CommitID {
@@ -112,6 +134,7 @@ func (st *Store) Commit() types.CommitID {
 	if err != nil {
 		panic(err)
 	}
+	st.dirty = false
 
 	return types.CommitID{
 		Version: version,
@@ -139,6 +162,14 @@ func (st *Store) GetPruning() types.PruningOptions {
 	panic("cannot get pruning options on an initialized IAVL store")
 }
 
+// HasUncommittedWrites returns whether Set or Delete has been called since the
+// store was loaded or last committed. Unlike comparing WorkingHash with the
+// last commit hash, it doesn't hash the working tree, but it also reports
+// writes that left the tree unchanged, e.g. setting a key to its current value.
+func (st *Store) HasUncommittedWrites() bool {
+	return st.dirty
+}
+
 // VersionExists returns whether or not a given version is stored.
 func (st *Store) VersionExists(version int64) bool {
 	return st.tree.VersionExists(version)
@@ -164,6 +195,7 @@ func (st *Store) Set(key, value []byte) {
 	types.AssertValidKey(key)
 	types.AssertValidValue(value)
 	st.tree.Set(key, value)
+	st.dirty = true
 }
 
 // Implements types.KVStore.
@@ -183,6 +215,7 @@ func (st *Store) Has(key []byte) (exists bool) {
 func (st *Store) Delete(key []byte) {
 	defer telemetry.MeasureSince(time.Now(), "store", "iavl", "delete")
 	st.tree.Remove(key)
+	st.dirty = true
 }
 
 // DeleteVersions deletes a series of versions from the MutableTree. An error
@@ -192,6 +225,47 @@ func (st *Store) DeleteVersions(versions ...int64) error {
 	return st.tree.DeleteVersions(versions...)
 }
 
+// WorkingHash returns the hash the tree would have if its working state was
+// saved as a new version, without saving it. Immutable trees return their hash.
+func (st *Store) WorkingHash() []byte {
+	tree, ok := st.tree.(*iavl.MutableTree)
+	if !ok {
+		return st.tree.Hash()
+	}
+	return tree.WorkingHash()
+}
+
+// AvailableVersions returns the versions persisted in the tree in ascending
+// order, or nil if the store is an immutable view of a single version.
+func (st *Store) AvailableVersions() []int {
+	tree, ok := st.tree.(*iavl.MutableTree)
+	if !ok {
+		return nil
+	}
+	return tree.AvailableVersions()
+}
+
+// Size returns the number of keys in the working tree, or in the loaded
+// version if the store is an immutable view.
+func (st *Store) Size() int64 {
+	return st.tree.Size()
+}
+
+// LoadVersionForOverwriting loads the tree at the given version and deletes
+// all versions greater than it, returning the loaded version.
+func (st *Store) LoadVersionForOverwriting(targetVersion int64) (int64, error) {
+	tree, ok := st.tree.(*iavl.MutableTree)
+	if !ok {
+		return 0, errors.New("iavl rollback failed: unable to find mutable tree")
+	}
+	version, err := tree.LoadVersionForOverwriting(targetVersion)
+	if err != nil {
+		return 0, err
+	}
+	st.dirty = false
+	return version, nil
+}
+
 // Implements types.KVStore.
 func (st *Store) Iterator(start, end []byte) types.Iterator {
 	var iTree *iavl.ImmutableTree
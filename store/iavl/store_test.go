@@ -633,3 +633,58 @@ func TestSetInitialVersion(t *testing.T) {
 		})
 	}
 }
+
+// countingDB counts the reads hitting the underlying DB.
+type countingDB struct {
+	dbm.DB
+	gets int
+}
+
+func (db *countingDB) Get(key []byte) ([]byte, error) {
+	db.gets++
+	return db.DB.Get(key)
+}
+
+func TestIAVLStoreWarmup(t *testing.T) {
+	db := &countingDB{DB: dbm.NewMemDB()}
+	store, err := LoadStore(db, types.CommitID{}, false)
+	require.NoError(t, err)
+	require.Zero(t, store.(*Store).Warmup())
+
+	for i := 0; i < 2000; i++ {
+		store.Set([]byte(fmt.Sprintf("key%04d", i)), []byte{byte(i)})
+	}
+	id := store.Commit()
+
+	store, err = LoadStore(db, id, false)
+	require.NoError(t, err)
+
+	// the nodes loaded by a warmup stay cached
+	db.gets = 0
+	lookups := store.(*Store).Warmup()
+	require.Greater(t, lookups, int64(0))
+	require.LessOrEqual(t, lookups, int64(2000))
+	require.Greater(t, db.gets, 0)
+
+	db.gets = 0
+	require.Equal(t, lookups, store.(*Store).Warmup())
+	require.Zero(t, db.gets)
+}
+
+func TestIAVLStoreHasUncommittedWrites(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree, _ := newAlohaTree(t, db)
+	iavlStore := UnsafeNewStore(tree)
+	require.False(t, iavlStore.HasUncommittedWrites())
+
+	iavlStore.Set([]byte("hello"), []byte("world"))
+	require.True(t, iavlStore.HasUncommittedWrites())
+	iavlStore.Commit()
+	require.False(t, iavlStore.HasUncommittedWrites())
+
+	iavlStore.Delete([]byte("hello"))
+	require.True(t, iavlStore.HasUncommittedWrites())
+	_, err := iavlStore.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	require.False(t, iavlStore.HasUncommittedWrites())
+}
@@ -26,6 +26,9 @@ type (
 		DeleteVersions(versions ...int64) error
 		Version() int64
 		Hash() []byte
+		Size() int64
+		Height() int8
+		GetByIndex(index int64) (key []byte, value []byte)
 		VersionExists(version int64) bool
 		GetVersioned(key []byte, version int64) (int64, []byte)
 		GetVersionedWithProof(key []byte, version int64) ([]byte, *iavl.RangeProof, error)
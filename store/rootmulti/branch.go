@@ -0,0 +1,231 @@
+package rootmulti
+
+import (
+	"errors"
+
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/cachekv"
+	"github.com/cosmos/cosmos-sdk/store/dbadapter"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+var (
+	_ dbm.DB    = (*branchDB)(nil)
+	_ dbm.Batch = (*branchBatch)(nil)
+
+	errBranchKeyEmpty    = errors.New("key cannot be empty")
+	errBranchValueNil    = errors.New("value cannot be nil")
+	errBranchBatchClosed = errors.New("batch has been written or closed")
+)
+
+//----------------------------------------
+// branchDB is used as the DB of a branched root store. Reads fall through to
+// the parent DB, while writes are kept in memory and never reach the parent,
+// so the branch can commit real IAVL versions without touching the disk.
+
+// Wrapper type for a dbm.DB which buffers all writes in memory
+type branchDB struct {
+	cache *cachekv.Store
+}
+
+func newBranchDB(parent dbm.DB) *branchDB {
+	return &branchDB{cache: cachekv.NewStore(dbadapter.Store{DB: parent})}
+}
+
+func (db *branchDB) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errBranchKeyEmpty
+	}
+	return db.cache.Get(key), nil
+}
+
+func (db *branchDB) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, errBranchKeyEmpty
+	}
+	return db.cache.Has(key), nil
+}
+
+func (db *branchDB) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errBranchKeyEmpty
+	}
+	if value == nil {
+		return errBranchValueNil
+	}
+	db.cache.Set(key, value)
+	return nil
+}
+
+func (db *branchDB) SetSync(key, value []byte) error {
+	return db.Set(key, value)
+}
+
+func (db *branchDB) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errBranchKeyEmpty
+	}
+	db.cache.Delete(key)
+	return nil
+}
+
+func (db *branchDB) DeleteSync(key []byte) error {
+	return db.Delete(key)
+}
+
+func (db *branchDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errBranchKeyEmpty
+	}
+	return db.cache.Iterator(start, end), nil
+}
+
+func (db *branchDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errBranchKeyEmpty
+	}
+	return db.cache.ReverseIterator(start, end), nil
+}
+
+// Close is a no-op, the parent DB is owned by the parent store.
+func (db *branchDB) Close() error { return nil }
+
+func (db *branchDB) NewBatch() dbm.Batch {
+	return &branchBatch{db: db}
+}
+
+func (db *branchDB) Print() error { return nil }
+
+func (db *branchDB) Stats() map[string]string {
+	return map[string]string{"database.type": "branchDB"}
+}
+
+type branchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// branchBatch buffers the writes of a batch until it is written to the
+// branchDB it was created from.
+type branchBatch struct {
+	db  *branchDB
+	ops []branchOp
+}
+
+func (b *branchBatch) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errBranchKeyEmpty
+	}
+	if value == nil {
+		return errBranchValueNil
+	}
+	if b.db == nil {
+		return errBranchBatchClosed
+	}
+	b.ops = append(b.ops, branchOp{key: key, value: value})
+	return nil
+}
+
+func (b *branchBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errBranchKeyEmpty
+	}
+	if b.db == nil {
+		return errBranchBatchClosed
+	}
+	b.ops = append(b.ops, branchOp{key: key, delete: true})
+	return nil
+}
+
+func (b *branchBatch) Write() error {
+	if b.db == nil {
+		return errBranchBatchClosed
+	}
+	for _, op := range b.ops {
+		if op.delete {
+			b.db.cache.Delete(op.key)
+		} else {
+			b.db.cache.Set(op.key, op.value)
+		}
+	}
+	return b.Close()
+}
+
+func (b *branchBatch) WriteSync() error {
+	return b.Write()
+}
+
+func (b *branchBatch) Close() error {
+	b.db, b.ops = nil, nil
+	return nil
+}
+
+// Branch returns a copy of the store at its last committed version for
+// speculative execution. The branch is a fully functional CommitMultiStore:
+// its Commit persists IAVL versions and commit info and hence returns the
+// exact app hash the same writes would produce on this store, but everything
+// it writes is kept in memory and the DBs of this store are never modified.
+// Uncommitted writes to this store are not part of the branch.
+//
+// Transient stores start out empty and memory stores are copied. To keep the
+// outcome of a branch, the same writes must be applied to this store; a
+// branch is discarded by simply dropping it. The branch is only valid as long
+// as this store is not committed or closed.
+func (rs *Store) Branch() (*Store, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	branched := NewStore(newBranchDB(rs.db))
+	branched.pruningOpts = rs.pruningOpts
+	branched.storePrefixer = rs.storePrefixer
+	branched.initialVersion = rs.initialVersion
+	branched.commitWorkers = rs.commitWorkers
+	branched.traceWriter = rs.traceWriter
+	branched.traceContext = rs.traceContext
+	branched.cInfoCodec = rs.cInfoCodec
+	branched.logger = rs.logger
+	branched.lazyLoading = rs.lazyLoading
+
+	// stores mounted with their own DB get an in-memory branch of that DB,
+	// shared by all stores mounted with it
+	ownDBs := make(map[dbm.DB]dbm.DB)
+	for key, params := range rs.storesParams {
+		if params.db != nil {
+			if _, ok := ownDBs[params.db]; !ok {
+				ownDBs[params.db] = newBranchDB(params.db)
+			}
+			params.db = ownDBs[params.db]
+		}
+
+		branched.storesParams[key] = params
+		branched.keysByName[key.Name()] = key
+		branched.tracingExcluded[key] = rs.tracingExcluded[key]
+	}
+
+	if err := branched.LoadVersion(rs.lastCommitInfo.GetVersion()); err != nil {
+		return nil, err
+	}
+
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeMemory {
+			continue
+		}
+
+		dst := branched.stores[key]
+		if err := iterateBatches(store, func(keys, values [][]byte) {
+			for i := range keys {
+				dst.Set(keys[i], values[i])
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return branched, nil
+}
@@ -0,0 +1,124 @@
+package rootmulti
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/cosmos/cosmos-sdk/store/cachekv"
+	"github.com/cosmos/cosmos-sdk/store/tracekv"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// Change set record operations.
+const (
+	ChangeSetOpSet    byte = 0
+	ChangeSetOpDelete byte = 1
+)
+
+var _ types.KVStore = changeSetKVStore{}
+
+// changeSet accumulates the writes applied to the sub-stores of a root store
+// between two commits, encoded in the change set format documented on
+// SetChangeSetWriter.
+type changeSet struct {
+	mtx     sync.Mutex
+	records []byte
+	count   uint64
+	stores  map[string]bool // names of the stores with recorded writes
+}
+
+func (cs *changeSet) add(storeName string, op byte, key, value []byte) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	cs.records = appendBytes(cs.records, []byte(storeName))
+	cs.records = append(cs.records, op)
+	cs.records = appendBytes(cs.records, key)
+	if op == ChangeSetOpSet {
+		cs.records = appendBytes(cs.records, value)
+	}
+	cs.count++
+
+	if cs.stores == nil {
+		cs.stores = make(map[string]bool)
+	}
+	cs.stores[storeName] = true
+}
+
+// recorded returns whether any write to the named store has been recorded.
+func (cs *changeSet) recorded(storeName string) bool {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	return cs.stores[storeName]
+}
+
+// flush writes the accumulated records as a single block for the given version
+// with one call to w.Write, and resets the change set. If the write fails, the
+// records are kept.
+func (cs *changeSet) flush(w io.Writer, version int64) error {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	block := appendUvarint(nil, uint64(version))
+	block = appendUvarint(block, cs.count)
+	block = append(block, cs.records...)
+
+	if _, err := w.Write(appendBytes(nil, block)); err != nil {
+		return err
+	}
+
+	cs.records, cs.count, cs.stores = nil, 0, nil
+	return nil
+}
+
+// reset discards the accumulated records.
+func (cs *changeSet) reset() {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	cs.records, cs.count, cs.stores = nil, 0, nil
+}
+
+func appendBytes(buf, bz []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(bz)))
+	return append(buf, bz...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+//----------------------------------------
+// changeSetKVStore is used to hand sub-stores to callers of the root store
+// while a change set writer is set, so that every write applied to the
+// sub-store, including writes flushed from a cache wrapping it, is recorded.
+
+// Wrapper type for a KVStore which records every write in a change set
+type changeSetKVStore struct {
+	types.KVStore
+
+	name      string
+	changeSet *changeSet
+}
+
+func (cs changeSetKVStore) Set(key, value []byte) {
+	cs.KVStore.Set(key, value)
+	cs.changeSet.add(cs.name, ChangeSetOpSet, key, value)
+}
+
+func (cs changeSetKVStore) Delete(key []byte) {
+	cs.KVStore.Delete(key)
+	cs.changeSet.add(cs.name, ChangeSetOpDelete, key, nil)
+}
+
+func (cs changeSetKVStore) CacheWrap() types.CacheWrap {
+	return cachekv.NewStore(cs)
+}
+
+func (cs changeSetKVStore) CacheWrapWithTrace(w io.Writer, tc types.TraceContext) types.CacheWrap {
+	return cachekv.NewStore(tracekv.NewStore(cs, w, tc))
+}
@@ -0,0 +1,83 @@
+package rootmulti
+
+import (
+	"fmt"
+
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// CommitInfoCodec encodes the commit info persisted for each version, see
+// SetCommitInfoCodec. Its name is recorded in the DB, so a DB written with one
+// codec is never decoded with another.
+type CommitInfoCodec interface {
+	// Name uniquely identifies the encoding. It must not change for as long as
+	// DBs written with the codec are in use.
+	Name() string
+
+	Marshal(cInfo *types.CommitInfo) ([]byte, error)
+	Unmarshal(bz []byte, cInfo *types.CommitInfo) error
+}
+
+// DefaultCommitInfoCodec is the CommitInfoCodec used by NewStore. It encodes
+// commit infos as protobuf, as all DBs written before codecs were configurable.
+var DefaultCommitInfoCodec CommitInfoCodec = protoCommitInfoCodec{}
+
+type protoCommitInfoCodec struct{}
+
+func (protoCommitInfoCodec) Name() string { return "proto" }
+
+func (protoCommitInfoCodec) Marshal(cInfo *types.CommitInfo) ([]byte, error) {
+	return cInfo.Marshal()
+}
+
+func (protoCommitInfoCodec) Unmarshal(bz []byte, cInfo *types.CommitInfo) error {
+	return cInfo.Unmarshal(bz)
+}
+
+// getCommitInfoCodecName returns the name of the codec the commit infos in the
+// DB are encoded with, or an empty string if nothing has been committed yet.
+// DBs without a recorded codec were written with DefaultCommitInfoCodec.
+func getCommitInfoCodecName(db dbm.DB) (string, error) {
+	bz, err := db.Get([]byte(commitInfoCodecKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to get commit info codec: %w", err)
+	} else if bz != nil {
+		return string(bz), nil
+	}
+
+	latest, err := getLatestVersion(db)
+	if err != nil || latest == 0 {
+		return "", err
+	}
+
+	return DefaultCommitInfoCodec.Name(), nil
+}
+
+// checkCommitInfoCodec returns an error if the commit infos in the DB are
+// encoded with a different codec than the given one.
+func checkCommitInfoCodec(db dbm.DB, codec CommitInfoCodec) error {
+	name, err := getCommitInfoCodecName(db)
+	if err != nil {
+		return err
+	}
+
+	if name != "" && name != codec.Name() {
+		return fmt.Errorf(
+			"commit infos in the DB are encoded with codec %q, but the store is configured with codec %q",
+			name, codec.Name())
+	}
+
+	return nil
+}
+
+// setCommitInfoCodec records the codec commit infos are encoded with. Nothing
+// is recorded for DefaultCommitInfoCodec, which DBs without a record use.
+func setCommitInfoCodec(batch dbm.Batch, codec CommitInfoCodec) {
+	if codec.Name() == DefaultCommitInfoCodec.Name() {
+		return
+	}
+
+	batch.Set([]byte(commitInfoCodecKey), []byte(codec.Name()))
+}
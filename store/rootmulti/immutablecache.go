@@ -0,0 +1,98 @@
+package rootmulti
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/cosmos/cosmos-sdk/store/iavl"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+// immutableStoreCache memoizes the immutable IAVL stores loaded for a version,
+// see SetImmutableCacheSize, evicting the least recently used version once
+// more than size versions are cached. Versions must be evicted when they are
+// pruned, as their trees can't be read anymore afterwards.
+type immutableStoreCache struct {
+	mtx      sync.Mutex
+	size     int
+	order    *list.List // of *immutableStores, most recently used first
+	versions map[int64]*list.Element
+
+	// generation is incremented on every eviction, so that stores loaded
+	// concurrently with pruning aren't added back after their version has been
+	// evicted.
+	generation uint64
+}
+
+type immutableStores struct {
+	version int64
+	stores  map[types.StoreKey]*iavl.Store
+}
+
+func newImmutableStoreCache(size int) *immutableStoreCache {
+	return &immutableStoreCache{
+		size:     size,
+		order:    list.New(),
+		versions: make(map[int64]*list.Element),
+	}
+}
+
+// get returns the cached stores of the given version, if any, and the current
+// generation to pass to add if they have to be loaded.
+func (c *immutableStoreCache) get(version int64) (map[types.StoreKey]*iavl.Store, uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.versions[version]
+	if !ok {
+		return nil, c.generation
+	}
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*immutableStores).stores, c.generation
+}
+
+// add caches the stores of the given version, unless anything has been evicted
+// since the given generation was returned by get.
+func (c *immutableStoreCache) add(version int64, stores map[types.StoreKey]*iavl.Store, generation uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.versions[version]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.versions[version] = c.order.PushFront(&immutableStores{version: version, stores: stores})
+	for c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(*immutableStores)
+		delete(c.versions, oldest.version)
+	}
+}
+
+// evict removes the given versions from the cache.
+func (c *immutableStoreCache) evict(versions ...int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.generation++
+	for _, version := range versions {
+		if elem, ok := c.versions[version]; ok {
+			c.order.Remove(elem)
+			delete(c.versions, version)
+		}
+	}
+}
+
+// reset removes all versions from the cache.
+func (c *immutableStoreCache) reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.generation++
+	c.order.Init()
+	c.versions = make(map[int64]*list.Element)
+}
@@ -0,0 +1,41 @@
+package rootmulti
+
+import "time"
+
+// StoreMetrics receives instrumentation from a Store, see SetMetrics. All calls
+// are made synchronously from the goroutine calling into the Store, so
+// implementations should return quickly.
+type StoreMetrics interface {
+	// StoreCommitted is called by Commit for each committed store with the
+	// resulting version and the time the store took to commit.
+	StoreCommitted(storeName string, version int64, duration time.Duration)
+
+	// Committed is called at the end of Commit with the committed version and
+	// the time taken by the whole commit, including pruning and flushing
+	// metadata.
+	Committed(version int64, duration time.Duration)
+
+	// VersionLoaded is called after a version has been successfully loaded with
+	// the loaded version and the time taken to load it.
+	VersionLoaded(version int64, duration time.Duration)
+
+	// Queried is called after each Query with the request path, the response
+	// code and the time taken to answer it.
+	Queried(path string, code uint32, duration time.Duration)
+
+	// StoreSize is called by ReportStoreSizes for each IAVL store with the
+	// number of keys in its working tree.
+	StoreSize(storeName string, numKeys int64)
+}
+
+// NoopStoreMetrics is a StoreMetrics that discards everything. It is what a
+// Store reports to unless SetMetrics is called.
+type NoopStoreMetrics struct{}
+
+var _ StoreMetrics = NoopStoreMetrics{}
+
+func (NoopStoreMetrics) StoreCommitted(string, int64, time.Duration) {}
+func (NoopStoreMetrics) Committed(int64, time.Duration)              {}
+func (NoopStoreMetrics) VersionLoaded(int64, time.Duration)          {}
+func (NoopStoreMetrics) Queried(string, uint32, time.Duration)       {}
+func (NoopStoreMetrics) StoreSize(string, int64)                     {}
@@ -1,9 +1,12 @@
 package rootmulti
 
 import (
+	"bytes"
+
 	"github.com/tendermint/tendermint/crypto/merkle"
 
 	storetypes "github.com/cosmos/cosmos-sdk/store/types"
+	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
 )
 
 // RequireProof returns whether proof is required for the subpath.
@@ -25,3 +28,36 @@ func DefaultProofRuntime() (prt *merkle.ProofRuntime) {
 	prt.RegisterOpDecoder(storetypes.ProofOpSimpleMerkleCommitment, storetypes.CommitmentOpDecoder)
 	return
 }
+
+// VerifyMultiStoreProof verifies a query result returned by Store.Query
+// against a known app hash. subProof is the sub-store commitment proof for the
+// queried key and multiProof is the multistore commitment proof appended by
+// Store.Query; the sub-store root computed from subProof is folded into the
+// commit info map hash via multiProof and compared with appHash. A nil value
+// verifies the absence of the key instead of its existence.
+func VerifyMultiStoreProof(appHash []byte, storeName string, value []byte, subProof, multiProof storetypes.CommitmentOp) error {
+	if string(multiProof.GetKey()) != storeName {
+		return sdkerrors.Wrapf(storetypes.ErrInvalidProof, "multistore proof is for store %s, expected %s", multiProof.GetKey(), storeName)
+	}
+
+	var args [][]byte
+	if value != nil {
+		args = [][]byte{value}
+	}
+
+	storeRoot, err := subProof.Run(args)
+	if err != nil {
+		return err
+	}
+
+	root, err := multiProof.Run(storeRoot)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(root[0], appHash) {
+		return sdkerrors.Wrapf(storetypes.ErrInvalidProof, "computed app hash %X does not match expected %X", root[0], appHash)
+	}
+
+	return nil
+}
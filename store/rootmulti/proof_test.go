@@ -146,3 +146,47 @@ func TestVerifyMultiStoreQueryProofAbsence(t *testing.T) {
 	err = prt.VerifyValue(res.ProofOps, cid.Hash, "/iavlStoreKey/MYABSENTKEY", []byte(""))
 	require.NotNil(t, err)
 }
+
+func TestVerifyMultiStoreProof(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db)
+	iavlStoreKey := types.NewKVStoreKey("iavlStoreKey")
+
+	store.MountStoreWithDB(iavlStoreKey, types.StoreTypeIAVL, nil)
+	require.NoError(t, store.LoadVersion(0))
+
+	iavlStore := store.GetCommitStore(iavlStoreKey).(*iavl.Store)
+	iavlStore.Set([]byte("MYKEY"), []byte("MYVALUE"))
+	cid := store.Commit()
+
+	decodeOps := func(res abci.ResponseQuery) (types.CommitmentOp, types.CommitmentOp) {
+		require.NotNil(t, res.ProofOps)
+		require.Len(t, res.ProofOps.Ops, 2)
+		subProof, err := types.CommitmentOpDecoder(res.ProofOps.Ops[0])
+		require.NoError(t, err)
+		multiProof, err := types.CommitmentOpDecoder(res.ProofOps.Ops[1])
+		require.NoError(t, err)
+		return subProof.(types.CommitmentOp), multiProof.(types.CommitmentOp)
+	}
+
+	subProof, multiProof := decodeOps(store.Query(abci.RequestQuery{
+		Path:  "/iavlStoreKey/key",
+		Data:  []byte("MYKEY"),
+		Prove: true,
+	}))
+
+	require.NoError(t, VerifyMultiStoreProof(cid.Hash, "iavlStoreKey", []byte("MYVALUE"), subProof, multiProof))
+	require.Error(t, VerifyMultiStoreProof(cid.Hash, "iavlStoreKey", []byte("MYVALUE_NOT"), subProof, multiProof))
+	require.Error(t, VerifyMultiStoreProof(cid.Hash, "otherStore", []byte("MYVALUE"), subProof, multiProof))
+	require.Error(t, VerifyMultiStoreProof([]byte("badhash"), "iavlStoreKey", []byte("MYVALUE"), subProof, multiProof))
+
+	// absence
+	subProof, multiProof = decodeOps(store.Query(abci.RequestQuery{
+		Path:  "/iavlStoreKey/key",
+		Data:  []byte("MYABSENTKEY"),
+		Prove: true,
+	}))
+
+	require.NoError(t, VerifyMultiStoreProof(cid.Hash, "iavlStoreKey", nil, subProof, multiProof))
+	require.Error(t, VerifyMultiStoreProof(cid.Hash, "iavlStoreKey", []byte(""), subProof, multiProof))
+}
@@ -0,0 +1,36 @@
+package rootmulti
+
+import (
+	"io"
+
+	"github.com/cosmos/cosmos-sdk/store/cachekv"
+	"github.com/cosmos/cosmos-sdk/store/tracekv"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+var _ types.KVStore = readOnlyKVStore{}
+
+//----------------------------------------
+// readOnlyKVStore is used by a read-only root store to guard its sub-stores
+// against writes, including writes flushed from a cache wrapping it.
+
+// Wrapper type for a KVStore which panics on every write
+type readOnlyKVStore struct {
+	types.KVStore
+}
+
+func (ros readOnlyKVStore) Set(_, _ []byte) {
+	panic(types.ErrReadOnly)
+}
+
+func (ros readOnlyKVStore) Delete(_ []byte) {
+	panic(types.ErrReadOnly)
+}
+
+func (ros readOnlyKVStore) CacheWrap() types.CacheWrap {
+	return cachekv.NewStore(ros)
+}
+
+func (ros readOnlyKVStore) CacheWrapWithTrace(w io.Writer, tc types.TraceContext) types.CacheWrap {
+	return cachekv.NewStore(tracekv.NewStore(ros, w, tc))
+}
@@ -2,19 +2,28 @@ package rootmulti
 
 import (
 	"bufio"
+	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	iavltree "github.com/cosmos/iavl"
 	protoio "github.com/gogo/protobuf/io"
+	"github.com/gogo/protobuf/proto"
 	gogotypes "github.com/gogo/protobuf/types"
 	"github.com/pkg/errors"
 	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/libs/log"
+	tmcrypto "github.com/tendermint/tendermint/proto/tendermint/crypto"
 	dbm "github.com/tendermint/tm-db"
 
 	"github.com/cosmos/cosmos-sdk/snapshots"
@@ -23,41 +32,116 @@ import (
 	"github.com/cosmos/cosmos-sdk/store/dbadapter"
 	"github.com/cosmos/cosmos-sdk/store/iavl"
 	"github.com/cosmos/cosmos-sdk/store/mem"
+	"github.com/cosmos/cosmos-sdk/store/prefix"
 	"github.com/cosmos/cosmos-sdk/store/tracekv"
 	"github.com/cosmos/cosmos-sdk/store/transient"
 	"github.com/cosmos/cosmos-sdk/store/types"
 	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+	"github.com/cosmos/cosmos-sdk/types/kv"
+	"github.com/cosmos/cosmos-sdk/types/query"
 )
 
 const (
-	latestVersionKey = "s/latest"
-	pruneHeightsKey  = "s/pruneheights"
-	commitInfoKeyFmt = "s/%d" // s/<version>
+	latestVersionKey   = "s/latest"
+	pruneHeightsKey    = "s/pruneheights"
+	commitInfoCodecKey = "s/codec"
+	commitInfoKeyFmt   = "s/%d" // s/<version>
 
 	// Do not change chunk size without new snapshot format (must be uniform across nodes)
 	snapshotChunkSize   = uint64(10e6)
 	snapshotBufferSize  = int(snapshotChunkSize)
 	snapshotMaxItemSize = int(64e6) // SDK has no key/value size limit, so we set an arbitrary limit
+
+	// Do not change compression level without new snapshot format (must be uniform across nodes)
+	snapshotCompressionLevel = 7
+
+	// number of keys sampled per store by EstimateSnapshotSize
+	snapshotSizeSampleKeys = 1000
+
+	// number of items a store export may run ahead of the snapshot writer
+	snapshotExportBufferSize = 1024
+)
+
+// TraceContextStoreKey is the trace context key under which GetKVStore records
+// the name of the store each traced operation was performed on.
+const TraceContextStoreKey = "store"
+
+// LoadMode defines how a Store handles sub-stores that fail to load.
+type LoadMode int
+
+const (
+	// LoadModeStrict fails loading on the first sub-store that fails to load.
+	// This is the default.
+	LoadModeStrict LoadMode = iota
+
+	// LoadModeCollect attempts to load every sub-store and fails with an error
+	// reporting all sub-stores that failed to load.
+	LoadModeCollect
+
+	// LoadModeDegraded attempts to load every sub-store and leaves the ones that
+	// failed to load unmounted, see FailedStores. Loading succeeds, but the store
+	// refuses to Commit, so it can only be used to inspect the healthy stores.
+	LoadModeDegraded
 )
 
 // Store is composed of many CommitStores. Name contrasts with
 // cacheMultiStore which is for cache-wrapping other MultiStores. It implements
 // the CommitMultiStore interface.
+//
+// Concurrency: Commit, LoadVersion and Close must be called from a single
+// goroutine, as must all other methods that modify the store, e.g. setters and
+// mounts. Query, QueryKeys, QuerySubspace, CacheMultiStore,
+// CacheMultiStoreWithVersion, GetVersionedMultiStore, Branch,
+// CommitIDForVersion, GetKVStore, GetKVStoreSafe, IterateVersioned,
+// ReverseIterateVersioned, LastCommitID and Warmup may be called concurrently
+// with them and each other: Commit swaps in the new version under a write lock
+// that these readers take a read lock on, so they observe either the previous
+// or the new version, never a partially committed one. Stores returned by
+// GetKVStore are not themselves synchronized, and must not be written to
+// concurrently with Commit.
 type Store struct {
-	db             dbm.DB
-	lastCommitInfo *types.CommitInfo
-	pruningOpts    types.PruningOptions
-	storesParams   map[types.StoreKey]storeParams
-	stores         map[types.StoreKey]types.CommitKVStore
-	keysByName     map[string]types.StoreKey
-	lazyLoading    bool
-	pruneHeights   []int64
-	initialVersion int64
-
-	traceWriter  io.Writer
-	traceContext types.TraceContext
+	mtx sync.RWMutex // guards the loaded version, i.e. lastCommitInfo and stores
+
+	db              dbm.DB
+	lastCommitInfo  *types.CommitInfo
+	lastCommitHash  commitHashCache
+	pruningOpts     types.PruningOptions
+	pendingPruning  *types.PruningOptions
+	storesParams    map[types.StoreKey]storeParams
+	stores          map[types.StoreKey]types.CommitKVStore
+	keysByName      map[string]types.StoreKey
+	lazyLoading     bool
+	storePrefixer   StorePrefixer
+	cInfoCodec      CommitInfoCodec
+	pruneHeights    []int64
+	initialVersion  int64
+	commitWorkers   int
+	loadErr         error
+	loadMode        LoadMode
+	failedStores    map[string]error
+	renamedFrom     []renamedStore
+	unmounted       []string
+	rejectUnmounted bool
+	storesToLoad    map[types.StoreKey]bool
+	readOnly        bool
+	syncCommits     bool
+	skipStoreProofs bool
+	maxQuerySize    int
+	closed          bool
+
+	traceWriter     io.Writer
+	traceContext    types.TraceContext
+	tracingExcluded map[types.StoreKey]bool
+
+	changeSetWriter io.Writer
+	changeSet       *changeSet
 
 	interBlockCache types.MultiStorePersistentCache
+	immutableCache  *immutableStoreCache // nil if disabled
+
+	metrics         StoreMetrics
+	logger          log.Logger
+	commitListeners []func(types.CommitID)
 }
 
 var (
@@ -65,18 +149,119 @@ var (
 	_ types.Queryable        = (*Store)(nil)
 )
 
+// Options configures a Store constructed with NewStoreWithOptions. Each field
+// has the same effect as the setter of the same name, but takes effect
+// atomically at construction. Start from DefaultOptions, as the zero value of
+// Pruning is not PruneNothing.
+type Options struct {
+	Pruning               types.PruningOptions
+	LazyLoading           bool
+	InterBlockCache       types.MultiStorePersistentCache
+	Tracer                io.Writer
+	TracingContext        types.TraceContext
+	InitialVersion        uint64
+	ReadOnly              bool
+	SyncCommits           bool
+	SkipMultiStoreProofs  bool
+	MaxQueryResponseSize  int
+	CommitWorkers         int
+	ImmutableCacheSize    int
+	LoadMode              LoadMode
+	RejectUnmountedStores bool
+	Metrics               StoreMetrics    // nil for no-op metrics
+	Logger                log.Logger      // nil for a no-op logger
+	StorePrefixer         StorePrefixer   // nil for DefaultStorePrefixer
+	CommitInfoCodec       CommitInfoCodec // nil for DefaultCommitInfoCodec
+	ChangeSetWriter       io.Writer       // nil to not record change sets
+}
+
+// DefaultOptions returns the Options NewStore constructs a Store with, i.e. a
+// PruneNothing pruning strategy and every other option at its default.
+func DefaultOptions() Options {
+	return Options{
+		Pruning: types.PruneNothing,
+	}
+}
+
 // NewStore returns a reference to a new Store object with the provided DB. The
 // store will be created with a PruneNothing pruning strategy by default. After
 // a store is created, KVStores must be mounted and finally LoadLatestVersion or
 // LoadVersion must be called.
 func NewStore(db dbm.DB) *Store {
-	return &Store{
-		db:           db,
-		pruningOpts:  types.PruneNothing,
-		storesParams: make(map[types.StoreKey]storeParams),
-		stores:       make(map[types.StoreKey]types.CommitKVStore),
-		keysByName:   make(map[string]types.StoreKey),
-		pruneHeights: make([]int64, 0),
+	return NewStoreWithOptions(db, DefaultOptions())
+}
+
+// NewStoreWithOptions returns a reference to a new Store object with the
+// provided DB, configured with opts. As with NewStore, KVStores must then be
+// mounted and a version loaded.
+func NewStoreWithOptions(db dbm.DB, opts Options) *Store {
+	rs := &Store{
+		db:              db,
+		pruningOpts:     opts.Pruning,
+		storesParams:    make(map[types.StoreKey]storeParams),
+		stores:          make(map[types.StoreKey]types.CommitKVStore),
+		keysByName:      make(map[string]types.StoreKey),
+		lazyLoading:     opts.LazyLoading,
+		pruneHeights:    make([]int64, 0),
+		initialVersion:  int64(opts.InitialVersion),
+		commitWorkers:   opts.CommitWorkers,
+		loadMode:        opts.LoadMode,
+		rejectUnmounted: opts.RejectUnmountedStores,
+		readOnly:        opts.ReadOnly,
+		syncCommits:     opts.SyncCommits,
+		skipStoreProofs: opts.SkipMultiStoreProofs,
+		maxQuerySize:    opts.MaxQueryResponseSize,
+		traceWriter:     opts.Tracer,
+		traceContext:    opts.TracingContext,
+		tracingExcluded: make(map[types.StoreKey]bool),
+		interBlockCache: opts.InterBlockCache,
+	}
+
+	rs.SetMetrics(opts.Metrics)
+	rs.SetLogger(opts.Logger)
+	rs.SetStorePrefixer(opts.StorePrefixer)
+	rs.SetCommitInfoCodec(opts.CommitInfoCodec)
+	rs.SetImmutableCacheSize(opts.ImmutableCacheSize)
+	if opts.ChangeSetWriter != nil {
+		rs.SetChangeSetWriter(opts.ChangeSetWriter)
+	}
+
+	return rs
+}
+
+// SetMetrics sets the StoreMetrics that Commit, version loading and Query
+// report to. Passing nil restores the default no-op metrics.
+func (rs *Store) SetMetrics(metrics StoreMetrics) {
+	if metrics == nil {
+		metrics = NoopStoreMetrics{}
+	}
+
+	rs.metrics = metrics
+}
+
+// SetLogger sets the logger that store upgrades, rollbacks, stores that fail
+// to load or are persisted but not mounted, and stores skipped by snapshots are
+// reported to. Passing nil restores the default no-op logger.
+func (rs *Store) SetLogger(logger log.Logger) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	rs.logger = logger.With("module", "rootmulti")
+}
+
+// ReportStoreSizes reports the approximate size of every loaded IAVL store,
+// i.e. the number of keys in its working tree, to the configured StoreMetrics.
+func (rs *Store) ReportStoreSizes() {
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		iavlStore := rs.GetCommitKVStore(key).(*iavl.Store)
+		rs.metrics.StoreSize(key.Name(), iavlStore.Size())
 	}
 }
 
@@ -85,33 +270,369 @@ func (rs *Store) GetPruning() types.PruningOptions {
 	return rs.pruningOpts
 }
 
-// SetPruning sets the pruning strategy on the root store and all the sub-stores.
-// Note, calling SetPruning on the root store prior to LoadVersion or
-// LoadLatestVersion performs a no-op as the stores aren't mounted yet.
+// SetPruning sets the pruning strategy on the root store. Sub-stores are never
+// configured individually: the root store decides which heights to prune at
+// each Commit and deletes them from every IAVL store, see PrunableStores. Stores
+// of other types are not versioned and are unaffected.
+//
+// The strategy may be set before or after loading, and takes effect from the
+// next Commit onwards. If called mid-block, see SetPruningErr, the change is
+// logged and deferred until after the next Commit instead, so that the block
+// in progress is committed under the strategy it started with. Heights already
+// scheduled for pruning under the previous strategy are still pruned.
 func (rs *Store) SetPruning(pruningOpts types.PruningOptions) {
+	if _, err := rs.SetPruningErr(pruningOpts); err != nil {
+		rs.logger.Info("deferring pruning change to the next commit", "err", err)
+		rs.pendingPruning = &pruningOpts
+	}
+}
+
+// SetPruningErr is like SetPruning, but returns an error rather than deferring
+// the change if any loaded IAVL store has uncommitted writes, i.e. if called
+// mid-block rather than between two commits, which would make the heights
+// pruned at the next Commit depend on when it was called. Writes to stores of
+// other types can't be detected. On success, it replaces any change deferred
+// by SetPruning and returns the keys of the stores the strategy applies to,
+// i.e. the IAVL stores without an override set with SetStorePruning, sorted by
+// name.
+func (rs *Store) SetPruningErr(pruningOpts types.PruningOptions) ([]types.StoreKey, error) {
+	if name := rs.uncommittedStore(); name != "" {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic,
+			"cannot change pruning mid-block: store %s has uncommitted writes", name)
+	}
+
 	rs.pruningOpts = pruningOpts
+	rs.pendingPruning = nil
+
+	accepted := []types.StoreKey{}
+	for _, key := range rs.PrunableStores() {
+		if rs.storesParams[key].pruning == nil {
+			accepted = append(accepted, key)
+		}
+	}
+
+	return accepted, nil
+}
+
+// uncommittedStore returns the name of a loaded IAVL store that has been
+// written to since it was loaded or last committed, or an empty string if
+// there is none.
+func (rs *Store) uncommittedStore() string {
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		if rs.GetCommitKVStore(key).(*iavl.Store).HasUncommittedWrites() {
+			return key.Name()
+		}
+	}
+
+	return ""
+}
+
+// SetStorePruning overrides the root pruning strategy for a single mounted
+// store. The store is then pruned on its own interval using opts, while stores
+// without an override keep following the strategy set with SetPruning. Commit
+// infos are kept until no IAVL store can serve their version anymore, so that
+// historical queries with proofs keep working for the retained versions. Only
+// IAVL stores are versioned; an override on any other store has no effect.
+func (rs *Store) SetStorePruning(key types.StoreKey, opts types.PruningOptions) {
+	params, ok := rs.storesParams[key]
+	if !ok {
+		panic(fmt.Sprintf("store %s is not mounted", key.Name()))
+	}
+
+	params.pruning = &opts
+	rs.storesParams[key] = params
+}
+
+// GetStorePruning returns the pruning strategy in effect for a mounted store,
+// i.e. its override set with SetStorePruning if any, and the root strategy
+// otherwise. It panics if the store is not mounted.
+func (rs *Store) GetStorePruning(key types.StoreKey) types.PruningOptions {
+	params, ok := rs.storesParams[key]
+	if !ok {
+		panic(fmt.Sprintf("store %s is not mounted", key.Name()))
+	}
+
+	if params.pruning != nil {
+		return *params.pruning
+	}
+
+	return rs.pruningOpts
+}
+
+// ExcludeFromCommitHash excludes a mounted store from the commit info, and hence
+// from the root hash, e.g. for a DB-adapter store used as an ephemeral cache.
+// The store is still committed, but isn't recorded in the commit info and its
+// contents can't be proven by queries. It must be called before loading a
+// version, and consistently on every node, as it changes the app hash.
+// Transient stores are always excluded, see includeInCommitHash.
+func (rs *Store) ExcludeFromCommitHash(key types.StoreKey) {
+	params, ok := rs.storesParams[key]
+	if !ok {
+		panic(fmt.Sprintf("store %s is not mounted", key.Name()))
+	}
+
+	params.excludeFromHash = true
+	rs.storesParams[key] = params
+}
+
+// includeInCommitHash is the single place that decides whether the store with
+// the given key and type is recorded in the commit info, and hence takes part
+// in the root hash. Transient stores are never included.
+func (rs *Store) includeInCommitHash(key types.StoreKey, typ types.StoreType) bool {
+	if typ == types.StoreTypeTransient {
+		return false
+	}
+
+	return !rs.storesParams[key].excludeFromHash
+}
+
+// PrunableStores returns the keys of the mounted stores that the pruning
+// strategy applies to, sorted by name.
+func (rs *Store) PrunableStores() []types.StoreKey {
+	keys := make([]types.StoreKey, 0, len(rs.storesParams))
+	for key, params := range rs.storesParams {
+		if params.typ == types.StoreTypeIAVL {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name() < keys[j].Name()
+	})
+
+	return keys
 }
 
-// SetLazyLoading sets if the iavl store should be loaded lazily or not
+// SetLazyLoading sets if the iavl store should be loaded lazily or not. It is
+// the default for stores without an override set with SetStoreLazyLoading.
 func (rs *Store) SetLazyLoading(lazyLoading bool) {
 	rs.lazyLoading = lazyLoading
 }
 
+// SetStoreLazyLoading overrides whether a single mounted IAVL store is loaded
+// lazily, e.g. to lazily load cold archival stores while loading hot stores
+// eagerly for a predictable first-access latency. It must be called before
+// loading, and panics if the store is not mounted.
+func (rs *Store) SetStoreLazyLoading(key types.StoreKey, lazyLoading bool) {
+	params, ok := rs.storesParams[key]
+	if !ok {
+		panic(fmt.Sprintf("store %s is not mounted", key.Name()))
+	}
+
+	params.lazyLoading = &lazyLoading
+	rs.storesParams[key] = params
+}
+
+// StorePrefixer returns the prefix under which the data of the store with the
+// given key is kept. hasOwnDB reports whether the store was mounted with a DB
+// of its own, rather than sharing the root store's DB or a DB that other stores
+// are mounted with too.
+type StorePrefixer func(key types.StoreKey, hasOwnDB bool) []byte
+
+// DefaultStorePrefixer is the StorePrefixer used by NewStore. Stores with a DB
+// of their own are kept under "s/_/", and all other stores under "s/k:<name>/",
+// which keeps several stores mounted with the same DB apart. Since the prefix
+// of a store changes when its DB becomes shared, loading fails if a shared DB
+// has data under "s/_/".
+func DefaultStorePrefixer(key types.StoreKey, hasOwnDB bool) []byte {
+	if hasOwnDB {
+		return []byte("s/_/")
+	}
+
+	return []byte("s/k:" + key.Name() + "/")
+}
+
+// SetStorePrefixer sets the StorePrefixer used to locate the data of each store
+// in its DB, e.g. to read a DB written with a legacy key layout. It must be set
+// before loading a version. Prefixes of stores sharing the root store's DB must
+// neither overlap each other nor the root store's metadata, which is kept under
+// "s/latest", "s/pruneheights" and "s/<version>". Passing nil restores
+// DefaultStorePrefixer.
+func (rs *Store) SetStorePrefixer(prefixer StorePrefixer) {
+	if prefixer == nil {
+		prefixer = DefaultStorePrefixer
+	}
+
+	rs.storePrefixer = prefixer
+}
+
+// SetCommitInfoCodec sets the CommitInfoCodec the commit info of each version
+// is persisted with. It must be set before loading a version, and must match
+// the codec the DB was written with, if any: loading a version fails rather
+// than misreading commit infos encoded with another codec. Passing nil
+// restores DefaultCommitInfoCodec.
+func (rs *Store) SetCommitInfoCodec(codec CommitInfoCodec) {
+	if codec == nil {
+		codec = DefaultCommitInfoCodec
+	}
+
+	rs.cInfoCodec = codec
+}
+
+// SetCommitWorkers sets the maximum number of sub-stores committed
+// concurrently on Commit. A non-positive value, the default, uses GOMAXPROCS.
+func (rs *Store) SetCommitWorkers(workers int) {
+	rs.commitWorkers = workers
+}
+
+// SetImmutableCacheSize sets the number of versions whose immutable IAVL stores
+// CacheMultiStoreWithVersion keeps in memory for reuse, e.g. on a query node
+// serving many reads at the same recent heights. The least recently used
+// version is evicted first, and versions are evicted as soon as they are
+// pruned. A non-positive size, the default, disables the cache.
+func (rs *Store) SetImmutableCacheSize(size int) {
+	if size <= 0 {
+		rs.immutableCache = nil
+		return
+	}
+
+	rs.immutableCache = newImmutableStoreCache(size)
+}
+
+// SetLoadMode sets how sub-stores that fail to load are handled. It must be set
+// before loading, and defaults to LoadModeStrict.
+func (rs *Store) SetLoadMode(mode LoadMode) {
+	rs.loadMode = mode
+}
+
+// SetStoresToLoad restricts loading to the given mounted stores, e.g. for an
+// inspection tool that only needs a few of them, leaving all other stores
+// unloaded. Queries against an unloaded store return an error stating so, and
+// Commit panics, since committing would drop the unloaded stores from the
+// commit info. Calling it without keys restores loading all mounted stores. It
+// must be called before loading, and panics if a store is not mounted.
+func (rs *Store) SetStoresToLoad(keys ...types.StoreKey) {
+	if len(keys) == 0 {
+		rs.storesToLoad = nil
+		return
+	}
+
+	storesToLoad := make(map[types.StoreKey]bool, len(keys))
+	for _, key := range keys {
+		if _, ok := rs.storesParams[key]; !ok {
+			panic(fmt.Sprintf("store %s is not mounted", key.Name()))
+		}
+		storesToLoad[key] = true
+	}
+	rs.storesToLoad = storesToLoad
+}
+
+// isUnloaded returns whether the store with the given name is mounted, but was
+// left unloaded by SetStoresToLoad.
+func (rs *Store) isUnloaded(name string) bool {
+	key, ok := rs.keysByName[name]
+	return ok && rs.storesToLoad != nil && !rs.storesToLoad[key]
+}
+
+// FailedStores returns the errors of the sub-stores that failed to load in
+// LoadModeDegraded and were left unmounted, keyed by store name.
+func (rs *Store) FailedStores() map[string]error {
+	return rs.failedStores
+}
+
+// SetRejectUnmountedStores sets whether loading a version fails if the commit
+// info persisted for it records stores that are not mounted, e.g. because a
+// module was removed without deleting its store with a store upgrade. Without
+// it, such stores are only reported by UnmountedStores. It must be set before
+// loading.
+func (rs *Store) SetRejectUnmountedStores(reject bool) {
+	rs.rejectUnmounted = reject
+}
+
+// UnmountedStores returns the sorted names of the stores recorded in the commit
+// info of the last loaded version that are not mounted, and are neither
+// deleted nor renamed by the store upgrades applied on load. Their data is
+// left untouched on disk, and is dropped from the commit info on the next
+// Commit.
+func (rs *Store) UnmountedStores() []string {
+	return rs.unmounted
+}
+
+// SetSyncCommits sets whether the commit info and latest version written by
+// Commit and Restore are flushed to disk with a synchronous write. Without it,
+// some DB backends may lose the latest commit info on a crash even though the
+// IAVL stores have already persisted the new version, trading crash-consistency
+// for higher commit throughput.
+func (rs *Store) SetSyncCommits(sync bool) {
+	rs.syncCommits = sync
+}
+
+// SetSkipMultiStoreProofs sets whether Query and QueryKeys leave out the
+// `multistore -> substore` proof op when a proof is requested, returning only
+// the proof of the sub-store. This saves loading the commit info and building
+// its merkle proof, but the results can't be verified against the app hash, so
+// it must only be set on stores serving trusted callers, e.g. queries from
+// within the same process.
+func (rs *Store) SetSkipMultiStoreProofs(skip bool) {
+	rs.skipStoreProofs = skip
+}
+
+// SetMaxQueryResponseSize sets the maximum size in bytes of the value of a
+// Query response. The pairs of a `/subspace` query that doesn't fit are cut
+// off, which is reported by setting the Info of the response to
+// TruncatedQueryInfo; QuerySubspace returns them one page at a time instead.
+// Other queries with a larger response fail. A non-positive size, the default,
+// doesn't limit responses.
+func (rs *Store) SetMaxQueryResponseSize(size int) {
+	rs.maxQuerySize = size
+}
+
+// SetReadOnly sets whether the store is read-only. A read-only store can be
+// loaded and queried, including at past versions, but Commit panics, stores
+// returned by GetKVStore and CacheMultiStore panic on writes, and operations
+// that mutate persisted state, such as upgrades, restores and mounting stores
+// after load, return ErrReadOnly.
+func (rs *Store) SetReadOnly(readOnly bool) {
+	rs.readOnly = readOnly
+}
+
+// IsReadOnly returns whether the store is read-only.
+func (rs *Store) IsReadOnly() bool {
+	return rs.readOnly
+}
+
 // GetStoreType implements Store.
 func (rs *Store) GetStoreType() types.StoreType {
 	return types.StoreTypeMulti
 }
 
-// MountStoreWithDB implements CommitMultiStore.
+// MountStoreWithDB implements CommitMultiStore. It panics on a nil key or a
+// duplicate key or key name, see MountStoreWithDBErr.
+//
+// Stores mounted with a nil DB are kept in the root store's DB. Several stores
+// may be mounted with the same DB, e.g. to reduce the number of open files, and
+// are kept apart by their prefixes, see DefaultStorePrefixer. As a store with a
+// DB of its own is kept under a different prefix, a DB must not become shared
+// once it has data.
 func (rs *Store) MountStoreWithDB(key types.StoreKey, typ types.StoreType, db dbm.DB) {
+	if err := rs.MountStoreWithDBErr(key, typ, db); err != nil {
+		panic(err.Error())
+	}
+}
+
+// MountStoreWithDBErr is like MountStoreWithDB, but returns an error instead of
+// panicking if the key is nil, or if the key or its name is already mounted.
+func (rs *Store) MountStoreWithDBErr(key types.StoreKey, typ types.StoreType, db dbm.DB) error {
 	if key == nil {
-		panic("MountIAVLStore() key cannot be nil")
+		return errors.New("MountIAVLStore() key cannot be nil")
+	}
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if rs.readOnly && rs.lastCommitInfo != nil {
+		return sdkerrors.Wrapf(types.ErrReadOnly, "cannot mount store %s after load", key.Name())
 	}
 	if _, ok := rs.storesParams[key]; ok {
-		panic(fmt.Sprintf("store duplicate store key %v", key))
+		return fmt.Errorf("store duplicate store key %v", key)
 	}
 	if _, ok := rs.keysByName[key.Name()]; ok {
-		panic(fmt.Sprintf("store duplicate store key name %v", key))
+		return fmt.Errorf("store duplicate store key name %v", key)
 	}
 	rs.storesParams[key] = storeParams{
 		key: key,
@@ -119,6 +640,8 @@ func (rs *Store) MountStoreWithDB(key types.StoreKey, typ types.StoreType, db db
 		db:  db,
 	}
 	rs.keysByName[key.Name()] = key
+
+	return nil
 }
 
 // GetCommitStore returns a mounted CommitStore for a given StoreKey. If the
@@ -129,6 +652,8 @@ func (rs *Store) GetCommitStore(key types.StoreKey) types.CommitStore {
 
 // GetCommitKVStore returns a mounted CommitKVStore for a given StoreKey. If the
 // store is wrapped in an inter-block cache, it will be unwrapped before returning.
+// Writes through the returned store are not recorded in the change set, see
+// SetChangeSetWriter.
 func (rs *Store) GetCommitKVStore(key types.StoreKey) types.CommitKVStore {
 	// If the Store has an inter-block cache, first attempt to lookup and unwrap
 	// the underlying CommitKVStore by StoreKey. If it does not exist, fallback to
@@ -144,7 +669,16 @@ func (rs *Store) GetCommitKVStore(key types.StoreKey) types.CommitKVStore {
 
 // LoadLatestVersionAndUpgrade implements CommitMultiStore
 func (rs *Store) LoadLatestVersionAndUpgrade(upgrades *types.StoreUpgrades) error {
-	ver := getLatestVersion(rs.db)
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	ver, err := getLatestVersion(rs.db)
+	if err != nil {
+		return err
+	}
+	if err := checkLatestCommitInfo(rs.db, ver); err != nil {
+		return err
+	}
 	return rs.loadVersion(ver, upgrades)
 }
 
@@ -155,7 +689,16 @@ func (rs *Store) LoadVersionAndUpgrade(ver int64, upgrades *types.StoreUpgrades)
 
 // LoadLatestVersion implements CommitMultiStore.
 func (rs *Store) LoadLatestVersion() error {
-	ver := getLatestVersion(rs.db)
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	ver, err := getLatestVersion(rs.db)
+	if err != nil {
+		return err
+	}
+	if err := checkLatestCommitInfo(rs.db, ver); err != nil {
+		return err
+	}
 	return rs.loadVersion(ver, nil)
 }
 
@@ -164,7 +707,83 @@ func (rs *Store) LoadVersion(ver int64) error {
 	return rs.loadVersion(ver, nil)
 }
 
+// HasVersion returns whether the given version has commit info persisted, and
+// can hence be loaded with LoadVersion. It only checks for the commit info row,
+// without loading any stores, so it can be called before a version is loaded.
+// Version 0, the initial empty state, always exists. Errors reading the DB,
+// e.g. because the store is closed, are reported as the version not existing.
+func (rs *Store) HasVersion(ver int64) bool {
+	switch {
+	case ver == 0:
+		return true
+	case ver < 0 || rs.checkClosed() != nil:
+		return false
+	}
+
+	ok, err := rs.db.Has([]byte(fmt.Sprintf(commitInfoKeyFmt, ver)))
+	return err == nil && ok
+}
+
+// Warmup preloads the upper tree levels of the IAVL stores with the given keys
+// into their node caches, see iavl.Store.Warmup, or of all loaded IAVL stores
+// if no keys are given. Calling it after loading a version trades startup time
+// for the latency of the first reads. An error is returned if a given store is
+// not a loaded IAVL store.
+func (rs *Store) Warmup(keys ...types.StoreKey) error {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		for key, store := range rs.stores {
+			if store.GetStoreType() == types.StoreTypeIAVL {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		store, ok := rs.stores[key]
+		if !ok {
+			return sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not loaded: %s", key.Name())
+		}
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot warm up non-IAVL store %s", key.Name())
+		}
+
+		start := time.Now()
+		lookups := rs.GetCommitKVStore(key).(*iavl.Store).Warmup()
+		rs.logger.Debug("warmed up store", "store", key.Name(), "lookups", lookups, "duration", time.Since(start))
+	}
+
+	return nil
+}
+
 func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	start := time.Now()
+	if rs.readOnly && upgrades != nil {
+		return sdkerrors.Wrap(types.ErrReadOnly, "cannot apply store upgrades")
+	}
+	if rs.storesToLoad != nil && upgrades != nil {
+		return sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot apply store upgrades when loading a subset of the stores")
+	}
+	if err := rs.checkStorePrefixes(); err != nil {
+		return err
+	}
+	if err := checkCommitInfoCodec(rs.db, rs.cInfoCodec); err != nil {
+		return err
+	}
+	if rs.immutableCache != nil {
+		// cached trees belong to the stores about to be replaced
+		rs.immutableCache.reset()
+	}
+
 	infos := make(map[string]types.StoreInfo)
 
 	cInfo := &types.CommitInfo{}
@@ -172,7 +791,7 @@ func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
 	// load old data if we are not version 0
 	if ver != 0 {
 		var err error
-		cInfo, err = getCommitInfo(rs.db, ver)
+		cInfo, err = getCommitInfo(rs.db, rs.cInfoCodec, ver)
 		if err != nil {
 			return err
 		}
@@ -183,547 +802,3362 @@ func (rs *Store) loadVersion(ver int64, upgrades *types.StoreUpgrades) error {
 		}
 	}
 
+	// persisted stores that are no longer mounted are reported rather than
+	// loaded, see UnmountedStores
+	unmounted := unmountedStores(cInfo, rs.keysByName, upgrades)
+	if len(unmounted) > 0 && rs.rejectUnmounted {
+		return fmt.Errorf(
+			"stores %s are persisted at version %d but not mounted; mount them or delete them with a store upgrade",
+			strings.Join(unmounted, ", "), ver)
+	}
+	for _, name := range unmounted {
+		rs.logger.Info("store is persisted but not mounted", "store", name, "version", ver)
+	}
+
 	// load each Store (note this doesn't panic on unmounted keys now)
 	var newStores = make(map[types.StoreKey]types.CommitKVStore)
+	var failedStores = make(map[string]error)
+	var renames []storeRename
+	var renamedFrom []renamedStore
 
 	for key, storeParams := range rs.storesParams {
+		if rs.storesToLoad != nil && !rs.storesToLoad[key] {
+			continue
+		}
+
 		commitID := rs.getCommitID(infos, key.Name())
 
-		// If it has been added, set the initial version
+		if err := checkStoreType(infos, key.Name(), storeParams.typ); err != nil {
+			return err
+		}
+
+		// If it has been added, set the initial version. A store that is already
+		// present in the persisted commit info can't be added again.
 		if upgrades.IsAdded(key.Name()) {
+			if _, ok := infos[key.Name()]; ok {
+				return fmt.Errorf("store %s is marked as added but already exists at version %d", key.Name(), ver)
+			}
 			storeParams.initialVersion = uint64(ver) + 1
+			rs.logger.Info("adding store", "store", key.Name(), "version", ver+1)
+		} else if ver == 0 && rs.initialVersion > 1 {
+			// a store loaded before the first commit starts at the initial
+			// version set with SetInitialVersion
+			storeParams.initialVersion = uint64(rs.initialVersion)
 		}
 
 		store, err := rs.loadCommitStoreFromParams(key, commitID, storeParams)
 		if err != nil {
-			return errors.Wrap(err, "failed to load store")
+			if rs.loadMode == LoadModeStrict {
+				return errors.Wrapf(err, "failed to load store %s", key.Name())
+			}
+			failedStores[key.Name()] = err
+			rs.logger.Error("failed to load store", "store", key.Name(), "err", err)
+			continue
 		}
 
 		newStores[key] = store
 
 		// If it was deleted, remove all data
 		if upgrades.IsDeleted(key.Name()) {
+			rs.logger.Info("deleting store", "store", key.Name())
 			if err := deleteKVStore(store.(types.KVStore)); err != nil {
-				return errors.Wrapf(err, "failed to delete store %s", key.Name())
+				rs.loadErr = errors.Wrapf(err, "failed to delete store %s", key.Name())
+				return rs.loadErr
 			}
 		} else if oldName := upgrades.RenamedFrom(key.Name()); oldName != "" {
-			// handle renames specially
-			// make an unregistered key to satify loadCommitStore params
-			oldKey := types.NewKVStoreKey(oldName)
-			oldParams := storeParams
-			oldParams.key = oldKey
-
-			// load from the old name
-			oldStore, err := rs.loadCommitStoreFromParams(oldKey, rs.getCommitID(infos, oldName), oldParams)
-			if err != nil {
-				return errors.Wrapf(err, "failed to load old store %s", oldName)
+			// renames are applied once all stores are loaded, see below
+			renames = append(renames, storeRename{key: key, oldName: oldName, params: storeParams})
+		}
+	}
+
+	// Apply renames in dependency order, so that in a chain like A -> B, B -> C
+	// the data of B is moved to C before the data of A is moved into B.
+	renames, err := orderStoreRenames(renames)
+	if err != nil {
+		return err
+	}
+
+	for _, rename := range renames {
+		key, oldName := rename.key, rename.oldName
+
+		store, ok := newStores[key]
+		if !ok {
+			// the store failed to load and is reported below
+			continue
+		}
+
+		// A source that is itself mounted, i.e. in the middle of a rename chain,
+		// must be read through its loaded instance, which is the one committed.
+		// It is emptied right away, before another store is renamed to it, which
+		// for an IAVL store only becomes durable with the next commit.
+		oldStore := rs.getLoadedStoreByName(newStores, oldName)
+		if oldStore != nil {
+			if oldStore.GetStoreType() != types.StoreTypeIAVL && store.GetStoreType() == types.StoreTypeIAVL {
+				return fmt.Errorf(
+					"cannot rename store %s to %s: store %s is not an IAVL store, so its data would be deleted before the copy is committed",
+					oldName, key.Name(), oldName)
 			}
 
-			// move all data
+			rs.logger.Info("renaming store", "from", oldName, "to", key.Name())
 			if err := moveKVStoreData(oldStore.(types.KVStore), store.(types.KVStore)); err != nil {
-				return errors.Wrapf(err, "failed to move store %s -> %s", oldName, key.Name())
+				rs.loadErr = errors.Wrapf(err, "failed to move store %s -> %s", oldName, key.Name())
+				return rs.loadErr
 			}
+			continue
+		}
+
+		// make an unregistered key to satify loadCommitStore params
+		oldKey := types.NewKVStoreKey(oldName)
+		oldParams := rename.params
+		oldParams.key = oldKey
+
+		// the old store may have a different type, e.g. when migrating from a
+		// DB adapter to an IAVL store; its data is moved through the KVStore
+		// interface and committed to the new store on the next Commit
+		if typ, ok := upgrades.RenamedFromStoreType(key.Name()); ok {
+			oldParams.typ = typ
+		} else if info, ok := infos[oldName]; ok && info.StoreType != types.StoreTypeMulti {
+			oldParams.typ = info.StoreType
+		}
+		if err := checkStoreType(infos, oldName, oldParams.typ); err != nil {
+			return err
+		}
+
+		// load from the old name
+		oldStore, err = rs.loadCommitStoreFromParams(oldKey, rs.getCommitID(infos, oldName), oldParams)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load old store %s", oldName)
+		}
+
+		// Copy all data now, but only delete it from the old store once the copy
+		// is committed, as deleting from e.g. a DB adapter is durable right away
+		// while the copy is not until the next Commit.
+		rs.logger.Info("renaming store", "from", oldName, "to", key.Name())
+		if err := copyKVStoreData(oldStore.(types.KVStore), store.(types.KVStore)); err != nil {
+			rs.loadErr = errors.Wrapf(err, "failed to copy store %s -> %s", oldName, key.Name())
+			return rs.loadErr
 		}
+		renamedFrom = append(renamedFrom, renamedStore{name: oldName, store: oldStore})
 	}
 
+	var loadErr error
+	if len(failedStores) > 0 {
+		loadErr = failedStoresError(failedStores)
+		if rs.loadMode == LoadModeCollect {
+			return loadErr
+		}
+	}
+
+	rs.mtx.Lock()
 	rs.lastCommitInfo = cInfo
 	rs.stores = newStores
+	rs.mtx.Unlock()
+	// writes recorded against the previously loaded version belong to no commit
+	if rs.changeSet != nil {
+		rs.changeSet.reset()
+	}
+	rs.loadErr = loadErr
+	rs.failedStores = failedStores
+	rs.unmounted = unmounted
+	// old stores of a previous load are kept, as their copy was never committed
+	rs.renamedFrom = renamedFrom
 
 	// load any pruned heights we missed from disk to be pruned on the next run
-	ph, err := getPruningHeights(rs.db)
-	if err == nil && len(ph) > 0 {
+	if ph, err := getPruningHeights(rs.db); err == nil && len(ph) > 0 {
 		rs.pruneHeights = ph
 	}
 
+	rs.metrics.VersionLoaded(cInfo.Version, time.Since(start))
+
 	return nil
 }
 
-func (rs *Store) getCommitID(infos map[string]types.StoreInfo, name string) types.CommitID {
-	info, ok := infos[name]
-	if !ok {
-		return types.CommitID{}
+// RollbackToVersion loads the given version and permanently discards every
+// version committed after it, so that the next Commit produces target + 1. The
+// IAVL sub-stores are rolled back first, after which the commit info rows and
+// latest version are rewritten in a single batch. If interrupted, it is safe to
+// call RollbackToVersion again with the same target.
+func (rs *Store) RollbackToVersion(target int64) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if rs.readOnly {
+		return sdkerrors.Wrap(types.ErrReadOnly, "cannot roll back")
+	}
+	if target <= 0 {
+		return fmt.Errorf("invalid rollback version %d", target)
 	}
 
-	return info.CommitId
-}
+	latest, err := getLatestVersion(rs.db)
+	if err != nil {
+		return err
+	}
+	if target > latest {
+		return sdkerrors.Wrapf(types.ErrVersionDoesNotExist, "cannot roll back to version %d; latest version is %d", target, latest)
+	}
 
-func deleteKVStore(kv types.KVStore) error {
-	// Note that we cannot write while iterating, so load all keys here, delete below
-	var keys [][]byte
-	itr := kv.Iterator(nil, nil)
-	for itr.Valid() {
-		keys = append(keys, itr.Key())
-		itr.Next()
+	if err := rs.loadVersion(target, nil); err != nil {
+		return errors.Wrapf(err, "failed to load version %d", target)
 	}
-	itr.Close()
 
-	for _, k := range keys {
-		kv.Delete(k)
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		store = rs.GetCommitKVStore(key)
+		if _, err := store.(*iavl.Store).LoadVersionForOverwriting(target); err != nil {
+			return errors.Wrapf(err, "failed to roll back store %s to version %d", key.Name(), target)
+		}
 	}
-	return nil
-}
 
-// we simulate move by a copy and delete
-func moveKVStoreData(oldDB types.KVStore, newDB types.KVStore) error {
-	// we read from one and write to another
-	itr := oldDB.Iterator(nil, nil)
-	for itr.Valid() {
-		newDB.Set(itr.Key(), itr.Value())
-		itr.Next()
+	pruneHeights := make([]int64, 0, len(rs.pruneHeights))
+	for _, h := range rs.pruneHeights {
+		if h <= target {
+			pruneHeights = append(pruneHeights, h)
+		}
 	}
-	itr.Close()
+	rs.pruneHeights = pruneHeights
 
-	// then delete the old store
-	return deleteKVStore(oldDB)
-}
+	batch := rs.db.NewBatch()
+	defer batch.Close()
 
-// SetInterBlockCache sets the Store's internal inter-block (persistent) cache.
-// When this is defined, all CommitKVStores will be wrapped with their respective
-// inter-block cache.
-func (rs *Store) SetInterBlockCache(c types.MultiStorePersistentCache) {
-	rs.interBlockCache = c
+	for version := target + 1; version <= latest; version++ {
+		cInfoKey := fmt.Sprintf(commitInfoKeyFmt, version)
+		if err := batch.Delete([]byte(cInfoKey)); err != nil {
+			return err
+		}
+	}
+	setLatestVersion(batch, target)
+	setPruningHeights(batch, rs.pruneHeights)
+
+	if err := batch.Write(); err != nil {
+		return errors.Wrap(err, "failed to write rollback metadata")
+	}
+
+	rs.logger.Info("rolled back", "from", latest, "to", target)
+	return nil
 }
 
-// SetTracer sets the tracer for the MultiStore that the underlying
-// stores will utilize to trace operations. A MultiStore is returned.
-func (rs *Store) SetTracer(w io.Writer) types.MultiStore {
-	rs.traceWriter = w
-	return rs
-}
+// Reset deletes all data of the mounted stores along with every committed
+// version, and reloads the stores at version 0, as if they had just been
+// mounted on an empty DB. It is meant for tests that reuse a store instead of
+// setting up a new one. Stores mounted on their own DB lose all data under
+// their prefix in it, while data of persisted stores that aren't mounted is
+// left in place. All settings of the store are kept.
+func (rs *Store) Reset() error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if rs.readOnly {
+		return sdkerrors.Wrap(types.ErrReadOnly, "cannot reset")
+	}
 
-// SetTracingContext updates the tracing context for the MultiStore by merging
-// the given context with the existing context by key. Any existing keys will
-// be overwritten. It is implied that the caller should update the context when
-// necessary between tracing operations. It returns a modified MultiStore.
-func (rs *Store) SetTracingContext(tc types.TraceContext) types.MultiStore {
-	if rs.traceContext != nil {
-		for k, v := range tc {
-			rs.traceContext[k] = v
+	for key, params := range rs.storesParams {
+		if params.typ != types.StoreTypeIAVL && params.typ != types.StoreTypeDB {
+			continue
+		}
+
+		if err := rs.deleteStoreData(key, params); err != nil {
+			return err
 		}
-	} else {
-		rs.traceContext = tc
 	}
 
-	return rs
-}
+	versions, err := getCommitInfoVersions(rs.db)
+	if err != nil {
+		return err
+	}
 
-// TracingEnabled returns if tracing is enabled for the MultiStore.
-func (rs *Store) TracingEnabled() bool {
-	return rs.traceWriter != nil
-}
+	batch := rs.db.NewBatch()
+	defer batch.Close()
 
-// LastCommitID implements Committer/CommitStore.
-func (rs *Store) LastCommitID() types.CommitID {
-	if rs.lastCommitInfo == nil {
-		return types.CommitID{
-			Version: getLatestVersion(rs.db),
+	for _, version := range versions {
+		if err := batch.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, version))); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{latestVersionKey, pruneHeightsKey, commitInfoCodecKey} {
+		if err := batch.Delete([]byte(key)); err != nil {
+			return err
 		}
 	}
 
-	return rs.lastCommitInfo.CommitID()
+	if err := batch.WriteSync(); err != nil {
+		return errors.Wrap(err, "failed to write reset metadata")
+	}
+
+	rs.pruneHeights = make([]int64, 0)
+	return rs.loadVersion(0, nil)
 }
 
-// Commit implements Committer/CommitStore.
-func (rs *Store) Commit() types.CommitID {
-	var previousHeight, version int64
-	if rs.lastCommitInfo.GetVersion() == 0 && rs.initialVersion > 1 {
-		// This case means that no commit has been made in the store, we
-		// start from initialVersion.
-		version = rs.initialVersion
+// deleteStoreData deletes the raw data under the prefix of the given store, as
+// deleting from an IAVL store would only delete its latest version.
+func (rs *Store) deleteStoreData(key types.StoreKey, params storeParams) error {
+	db := rs.db
+	if params.db != nil {
+		db = params.db
+	}
+	prefixDB := dbm.NewPrefixDB(db, rs.storePrefix(key, params))
+	if err := deleteKVStore(commitDBStoreAdapter{Store: dbadapter.Store{DB: prefixDB}}); err != nil {
+		return errors.Wrapf(err, "failed to delete data of store %s", key.Name())
+	}
+	return nil
+}
 
-	} else {
-		// This case can means two things:
-		// - either there was already a previous commit in the store, in which
-		// case we increment the version from there,
-		// - or there was no previous commit, and initial version was not set,
-		// in which case we start at version 1.
-		previousHeight = rs.lastCommitInfo.GetVersion()
-		version = previousHeight + 1
+// failedStoresError returns an error reporting every failed store, sorted by
+// store name.
+func failedStoresError(failedStores map[string]error) error {
+	names := make([]string, 0, len(failedStores))
+	for name := range failedStores {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	rs.lastCommitInfo = commitStores(version, rs.stores)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %v", name, failedStores[name])
+	}
 
-	// Determine if pruneHeight height needs to be added to the list of heights to
-	// be pruned, where pruneHeight = (commitHeight - 1) - KeepRecent.
-	if int64(rs.pruningOpts.KeepRecent) < previousHeight {
-		pruneHeight := previousHeight - int64(rs.pruningOpts.KeepRecent)
-		// We consider this height to be pruned iff:
-		//
-		// - KeepEvery is zero as that means that all heights should be pruned.
-		// - KeepEvery % (height - KeepRecent) != 0 as that means the height is not
-		// a 'snapshot' height.
-		if rs.pruningOpts.KeepEvery == 0 || pruneHeight%int64(rs.pruningOpts.KeepEvery) != 0 {
-			rs.pruneHeights = append(rs.pruneHeights, pruneHeight)
+	return fmt.Errorf("failed to load %d store(s): %s", len(names), strings.Join(msgs, "; "))
+}
+
+// unmountedStores returns the sorted names of the stores in cInfo that are not
+// mounted, and are neither deleted nor renamed by upgrades.
+func unmountedStores(cInfo *types.CommitInfo, keysByName map[string]types.StoreKey, upgrades *types.StoreUpgrades) []string {
+	declared := make(map[string]bool)
+	if upgrades != nil {
+		for _, name := range upgrades.Deleted {
+			declared[name] = true
+		}
+		for _, rename := range upgrades.Renamed {
+			declared[rename.OldKey] = true
 		}
 	}
 
-	// batch prune if the current height is a pruning interval height
-	if rs.pruningOpts.Interval > 0 && version%int64(rs.pruningOpts.Interval) == 0 {
-		rs.pruneStores()
+	var unmounted []string
+	for _, si := range cInfo.StoreInfos {
+		if _, ok := keysByName[si.Name]; !ok && !declared[si.Name] {
+			unmounted = append(unmounted, si.Name)
+		}
 	}
+	sort.Strings(unmounted)
 
-	flushMetadata(rs.db, version, rs.lastCommitInfo, rs.pruneHeights)
+	return unmounted
+}
 
-	return types.CommitID{
-		Version: version,
-		Hash:    rs.lastCommitInfo.Hash(),
+// ValidateUpgrades checks a store upgrade plan against the commit info
+// persisted for the given version, without loading or mutating anything, so
+// that a bad plan can be caught before calling LoadVersionAndUpgrade. It
+// verifies that deleted stores and rename sources exist at that version, that
+// added stores and rename targets are mounted, that added stores don't exist
+// yet, and that no store appears in conflicting roles. Rename chains such as
+// A -> B, B -> C are allowed, rename cycles are not. All problems found are
+// reported in a single error. A version of 0 validates against an empty
+// commit info, as when loading a fresh DB.
+func (rs *Store) ValidateUpgrades(upgrades *types.StoreUpgrades, ver int64) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if upgrades == nil {
+		return nil
 	}
-}
 
-// pruneStores will batch delete a list of heights from each mounted sub-store.
-// Afterwards, pruneHeights is reset.
-func (rs *Store) pruneStores() {
-	if len(rs.pruneHeights) == 0 {
-		return
+	persisted := make(map[string]bool)
+	if ver != 0 {
+		if err := checkCommitInfoCodec(rs.db, rs.cInfoCodec); err != nil {
+			return err
+		}
+		cInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, ver)
+		if err != nil {
+			return err
+		}
+
+		for _, si := range cInfo.StoreInfos {
+			persisted[si.Name] = true
+		}
 	}
 
-	for key, store := range rs.stores {
-		if store.GetStoreType() == types.StoreTypeIAVL {
-			// If the store is wrapped with an inter-block cache, we must first unwrap
-			// it to get the underlying IAVL store.
-			store = rs.GetCommitKVStore(key)
+	var problems []string
+	roles := make(map[string]string)
+	addRole := func(name, role string) {
+		prev, ok := roles[name]
+		switch {
+		case !ok:
+			roles[name] = role
+		case prev == "renamed to" && role == "renamed from", prev == "renamed from" && role == "renamed to":
+			// part of a rename chain, which is applied in dependency order
+			roles[name] = "renamed from and to"
+		case prev == role && role == "renamed from":
+			// reported by orderStoreRenames below
+		default:
+			problems = append(problems, fmt.Sprintf("store %s is both %s and %s", name, prev, role))
+		}
+	}
 
-			if err := store.(*iavl.Store).DeleteVersions(rs.pruneHeights...); err != nil {
-				if errCause := errors.Cause(err); errCause != nil && errCause != iavltree.ErrVersionDoesNotExist {
-					panic(err)
-				}
-			}
+	for _, name := range upgrades.Added {
+		addRole(name, "added")
+		if persisted[name] {
+			problems = append(problems, fmt.Sprintf("added store %s already exists", name))
+		}
+		if rs.keysByName[name] == nil {
+			problems = append(problems, fmt.Sprintf("added store %s is not mounted", name))
 		}
 	}
 
-	rs.pruneHeights = make([]int64, 0)
-}
+	for _, name := range upgrades.Deleted {
+		addRole(name, "deleted")
+		if !persisted[name] {
+			problems = append(problems, fmt.Sprintf("deleted store %s does not exist", name))
+		}
+	}
 
-// CacheWrap implements CacheWrapper/Store/CommitStore.
-func (rs *Store) CacheWrap() types.CacheWrap {
-	return rs.CacheMultiStore().(types.CacheWrap)
-}
+	renames := make([]storeRename, 0, len(upgrades.Renamed))
+	for _, rename := range upgrades.Renamed {
+		addRole(rename.OldKey, "renamed from")
+		addRole(rename.NewKey, "renamed to")
+		if !persisted[rename.OldKey] {
+			problems = append(problems, fmt.Sprintf("store %s renamed to %s does not exist", rename.OldKey, rename.NewKey))
+		}
+		if rs.keysByName[rename.NewKey] == nil {
+			problems = append(problems, fmt.Sprintf("store %s renamed from %s is not mounted", rename.NewKey, rename.OldKey))
+		}
+		renames = append(renames, storeRename{key: types.NewKVStoreKey(rename.NewKey), oldName: rename.OldKey})
+	}
+	if _, err := orderStoreRenames(renames); err != nil {
+		problems = append(problems, err.Error())
+	}
 
-// CacheWrapWithTrace implements the CacheWrapper interface.
-func (rs *Store) CacheWrapWithTrace(_ io.Writer, _ types.TraceContext) types.CacheWrap {
-	return rs.CacheWrap()
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid store upgrades for version %d: %s", ver, strings.Join(problems, "; "))
+	}
+
+	return nil
 }
 
-// CacheMultiStore cache-wraps the multi-store and returns a CacheMultiStore.
-// It implements the MultiStore interface.
-func (rs *Store) CacheMultiStore() types.CacheMultiStore {
-	stores := make(map[types.StoreKey]types.CacheWrapper)
-	for k, v := range rs.stores {
-		stores[k] = v
+// checkStorePrefixes returns an error if the DB prefixes of two mounted stores
+// kept in the same DB overlap each other or, in the root store's DB, the root
+// store's metadata, e.g. the stores "a" and "a/b" with DefaultStorePrefixer, as
+// such stores would silently read and overwrite each other's data. It also
+// returns an error if a DB shared by several stores, other than the root
+// store's, has data under the prefix of a store with a DB of its own.
+func (rs *Store) checkStorePrefixes() error {
+	// commit info keys are s/<version>, hence covered by the prefixes s/0 to s/9
+	root := []prefixedStore{{"", latestVersionKey}, {"", pruneHeightsKey}, {"", commitInfoCodecKey}}
+	for i := 0; i <= 9; i++ {
+		root = append(root, prefixedStore{"", fmt.Sprintf(commitInfoKeyFmt, i)})
 	}
 
-	return cachemulti.NewStore(rs.db, stores, rs.keysByName, rs.traceWriter, rs.traceContext)
+	// prefixes only need to be distinct among the stores kept in the same DB
+	storesByDB := map[dbm.DB][]prefixedStore{rs.db: root}
+	for key, params := range rs.storesParams {
+		db := rs.db
+		if params.db != nil {
+			db = params.db
+		}
+		storesByDB[db] = append(storesByDB[db], prefixedStore{key.Name(), string(rs.storePrefix(key, params))})
+	}
+
+	for db, stores := range storesByDB {
+		if err := checkOverlappingPrefixes(stores); err != nil {
+			return err
+		}
+		if db != rs.db && len(stores) > 1 {
+			if err := rs.checkSharedDB(db); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-// CacheMultiStoreWithVersion is analogous to CacheMultiStore except that it
-// attempts to load stores at a given version (height). An error is returned if
-// any store cannot be loaded. This should only be used for querying and
-// iterating at past heights.
-func (rs *Store) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStore, error) {
-	cachedStores := make(map[types.StoreKey]types.CacheWrapper)
-	for key, store := range rs.stores {
-		switch store.GetStoreType() {
-		case types.StoreTypeIAVL:
-			// If the store is wrapped with an inter-block cache, we must first unwrap
-			// it to get the underlying IAVL store.
-			store = rs.GetCommitKVStore(key)
+// checkSharedDB returns an error if the given DB, which several stores are
+// mounted with, has data under the prefix a store is kept under when it has a
+// DB of its own, i.e. data written before the DB was shared. The stores would
+// no longer see it, as sharing a DB changes their prefix.
+func (rs *Store) checkSharedDB(db dbm.DB) error {
+	for key, params := range rs.storesParams {
+		if params.db != db {
+			continue
+		}
 
-			// Attempt to lazy-load an already saved IAVL store version. If the
-			// version does not exist or is pruned, an error should be returned.
-			iavlStore, err := store.(*iavl.Store).GetImmutable(version)
-			if err != nil {
-				return nil, err
-			}
+		ownPrefix := rs.storePrefixer(key, true)
+		if bytes.Equal(ownPrefix, rs.storePrefix(key, params)) {
+			continue
+		}
 
-			cachedStores[key] = iavlStore
+		itr, err := dbm.IteratePrefix(db, ownPrefix)
+		if err != nil {
+			return err
+		}
+		hasData := itr.Valid()
+		itr.Close()
 
-		default:
-			cachedStores[key] = store
+		if hasData {
+			return fmt.Errorf("store %s shares its DB with other stores, but the DB has data under prefix %q, "+
+				"which is only used by a store with a DB of its own; mount the store with a DB of its own again",
+				key.Name(), ownPrefix)
 		}
 	}
 
-	return cachemulti.NewStore(rs.db, cachedStores, rs.keysByName, rs.traceWriter, rs.traceContext), nil
+	return nil
 }
 
-// GetStore returns a mounted Store for a given StoreKey. If the StoreKey does
-// not exist, it will panic. If the Store is wrapped in an inter-block cache, it
-// will be unwrapped prior to being returned.
-//
-// TODO: This isn't used directly upstream. Consider returning the Store as-is
-// instead of unwrapping.
-func (rs *Store) GetStore(key types.StoreKey) types.Store {
-	store := rs.GetCommitKVStore(key)
-	if store == nil {
-		panic(fmt.Sprintf("store does not exist for key: %s", key.Name()))
+// storePrefix returns the prefix of the mounted store with the given key and
+// params in its DB. The store has a DB of its own if it was mounted with a DB
+// no other store is mounted with.
+func (rs *Store) storePrefix(key types.StoreKey, params storeParams) []byte {
+	hasOwnDB := params.db != nil
+	if hasOwnDB {
+		for other, otherParams := range rs.storesParams {
+			if other != key && otherParams.db == params.db {
+				hasOwnDB = false
+				break
+			}
+		}
 	}
 
-	return store
+	return rs.storePrefixer(key, hasOwnDB)
 }
 
-// GetKVStore returns a mounted KVStore for a given StoreKey. If tracing is
-// enabled on the KVStore, a wrapped TraceKVStore will be returned with the root
-// store's tracer, otherwise, the original KVStore will be returned.
-//
-// NOTE: The returned KVStore may be wrapped in an inter-block cache if it is
-// set on the root store.
-func (rs *Store) GetKVStore(key types.StoreKey) types.KVStore {
-	store := rs.stores[key].(types.KVStore)
+// prefixedStore is a store, or root store metadata if name is empty, and the
+// prefix of its keys in a DB.
+type prefixedStore struct {
+	name   string
+	prefix string
+}
+
+// checkOverlappingPrefixes returns an error if any two of the given stores,
+// kept in the same DB, have overlapping prefixes.
+func checkOverlappingPrefixes(stores []prefixedStore) error {
+	sort.Slice(stores, func(i, j int) bool {
+		return stores[i].prefix < stores[j].prefix
+	})
 
-	if rs.TracingEnabled() {
-		store = tracekv.NewStore(store, rs.traceWriter, rs.traceContext)
+	// in sorted order, a prefix that overlaps any other overlaps its successor
+	for i := 1; i < len(stores); i++ {
+		a, b := stores[i-1], stores[i]
+		if !strings.HasPrefix(b.prefix, a.prefix) {
+			continue
+		}
+
+		switch {
+		case a.name == "" && b.name == "":
+			continue
+		case a.name == "":
+			return fmt.Errorf("store %s has DB prefix %q overlapping the root store metadata key %q", b.name, b.prefix, a.prefix)
+		case b.name == "":
+			return fmt.Errorf("store %s has DB prefix %q overlapping the root store metadata key %q", a.name, a.prefix, b.prefix)
+		default:
+			return fmt.Errorf("stores %s and %s have overlapping DB prefixes %q and %q", a.name, b.name, a.prefix, b.prefix)
+		}
 	}
 
-	return store
+	return nil
 }
 
-// getStoreByName performs a lookup of a StoreKey given a store name typically
-// provided in a path. The StoreKey is then used to perform a lookup and return
-// a Store. If the Store is wrapped in an inter-block cache, it will be unwrapped
-// prior to being returned. If the StoreKey does not exist, nil is returned.
-func (rs *Store) getStoreByName(name string) types.Store {
-	key := rs.keysByName[name]
-	if key == nil {
+// checkStoreType returns an error if the store type persisted for the named
+// store differs from typ. Commit info written before store types were recorded
+// carries no type and always passes.
+func checkStoreType(infos map[string]types.StoreInfo, name string, typ types.StoreType) error {
+	info, ok := infos[name]
+	if !ok || info.StoreType == types.StoreTypeMulti || info.StoreType == typ {
 		return nil
 	}
 
-	return rs.GetCommitKVStore(key)
+	return fmt.Errorf("store %s is mounted as %s but was committed as %s", name, typ, info.StoreType)
 }
 
-// Query calls substore.Query with the same `req` where `req.Path` is
-// modified to remove the substore prefix.
-// Ie. `req.Path` here is `/<substore>/<path>`, and trimmed to `/<path>` for the substore.
-// TODO: add proof for `multistore -> substore`.
-func (rs *Store) Query(req abci.RequestQuery) abci.ResponseQuery {
-	path := req.Path
-	storeName, subpath, err := parsePath(path)
-	if err != nil {
-		return sdkerrors.QueryResult(err)
-	}
-
-	store := rs.getStoreByName(storeName)
-	if store == nil {
-		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", storeName))
+// Close closes the sub-stores that hold resources of their own, the DBs mounted
+// with MountStoreWithDB and finally the root DB, and returns the first error
+// encountered. Sub-stores that are merely views over one of these DBs, or held
+// in memory, are released with them. Once closed, the store must not be used
+// anymore: methods that return an error fail with ErrStoreClosed, and Commit
+// and the store getters, e.g. GetKVStore and GetStore, panic with it.
+func (rs *Store) Close() error {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return err
 	}
+	rs.closed = true
 
-	queryable, ok := store.(types.Queryable)
-	if !ok {
-		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s (type %T) doesn't support queries", storeName, store))
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	// trim the path and make the query
-	req.Path = subpath
-	res := queryable.Query(req)
-
-	if !req.Prove || !RequireProof(subpath) {
-		return res
-	}
+	for key, store := range rs.stores {
+		switch store.(type) {
+		case commitDBStoreAdapter, *transient.Store, *mem.Store:
+			// closing these would close the DB they are a view of
+			continue
+		}
 
-	if res.ProofOps == nil || len(res.ProofOps.Ops) == 0 {
-		return sdkerrors.QueryResult(sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "proof is unexpectedly empty; ensure height has not been pruned"))
+		if closer, ok := store.(io.Closer); ok {
+			record(errors.Wrapf(closer.Close(), "failed to close store %s", key.Name()))
+		}
 	}
 
-	// If the request's height is the latest height we've committed, then utilize
-	// the store's lastCommitInfo as this commit info may not be flushed to disk.
-	// Otherwise, we query for the commit info from disk.
-	var commitInfo *types.CommitInfo
-
-	if res.Height == rs.lastCommitInfo.Version {
-		commitInfo = rs.lastCommitInfo
-	} else {
-		commitInfo, err = getCommitInfo(rs.db, res.Height)
-		if err != nil {
-			return sdkerrors.QueryResult(err)
+	closed := map[dbm.DB]bool{rs.db: true}
+	for key, params := range rs.storesParams {
+		if params.db != nil && !closed[params.db] {
+			closed[params.db] = true
+			record(errors.Wrapf(params.db.Close(), "failed to close DB of store %s", key.Name()))
 		}
 	}
+	record(errors.Wrap(rs.db.Close(), "failed to close DB"))
 
-	// Restore origin path and append proof op.
-	res.ProofOps.Ops = append(res.ProofOps.Ops, commitInfo.ProofOp(storeName))
+	rs.stores = make(map[types.StoreKey]types.CommitKVStore)
+	rs.storesParams = make(map[types.StoreKey]storeParams)
+	rs.keysByName = make(map[string]types.StoreKey)
+	rs.lastCommitInfo = nil
 
-	return res
+	return firstErr
 }
 
-// SetInitialVersion sets the initial version of the IAVL tree. It is used when
-// starting a new chain at an arbitrary height.
-func (rs *Store) SetInitialVersion(version int64) error {
-	rs.initialVersion = version
-
-	// Loop through all the stores, if it's an IAVL store, then set initial
-	// version on it.
-	for key, store := range rs.stores {
-		if store.GetStoreType() == types.StoreTypeIAVL {
-			// If the store is wrapped with an inter-block cache, we must first unwrap
-			// it to get the underlying IAVL store.
-			store = rs.GetCommitKVStore(key)
-			store.(*iavl.Store).SetInitialVersion(version)
-		}
+// checkClosed returns ErrStoreClosed if the store has been closed.
+func (rs *Store) checkClosed() error {
+	if rs.closed {
+		return types.ErrStoreClosed
 	}
-
+	return nil
+}
+
+func (rs *Store) getCommitID(infos map[string]types.StoreInfo, name string) types.CommitID {
+	info, ok := infos[name]
+	if !ok {
+		return types.CommitID{}
+	}
+
+	return info.CommitId
+}
+
+// storeMigrationBatchSize is the maximum number of keys held in memory at once
+// while moving or deleting store data during upgrades.
+var storeMigrationBatchSize = 10000
+
+// iterateBatches iterates over all keys of the given store in batches of at
+// most storeMigrationBatchSize pairs, calling fn for each batch once the
+// iterator has been closed so that fn may write to the store.
+func iterateBatches(kv types.KVStore, fn func(keys, values [][]byte)) error {
+	var start []byte
+	for {
+		keys := make([][]byte, 0, storeMigrationBatchSize)
+		values := make([][]byte, 0, storeMigrationBatchSize)
+
+		itr := kv.Iterator(start, nil)
+		for ; itr.Valid() && len(keys) < storeMigrationBatchSize; itr.Next() {
+			keys = append(keys, itr.Key())
+			values = append(values, itr.Value())
+		}
+		if err := itr.Error(); err != nil {
+			itr.Close()
+			return err
+		}
+		if err := itr.Close(); err != nil {
+			return err
+		}
+
+		if len(keys) == 0 {
+			return nil
+		}
+
+		fn(keys, values)
+
+		// resume from the smallest key following the last one read
+		last := keys[len(keys)-1]
+		start = make([]byte, len(last)+1)
+		copy(start, last)
+	}
+}
+
+// deleteKVStore removes all data from the given store. Deletes from IAVL stores
+// are only persisted on the next Commit, and deletes from DB adapter stores are
+// written in a single batch, so that a failed delete leaves the store intact.
+// Keys are read in chunks of storeMigrationBatchSize while the batch is built.
+func deleteKVStore(kv types.KVStore) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to delete store data: %v", r)
+		}
+	}()
+
+	if adapter, ok := kv.(commitDBStoreAdapter); ok {
+		batch := adapter.DB.NewBatch()
+		defer batch.Close()
+
+		err := iterateBatches(kv, func(keys, _ [][]byte) {
+			for _, k := range keys {
+				if err := batch.Delete(k); err != nil {
+					panic(err)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return batch.Write()
+	}
+
+	// Note that we cannot write while iterating, so keys are loaded and deleted
+	// in batches
+	return iterateBatches(kv, func(keys, _ [][]byte) {
+		for _, k := range keys {
+			kv.Delete(k)
+		}
+	})
+}
+
+// storeRename is a rename from a store upgrade plan pending in loadVersion.
+type storeRename struct {
+	key     types.StoreKey
+	oldName string
+	params  storeParams
+}
+
+// orderStoreRenames orders renames such that a store is renamed away before
+// another store is renamed to its name, and rejects renames forming a cycle.
+// Independent renames are ordered by target name, for determinism.
+func orderStoreRenames(renames []storeRename) ([]storeRename, error) {
+	bySource := make(map[string]storeRename, len(renames))
+	for _, rename := range renames {
+		if prev, ok := bySource[rename.oldName]; ok {
+			return nil, fmt.Errorf("store %s is renamed to both %s and %s", rename.oldName, prev.key.Name(), rename.key.Name())
+		}
+		bySource[rename.oldName] = rename
+	}
+
+	sort.Slice(renames, func(i, j int) bool {
+		return renames[i].key.Name() < renames[j].key.Name()
+	})
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	ordered := make([]storeRename, 0, len(renames))
+	state := make(map[string]int, len(renames))
+
+	var visit func(rename storeRename) error
+	visit = func(rename storeRename) error {
+		name := rename.key.Name()
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("store renames form a cycle through %s", name)
+		}
+
+		state[name] = visiting
+		// the target's current data must be moved out first
+		if next, ok := bySource[name]; ok {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		ordered = append(ordered, rename)
+		return nil
+	}
+
+	for _, rename := range renames {
+		if err := visit(rename); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// getLoadedStoreByName returns the store with the given name from stores, or
+// nil if there is none.
+func (rs *Store) getLoadedStoreByName(stores map[types.StoreKey]types.CommitKVStore, name string) types.CommitKVStore {
+	key := rs.keysByName[name]
+	if key == nil {
+		return nil
+	}
+
+	return stores[key]
+}
+
+// we simulate move by a copy and delete
+func moveKVStoreData(oldDB types.KVStore, newDB types.KVStore) error {
+	if err := copyKVStoreData(oldDB, newDB); err != nil {
+		return err
+	}
+
+	// then delete the old store
+	return deleteKVStore(oldDB)
+}
+
+// copyKVStoreData copies all data of oldDB to newDB, leaving oldDB untouched.
+func copyKVStoreData(oldDB types.KVStore, newDB types.KVStore) error {
+	// we read from one and write to another, in batches
+	return iterateBatches(oldDB, func(keys, values [][]byte) {
+		for i, k := range keys {
+			newDB.Set(k, values[i])
+		}
+	})
+}
+
+// renamedStore is an unmounted store that was renamed by the last load, and
+// whose data is deleted once the copy is committed, see deleteRenamedStores.
+type renamedStore struct {
+	name  string
+	store types.CommitKVStore
+}
+
+// deleteRenamedStores deletes the data of the stores renamed by the last load,
+// now that their copy has been committed. As the commit is already durable,
+// errors are logged rather than returned; the data left behind is unreachable
+// but otherwise harmless.
+func (rs *Store) deleteRenamedStores() {
+	for _, renamed := range rs.renamedFrom {
+		if err := deleteKVStore(renamed.store.(types.KVStore)); err != nil {
+			rs.logger.Error("failed to delete renamed store", "store", renamed.name, "err", err)
+		}
+	}
+	rs.renamedFrom = nil
+}
+
+// SetInterBlockCache sets the Store's internal inter-block (persistent) cache.
+// When this is defined, all CommitKVStores will be wrapped with their respective
+// inter-block cache.
+func (rs *Store) SetInterBlockCache(c types.MultiStorePersistentCache) {
+	rs.interBlockCache = c
+}
+
+// InterBlockCacheStats returns the statistics of the inter-block cache of each
+// store by store name, e.g. to size the cache. It returns nil if no inter-block
+// cache is set or the cache doesn't implement
+// types.MultiStorePersistentCacheWithStats.
+func (rs *Store) InterBlockCacheStats() map[string]types.PersistentCacheStats {
+	if c, ok := rs.interBlockCache.(types.MultiStorePersistentCacheWithStats); ok {
+		return c.Stats()
+	}
+
+	return nil
+}
+
+// SetTracer sets the tracer for the MultiStore that the underlying
+// stores will utilize to trace operations. A MultiStore is returned.
+func (rs *Store) SetTracer(w io.Writer) types.MultiStore {
+	rs.traceWriter = w
+	return rs
+}
+
+// SetTracingContext updates the tracing context for the MultiStore by merging
+// the given context with the existing context by key. Any existing keys will
+// be overwritten. It is implied that the caller should update the context when
+// necessary between tracing operations. It returns a modified MultiStore.
+func (rs *Store) SetTracingContext(tc types.TraceContext) types.MultiStore {
+	if rs.traceContext != nil {
+		for k, v := range tc {
+			rs.traceContext[k] = v
+		}
+	} else {
+		rs.traceContext = tc
+	}
+
+	return rs
+}
+
+// ExcludeFromTracing excludes the store with the given key from tracing. Its
+// operations are neither traced through GetKVStore nor through any cache
+// multi-store branched off the root store, even when tracing is enabled.
+func (rs *Store) ExcludeFromTracing(key types.StoreKey) {
+	rs.tracingExcluded[key] = true
+}
+
+// TracingEnabled returns if tracing is enabled for the MultiStore.
+func (rs *Store) TracingEnabled() bool {
+	return rs.traceWriter != nil
+}
+
+// LastCommitID implements Committer/CommitStore.
+func (rs *Store) LastCommitID() types.CommitID {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if rs.lastCommitInfo == nil {
+		version, err := getLatestVersion(rs.db)
+		if err != nil {
+			panic(err)
+		}
+
+		return types.CommitID{
+			Version: version,
+		}
+	}
+
+	return types.CommitID{
+		Version: rs.lastCommitInfo.Version,
+		Hash:    rs.lastCommitHash.get(rs.lastCommitInfo),
+	}
+}
+
+// latestVersion returns the version of the last commit without computing its
+// hash.
+func (rs *Store) latestVersion() (int64, error) {
+	if rs.lastCommitInfo == nil {
+		return getLatestVersion(rs.db)
+	}
+
+	return rs.lastCommitInfo.Version, nil
+}
+
+// LatestCommitInfo returns the latest version persisted in the DB together with
+// the commit ID of each store committed at that version, keyed by store name.
+// If nothing has been committed yet, version 0 and an empty map are returned.
+func (rs *Store) LatestCommitInfo() (version int64, stores map[string]types.CommitID, err error) {
+	if err := rs.checkClosed(); err != nil {
+		return 0, nil, err
+	}
+
+	version, err = getLatestVersion(rs.db)
+	if err != nil {
+		return 0, nil, err
+	}
+	stores = make(map[string]types.CommitID)
+	if version == 0 {
+		return version, stores, nil
+	}
+	if err := checkCommitInfoCodec(rs.db, rs.cInfoCodec); err != nil {
+		return 0, nil, err
+	}
+
+	cInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, version)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, si := range cInfo.StoreInfos {
+		stores[si.Name] = si.CommitId
+	}
+
+	return version, stores, nil
+}
+
+// CommitIDForVersion returns the commit ID, i.e. the app hash, of the given
+// committed version, read from the commit info persisted for it. No stores are
+// loaded. As for CacheMultiStoreWithVersion, ErrVersionDoesNotExist is returned
+// if the version was never committed, and ErrVersionPruned if its commit info
+// has been pruned.
+func (rs *Store) CommitIDForVersion(version int64) (types.CommitID, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if version <= 0 {
+		return types.CommitID{}, sdkerrors.Wrapf(types.ErrVersionDoesNotExist, "invalid version %d", version)
+	}
+	if err := rs.checkVersion(version); err != nil {
+		return types.CommitID{}, err
+	}
+
+	if version == rs.lastCommitInfo.GetVersion() {
+		return types.CommitID{Version: version, Hash: rs.lastCommitHash.get(rs.lastCommitInfo)}, nil
+	}
+	cInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, version)
+	if err != nil {
+		return types.CommitID{}, err
+	}
+
+	return cInfo.CommitID(), nil
+}
+
+// WorkingHash returns the root hash the next Commit would produce from the
+// current uncommitted state of the stores, without persisting anything or
+// incrementing the version. Stores are excluded exactly as in Commit.
+func (rs *Store) WorkingHash() []byte {
+	storeInfos := make([]types.StoreInfo, 0, len(rs.stores))
+
+	for key, store := range rs.stores {
+		var hash []byte
+
+		if !rs.includeInCommitHash(key, store.GetStoreType()) {
+			continue
+		}
+
+		switch store.GetStoreType() {
+		case types.StoreTypeIAVL:
+			// If the store is wrapped with an inter-block cache, we must first unwrap
+			// it to get the underlying IAVL store.
+			hash = rs.GetCommitKVStore(key).(*iavl.Store).WorkingHash()
+
+		default:
+			// other stores commit to a hash that doesn't depend on their contents
+			hash = store.LastCommitID().Hash
+		}
+
+		storeInfos = append(storeInfos, types.StoreInfo{
+			Name:     key.Name(),
+			CommitId: types.CommitID{Hash: hash},
+		})
+	}
+
+	return types.CommitInfo{StoreInfos: storeInfos}.Hash()
+}
+
+// IterateCommitInfos invokes fn with the version and root hash of every commit
+// info persisted for a version in [start, end], in ascending order of version,
+// until fn returns false. Versions whose commit info has been pruned are
+// skipped. The commit infos are located with a single scan of the metadata
+// keys, so sparse ranges are cheap to iterate.
+func (rs *Store) IterateCommitInfos(start, end int64, fn func(version int64, hash []byte) bool) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if start > end {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "invalid version range [%d, %d]", start, end)
+	}
+	if err := checkCommitInfoCodec(rs.db, rs.cInfoCodec); err != nil {
+		return err
+	}
+
+	versions, err := getCommitInfoVersions(rs.db)
+	if err != nil {
+		return err
+	}
+
+	inRange := make([]int64, 0, len(versions))
+	for _, version := range versions {
+		if version >= start && version <= end {
+			inRange = append(inRange, version)
+		}
+	}
+	sort.Slice(inRange, func(i, j int) bool { return inRange[i] < inRange[j] })
+
+	for _, version := range inRange {
+		cInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, version)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load commit info for version %d", version)
+		}
+		if !fn(version, cInfo.Hash()) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// VerifyIntegrity recomputes the commit info of the latest version from the
+// last commit IDs of the loaded stores and checks it against the commit info
+// persisted in the DB for that version. An error naming every diverging store
+// is returned on mismatch, e.g. after a suspected disk fault. Nothing is
+// checked if no version has been committed yet.
+func (rs *Store) VerifyIntegrity() error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+
+	version, err := rs.latestVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+
+	persisted, err := getCommitInfo(rs.db, rs.cInfoCodec, version)
+	if err != nil {
+		return err
+	}
+
+	live := rs.buildCommitInfo(version)
+
+	liveIDs := make(map[string]types.CommitID, len(live.StoreInfos))
+	for _, si := range live.StoreInfos {
+		liveIDs[si.Name] = si.CommitId
+	}
+
+	var mismatches []string
+	for _, si := range persisted.StoreInfos {
+		id, ok := liveIDs[si.Name]
+		delete(liveIDs, si.Name)
+
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s: persisted but not loaded", si.Name))
+		case id.Version != si.CommitId.Version || !bytes.Equal(id.Hash, si.CommitId.Hash):
+			mismatches = append(mismatches, fmt.Sprintf("%s: persisted %v, loaded %v", si.Name, si.CommitId, id))
+		}
+	}
+	for name := range liveIDs {
+		mismatches = append(mismatches, fmt.Sprintf("%s: loaded but not persisted", name))
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("commit info of version %d diverges from the loaded stores: %s", version, strings.Join(mismatches, "; "))
+	}
+
+	if liveHash, hash := live.Hash(), persisted.Hash(); !bytes.Equal(liveHash, hash) {
+		return fmt.Errorf("commit info hash of version %d diverges from the loaded stores: persisted %X, loaded %X", version, hash, liveHash)
+	}
+
+	return nil
+}
+
+// Commit implements Committer/CommitStore. It panics if the last attempt to
+// load the store failed while applying store upgrades, so that a partially
+// upgraded store is never committed as a new version.
+func (rs *Store) Commit() types.CommitID {
+	if err := rs.checkClosed(); err != nil {
+		panic(err)
+	}
+	if rs.readOnly {
+		panic(sdkerrors.Wrap(types.ErrReadOnly, "cannot commit"))
+	}
+	if rs.loadErr != nil {
+		panic(fmt.Errorf("cannot commit after a failed load: %w", rs.loadErr))
+	}
+	if rs.storesToLoad != nil {
+		panic(sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot commit when only a subset of the stores is loaded"))
+	}
+	start := time.Now()
+
+	commitID := rs.commit()
+	rs.metrics.Committed(commitID.Version, time.Since(start))
+	rs.notifyCommitListeners(commitID)
+
+	return commitID
+}
+
+// commit commits the stores as the next version and persists its metadata. It
+// holds the write lock throughout, so that concurrent readers never observe a
+// partially committed version.
+func (rs *Store) commit() types.CommitID {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	var previousHeight, version int64
+	if rs.lastCommitInfo.GetVersion() == 0 && rs.initialVersion > 1 {
+		// This case means that no commit has been made in the store, we
+		// start from initialVersion.
+		version = rs.initialVersion
+
+	} else {
+		// This case can means two things:
+		// - either there was already a previous commit in the store, in which
+		// case we increment the version from there,
+		// - or there was no previous commit, and initial version was not set,
+		// in which case we start at version 1.
+		previousHeight = rs.lastCommitInfo.GetVersion()
+		version = previousHeight + 1
+	}
+
+	// The change set is written before anything is committed, so that a failing
+	// writer aborts the commit rather than leaving a durable version without
+	// its change set.
+	if rs.changeSetWriter != nil {
+		rs.checkChangeSetComplete()
+		if err := rs.changeSet.flush(rs.changeSetWriter, version); err != nil {
+			panic(errors.Wrapf(err, "failed to write change set for version %d", version))
+		}
+	}
+
+	rs.lastCommitInfo = commitStores(version, rs.stores, rs.commitWorkers, rs.metrics, rs.includeInCommitHash)
+
+	// Determine if pruneHeight height needs to be added to the list of heights to
+	// be pruned, where pruneHeight = (commitHeight - 1) - KeepRecent.
+	if int64(rs.pruningOpts.KeepRecent) < previousHeight {
+		pruneHeight := previousHeight - int64(rs.pruningOpts.KeepRecent)
+		// We consider this height to be pruned iff:
+		//
+		// - KeepEvery is zero as that means that all heights should be pruned.
+		// - KeepEvery % (height - KeepRecent) != 0 as that means the height is not
+		// a 'snapshot' height.
+		if rs.pruningOpts.KeepEvery == 0 || pruneHeight%int64(rs.pruningOpts.KeepEvery) != 0 {
+			rs.pruneHeights = append(rs.pruneHeights, pruneHeight)
+		}
+	}
+
+	// batch prune if the current height is a pruning interval height
+	if rs.pruningOpts.Interval > 0 && version%int64(rs.pruningOpts.Interval) == 0 {
+		rs.pruneStores()
+	}
+	rs.pruneStoresWithOverrides(version)
+
+	if rs.pendingPruning != nil {
+		rs.pruningOpts = *rs.pendingPruning
+		rs.pendingPruning = nil
+	}
+
+	flushMetadata(rs.db, rs.cInfoCodec, version, rs.lastCommitInfo, rs.pruneHeights, rs.syncCommits)
+	rs.deleteRenamedStores()
+
+	return types.CommitID{
+		Version: version,
+		Hash:    rs.lastCommitHash.get(rs.lastCommitInfo),
+	}
+}
+
+// RegisterCommitListener registers a callback that is invoked synchronously at
+// the end of every successful Commit with the new commit ID, after the commit
+// has been written to the DB. Listeners are invoked in registration order.
+func (rs *Store) RegisterCommitListener(listener func(commitID types.CommitID)) {
+	rs.commitListeners = append(rs.commitListeners, listener)
+}
+
+// notifyCommitListeners invokes every commit listener. A panicking listener
+// doesn't prevent the remaining listeners from running. Its panic is logged
+// rather than re-raised, as the commit is already durable at this point and
+// Commit must not fail after the fact.
+func (rs *Store) notifyCommitListeners(commitID types.CommitID) {
+	for i, listener := range rs.commitListeners {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					rs.logger.Error("commit listener panicked", "listener", i, "version", commitID.Version, "err", r)
+				}
+			}()
+
+			listener(commitID)
+		}()
+	}
+}
+
+// commitHashCache memoizes the hash of the last commit info, which is otherwise
+// rebuilt from all store hashes on every call to LastCommitID. Commit infos are
+// never mutated once set on the store, so the cached hash is valid for as long
+// as the same commit info is passed in.
+type commitHashCache struct {
+	mtx  sync.Mutex
+	info *types.CommitInfo
+	hash []byte
+}
+
+func (c *commitHashCache) get(info *types.CommitInfo) []byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.info != info {
+		c.info = info
+		c.hash = info.Hash()
+	}
+
+	return c.hash
+}
+
+// pruneStores will batch delete a list of heights from each mounted sub-store,
+// along with the commit info persisted for those heights. Afterwards,
+// pruneHeights is reset.
+func (rs *Store) pruneStores() {
+	if len(rs.pruneHeights) == 0 {
+		return
+	}
+
+	// evict the pruned versions first, so that cached trees are never read
+	// after their nodes have been deleted
+	if rs.immutableCache != nil {
+		rs.immutableCache.evict(rs.pruneHeights...)
+	}
+
+	for key, store := range rs.stores {
+		// stores with their own pruning options are pruned separately
+		if store.GetStoreType() == types.StoreTypeIAVL && rs.storesParams[key].pruning == nil {
+			// If the store is wrapped with an inter-block cache, we must first unwrap
+			// it to get the underlying IAVL store.
+			store = rs.GetCommitKVStore(key)
+
+			if err := store.(*iavl.Store).DeleteVersions(rs.pruneHeights...); err != nil {
+				if errCause := errors.Cause(err); errCause != nil && errCause != iavltree.ErrVersionDoesNotExist {
+					panic(err)
+				}
+			}
+		}
+	}
+
+	rs.deleteUnservedCommitInfos(rs.pruneHeights)
+
+	rs.pruneHeights = make([]int64, 0)
+}
+
+// pruneStoresWithOverrides prunes the IAVL stores configured with
+// SetStorePruning whose pruning interval falls on the given version. Each such
+// store deletes every version it holds that its pruning options don't retain,
+// which keeps their pruning independent of the heights tracked by the root
+// store and of restarts.
+func (rs *Store) pruneStoresWithOverrides(version int64) {
+	pruned := []int64{}
+
+	for key, params := range rs.storesParams {
+		opts := params.pruning
+		if opts == nil || params.typ != types.StoreTypeIAVL ||
+			opts.Interval == 0 || version%int64(opts.Interval) != 0 {
+			continue
+		}
+
+		store := rs.GetCommitKVStore(key).(*iavl.Store)
+		heights := []int64{}
+		for _, v := range store.AvailableVersions() {
+			height := int64(v)
+			if height >= version-int64(opts.KeepRecent) {
+				break
+			}
+			if opts.KeepEvery == 0 || height%int64(opts.KeepEvery) != 0 {
+				heights = append(heights, height)
+			}
+		}
+		if len(heights) == 0 {
+			continue
+		}
+
+		if rs.immutableCache != nil {
+			rs.immutableCache.evict(heights...)
+		}
+		if err := store.DeleteVersions(heights...); err != nil {
+			panic(fmt.Errorf("failed to prune store %s: %w", key.Name(), err))
+		}
+		pruned = append(pruned, heights...)
+	}
+
+	rs.deleteUnservedCommitInfos(pruned)
+}
+
+// deleteUnservedCommitInfos deletes the commit infos of the given versions that
+// no IAVL store holds anymore.
+func (rs *Store) deleteUnservedCommitInfos(versions []int64) {
+	unserved := make([]int64, 0, len(versions))
+
+	for _, version := range versions {
+		served := false
+		for key, store := range rs.stores {
+			if store.GetStoreType() == types.StoreTypeIAVL &&
+				rs.GetCommitKVStore(key).(*iavl.Store).VersionExists(version) {
+				served = true
+				break
+			}
+		}
+		if !served {
+			unserved = append(unserved, version)
+		}
+	}
+
+	deleteCommitInfos(rs.db, unserved)
+}
+
+// PruneStaleCommitInfos deletes persisted commit info for versions that none of
+// the mounted IAVL stores can serve anymore, e.g. rows left behind by versions
+// pruned before commit info was pruned alongside them. The latest version is
+// never deleted, and nothing is deleted when the store prunes nothing or has no
+// IAVL stores mounted. It returns the number of deleted rows, and fails with
+// ErrReadOnly on a read-only store.
+func (rs *Store) PruneStaleCommitInfos() (int, error) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return 0, err
+	}
+	if rs.readOnly {
+		return 0, sdkerrors.Wrap(types.ErrReadOnly, "cannot prune commit infos")
+	}
+	if rs.pruningOpts == types.PruneNothing {
+		return 0, nil
+	}
+
+	iavlStores := []*iavl.Store{}
+	for key, store := range rs.stores {
+		if store.GetStoreType() == types.StoreTypeIAVL {
+			iavlStores = append(iavlStores, rs.GetCommitKVStore(key).(*iavl.Store))
+		}
+	}
+	if len(iavlStores) == 0 {
+		return 0, nil
+	}
+
+	latest, err := getLatestVersion(rs.db)
+	if err != nil {
+		return 0, err
+	}
+	stale := []int64{}
+
+	versions, err := getCommitInfoVersions(rs.db)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, version := range versions {
+		if version == latest {
+			continue
+		}
+
+		servable := false
+		for _, store := range iavlStores {
+			if store.VersionExists(version) {
+				servable = true
+				break
+			}
+		}
+		if !servable {
+			stale = append(stale, version)
+		}
+	}
+
+	deleteCommitInfos(rs.db, stale)
+
+	return len(stale), nil
+}
+
+// CacheWrap implements CacheWrapper/Store/CommitStore.
+func (rs *Store) CacheWrap() types.CacheWrap {
+	return rs.CacheMultiStore().(types.CacheWrap)
+}
+
+// CacheWrapWithTrace implements the CacheWrapper interface.
+func (rs *Store) CacheWrapWithTrace(_ io.Writer, _ types.TraceContext) types.CacheWrap {
+	return rs.CacheWrap()
+}
+
+// CacheMultiStore cache-wraps the multi-store and returns a CacheMultiStore.
+// It implements the MultiStore interface.
+func (rs *Store) CacheMultiStore() types.CacheMultiStore {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	stores := make(map[types.StoreKey]types.CacheWrapper)
+	for k, v := range rs.stores {
+		store := rs.changeSetStore(k, v)
+		if rs.readOnly {
+			store = readOnlyKVStore{store}
+		}
+		if rs.tracingExcluded[k] {
+			store = untracedKVStore{store}
+		}
+		stores[k] = store
+	}
+
+	return cachemulti.NewStore(rs.db, stores, rs.keysByName, rs.traceWriter, rs.traceContext)
+}
+
+// CacheMultiStoreWithVersion is analogous to CacheMultiStore except that it
+// attempts to load stores at a given version (height). An error is returned if
+// any store cannot be loaded. This should only be used for querying and
+// iterating at past heights.
+//
+// If the version was never committed, ErrVersionDoesNotExist is returned, and if
+// it was committed but its commit info has since been pruned, ErrVersionPruned
+// is returned. Individual stores that don't have the version, e.g. stores added
+// in a later upgrade, are loaded as empty stores.
+func (rs *Store) CacheMultiStoreWithVersion(version int64) (types.CacheMultiStore, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	immutableStores, err := rs.getImmutableStores(version)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedStores := make(map[types.StoreKey]types.CacheWrapper)
+	for key, store := range rs.stores {
+		switch store.GetStoreType() {
+		case types.StoreTypeIAVL:
+			cachedStores[key] = immutableStores[key]
+
+		default:
+			cachedStores[key] = store
+		}
+
+		if rs.tracingExcluded[key] {
+			cachedStores[key] = untracedKVStore{cachedStores[key].(types.KVStore)}
+		}
+	}
+
+	return cachemulti.NewStore(rs.db, cachedStores, rs.keysByName, rs.traceWriter, rs.traceContext), nil
+}
+
+// GetVersionedMultiStore returns a read-only CommitMultiStore view of the
+// state at the given committed version. IAVL stores are loaded as immutable
+// trees at that version, and queries with proofs are resolved against the
+// commit info persisted for it. Non-IAVL stores are not versioned and are
+// shared with the current store. The returned store is a *Store and hence
+// also implements types.Queryable.
+func (rs *Store) GetVersionedMultiStore(version int64) (types.CommitMultiStore, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	return rs.versionedMultiStore(version, nil)
+}
+
+// versionedMultiStore returns the view of GetVersionedMultiStore, with only the
+// IAVL stores of the given names loaded, or all of them if names is nil. Each
+// IAVL store loaded at a version reads its tree root from the DB, so queries
+// only load the stores they read. The caller must hold the read lock.
+func (rs *Store) versionedMultiStore(version int64, names map[string]bool) (*Store, error) {
+	if version <= 0 {
+		return nil, sdkerrors.Wrapf(types.ErrVersionDoesNotExist, "invalid version %d", version)
+	}
+	if err := rs.checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	commitInfo := rs.lastCommitInfo
+	if version != rs.lastCommitInfo.GetVersion() {
+		var err error
+		commitInfo, err = getCommitInfo(rs.db, rs.cInfoCodec, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versioned := NewStore(rs.db)
+	versioned.pruningOpts = rs.pruningOpts
+	versioned.readOnly = true
+	versioned.lastCommitInfo = commitInfo
+	versioned.traceWriter = rs.traceWriter
+	versioned.traceContext = rs.traceContext
+	versioned.cInfoCodec = rs.cInfoCodec
+	versioned.logger = rs.logger
+	versioned.skipStoreProofs = rs.skipStoreProofs
+	versioned.maxQuerySize = rs.maxQuerySize
+
+	for key, store := range rs.stores {
+		if store.GetStoreType() == types.StoreTypeIAVL {
+			if names != nil && !names[key.Name()] {
+				continue
+			}
+
+			// If the store is wrapped with an inter-block cache, we must first unwrap
+			// it to get the underlying IAVL store.
+			iavlStore, err := rs.GetCommitKVStore(key).(*iavl.Store).GetImmutable(version)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to load store %s at version %d", key.Name(), version)
+			}
+
+			store = iavlStore
+		}
+
+		versioned.storesParams[key] = rs.storesParams[key]
+		versioned.keysByName[key.Name()] = key
+		versioned.stores[key] = store
+	}
+
+	// keep reporting stores left unloaded by SetStoresToLoad as such
+	versioned.storesToLoad = rs.storesToLoad
+	for name, key := range rs.keysByName {
+		if rs.isUnloaded(name) {
+			versioned.keysByName[name] = key
+		}
+	}
+
+	return versioned, nil
+}
+
+// getImmutableStores returns the IAVL stores as of the given version, from the
+// immutable store cache if enabled. Stores that don't have the version are
+// returned empty.
+func (rs *Store) getImmutableStores(version int64) (map[types.StoreKey]*iavl.Store, error) {
+	var generation uint64
+	if rs.immutableCache != nil {
+		var stores map[types.StoreKey]*iavl.Store
+		if stores, generation = rs.immutableCache.get(version); stores != nil {
+			return stores, nil
+		}
+	}
+
+	stores := make(map[types.StoreKey]*iavl.Store)
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		iavlStore, err := rs.GetCommitKVStore(key).(*iavl.Store).GetImmutable(version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load store %s at version %d", key.Name(), version)
+		}
+
+		stores[key] = iavlStore
+	}
+
+	if rs.immutableCache != nil {
+		rs.immutableCache.add(version, stores, generation)
+	}
+
+	return stores, nil
+}
+
+// checkVersion returns ErrVersionDoesNotExist if the given version is newer than
+// the last committed version, and ErrVersionPruned if it is older but has no
+// commit info persisted.
+func (rs *Store) checkVersion(version int64) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+
+	latest := rs.lastCommitInfo.GetVersion()
+
+	switch {
+	case version <= 0 || version == latest:
+		return nil
+
+	case version > latest:
+		return sdkerrors.Wrapf(types.ErrVersionDoesNotExist, "version %d; latest version is %d", version, latest)
+	}
+
+	ok, err := rs.db.Has([]byte(fmt.Sprintf(commitInfoKeyFmt, version)))
+	if err != nil {
+		return errors.Wrap(err, "failed to get commit info")
+	} else if !ok {
+		return sdkerrors.Wrapf(types.ErrVersionPruned, "version %d", version)
+	}
+
+	return nil
+}
+
+// GetStore returns a mounted Store for a given StoreKey. If the StoreKey does
+// not exist, it will panic. If the Store is wrapped in an inter-block cache, it
+// will be unwrapped prior to being returned, i.e. the concrete store type is
+// returned and reads through it bypass the cache. See GetStoreCached for the
+// wrapped store.
+func (rs *Store) GetStore(key types.StoreKey) types.Store {
+	if err := rs.checkClosed(); err != nil {
+		panic(err)
+	}
+
+	store := rs.GetCommitKVStore(key)
+	if store == nil {
+		panic(fmt.Sprintf("store does not exist for key: %s", key.Name()))
+	}
+
+	return store
+}
+
+// GetStoreCached is like GetStore, but returns the Store as-is, i.e. wrapped in
+// the inter-block cache if one is set, so that reads through it are served from
+// the cache. Writes must go through the returned store too, to keep the cache
+// coherent. Without an inter-block cache it returns the same store as GetStore.
+func (rs *Store) GetStoreCached(key types.StoreKey) types.Store {
+	if err := rs.checkClosed(); err != nil {
+		panic(err)
+	}
+
+	store := rs.stores[key]
+	if store == nil {
+		panic(fmt.Sprintf("store does not exist for key: %s", key.Name()))
+	}
+
+	return store
+}
+
+// GetKVStore returns a mounted KVStore for a given StoreKey. If tracing is
+// enabled on the KVStore, a wrapped TraceKVStore will be returned with the root
+// store's tracer, otherwise, the original KVStore will be returned. The trace
+// context of the returned store is a copy of the root store's context with the
+// store name set under TraceContextStoreKey, unless the root context already
+// sets that key, in which case the user-supplied value takes precedence.
+//
+// NOTE: The returned KVStore may be wrapped in an inter-block cache if it is
+// set on the root store. All writes must go through it, or through a cache
+// multi-store, so that the cache stays coherent. GetCommitKVStore, GetStore and
+// the Query path return the unwrapped store instead, since they need the
+// concrete store type; reading through it is safe as the cache is write-through.
+// GetStoreCached returns the wrapped store.
+func (rs *Store) GetKVStore(key types.StoreKey) types.KVStore {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		panic(err)
+	}
+
+	return rs.getKVStore(key)
+}
+
+func (rs *Store) getKVStore(key types.StoreKey) types.KVStore {
+	store := rs.changeSetStore(key, rs.stores[key])
+
+	if rs.readOnly {
+		store = readOnlyKVStore{store}
+	}
+
+	if rs.TracingEnabled() && !rs.tracingExcluded[key] {
+		store = tracekv.NewStore(store, rs.traceWriter, rs.storeTraceContext(key))
+	}
+
+	return store
+}
+
+// GetKVStoreSafe is like GetKVStore, but returns an error instead of a store
+// that panics on use if no store is loaded for the given StoreKey, i.e. if it
+// isn't mounted, was left unloaded by SetStoresToLoad or failed to load.
+func (rs *Store) GetKVStoreSafe(key types.StoreKey) (types.KVStore, error) {
+	if key == nil {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "store key cannot be nil")
+	}
+
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return nil, err
+	}
+	if _, ok := rs.stores[key]; !ok {
+		if _, ok := rs.storesParams[key]; ok {
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not loaded: %s", key.Name())
+		}
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not mounted: %s", key.Name())
+	}
+
+	return rs.getKVStore(key), nil
+}
+
+// SetChangeSetWriter sets a writer that receives, at every Commit, the ordered
+// change set of all writes applied since the previous commit through the stores
+// returned by GetKVStore and CacheMultiStore, including writes flushed from
+// cache layers branched off them. Transient and memory stores are not
+// committed and hence not recorded. Writes through GetCommitKVStore or
+// GetCommitStore bypass the recording and must not be used while a writer is
+// set; Commit logs an error if it detects such writes to an IAVL store. Loading
+// a version, e.g. with RollbackToVersion or Reset, discards the writes recorded
+// so far. Passing nil disables change sets.
+//
+// The change set is written as a single Write call per commit, which makes a
+// commit's change set the unit of delivery. It is written before any store is
+// committed: if the write fails, Commit panics without committing anything.
+// The version may thus be lost to a crash after its change set was delivered,
+// in which case the version is committed and its change set written again;
+// consumers must let a repeated version replace the earlier one.
+//
+// Each commit is encoded as a block prefixed with its uvarint length. A block
+// holds the uvarint committed version and uvarint number of records, followed
+// by the records in the order the writes were applied. A record holds the
+// length-prefixed store name, a single op byte (ChangeSetOpSet or
+// ChangeSetOpDelete), the length-prefixed key and, for sets only, the
+// length-prefixed value. Lengths are uvarints.
+func (rs *Store) SetChangeSetWriter(w io.Writer) {
+	rs.changeSetWriter = w
+	rs.changeSet = &changeSet{}
+}
+
+// checkChangeSetComplete logs an error for every IAVL store with uncommitted
+// writes of which none were recorded in the change set, which means they
+// bypassed the recording, e.g. by going through GetCommitKVStore. Bypassing
+// writes to a store that also has recorded writes can't be detected.
+func (rs *Store) checkChangeSetComplete() {
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		iavlStore := rs.GetCommitKVStore(key).(*iavl.Store)
+		if iavlStore.HasUncommittedWrites() && !rs.changeSet.recorded(key.Name()) {
+			rs.logger.Error("writes bypassed the change set", "store", key.Name())
+		}
+	}
+}
+
+// changeSetStore wraps the given store so that its writes are recorded in the
+// change set if a change set writer is set.
+func (rs *Store) changeSetStore(key types.StoreKey, store types.KVStore) types.KVStore {
+	if rs.changeSetWriter == nil {
+		return store
+	}
+
+	switch store.GetStoreType() {
+	case types.StoreTypeTransient, types.StoreTypeMemory:
+		return store
+	}
+
+	return changeSetKVStore{KVStore: store, name: key.Name(), changeSet: rs.changeSet}
+}
+
+// storeTraceContext returns the trace context used to trace operations on the
+// store with the given key.
+func (rs *Store) storeTraceContext(key types.StoreKey) types.TraceContext {
+	tc := make(types.TraceContext, len(rs.traceContext)+1)
+	tc[TraceContextStoreKey] = key.Name()
+	for k, v := range rs.traceContext {
+		tc[k] = v
+	}
+
+	return tc
+}
+
+// getStoreByName performs a lookup of a StoreKey given a store name typically
+// provided in a path. The StoreKey is then used to perform a lookup and return
+// a Store. If the Store is wrapped in an inter-block cache, it will be unwrapped
+// prior to being returned. If the StoreKey does not exist, nil is returned.
+func (rs *Store) getStoreByName(name string) types.Store {
+	key := rs.keysByName[name]
+	if key == nil {
+		return nil
+	}
+
+	return rs.GetCommitKVStore(key)
+}
+
+// DB returns the root DB of the store, for operational tooling such as
+// compaction scheduling or disk usage stats. Stores mounted with their own DB
+// via MountStoreWithDB keep their data in that DB instead. The DB must only be
+// read: writing to it directly bypasses the stores and the commit info, which
+// is unsupported and may corrupt the state. It must not be closed either, see
+// Close.
+func (rs *Store) DB() dbm.DB {
+	return rs.db
+}
+
+// GetStoreByName returns the store mounted under the given name, e.g. as
+// addressed in a query path, or nil if no store is mounted under the name or
+// it isn't loaded. Stores wrapped in an inter-block cache are unwrapped.
+func (rs *Store) GetStoreByName(name string) types.Store {
+	return rs.getStoreByName(name)
+}
+
+// StoreKeys returns the keys of all mounted stores, sorted by name.
+func (rs *Store) StoreKeys() []types.StoreKey {
+	keys := make([]types.StoreKey, 0, len(rs.storesParams))
+	for key := range rs.storesParams {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name() < keys[j].Name()
+	})
+
+	return keys
+}
+
+// QueryableStores returns the names of the loaded stores that support queries,
+// i.e. that implement types.Queryable, sorted by name. These are exactly the
+// stores that can be addressed as `/<storeName>/...` in Query.
+func (rs *Store) QueryableStores() []string {
+	names := make([]string, 0, len(rs.stores))
+	for key := range rs.stores {
+		if _, ok := rs.GetCommitKVStore(key).(types.Queryable); ok {
+			names = append(names, key.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// DebugDump writes every key/value pair of the loaded stores as of the last
+// committed version to w, grouped by store and ordered by store name and then
+// by key, so that uncommitted writes don't show up in the dump. Each pair is
+// written as a line "<store>\t<hex key>\t<hex value>". Transient and memory
+// stores are not committed and hence skipped, and stores of other types than
+// IAVL aren't versioned and are dumped at their current state. This walks all
+// of state and is meant for debugging only.
+func (rs *Store) DebugDump(w io.Writer) error {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+
+	keys := make([]types.StoreKey, 0, len(rs.stores))
+	for key, store := range rs.stores {
+		switch store.GetStoreType() {
+		case types.StoreTypeTransient, types.StoreTypeMemory:
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name() < keys[j].Name()
+	})
+
+	version := rs.lastCommitInfo.GetVersion()
+	for _, key := range keys {
+		var store types.KVStore = rs.GetCommitKVStore(key)
+		if iavlStore, ok := store.(*iavl.Store); ok {
+			// an IAVL store without the version, e.g. before the first
+			// commit, is dumped empty
+			immutable, err := iavlStore.GetImmutable(version)
+			if err != nil {
+				return errors.Wrapf(err, "failed to load store %s at version %d", key.Name(), version)
+			}
+			store = immutable
+		}
+
+		if err := dumpKVStore(w, key.Name(), store); err != nil {
+			return errors.Wrapf(err, "failed to dump store %s", key.Name())
+		}
+	}
+
+	return nil
+}
+
+func dumpKVStore(w io.Writer, name string, store types.KVStore) error {
+	itr := store.Iterator(nil, nil)
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if _, err := fmt.Fprintf(w, "%s\t%X\t%X\n", name, itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Query calls substore.Query with the same `req` where `req.Path` is
+// modified to remove the substore prefix.
+// Ie. `req.Path` here is `/<substore>/<path>`, and trimmed to `/<path>` for the substore.
+// When a proof is requested, the `multistore -> substore` proof op is appended
+// to the substore's proof ops; see VerifyMultiStoreProof for client-side
+// verification against an app hash.
+func (rs *Store) Query(req abci.RequestQuery) abci.ResponseQuery {
+	start := time.Now()
+	res := rs.query(req)
+	rs.metrics.Queried(req.Path, res.Code, time.Since(start))
+
+	return res
+}
+
+func (rs *Store) query(req abci.RequestQuery) abci.ResponseQuery {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return sdkerrors.QueryResult(err)
+	}
+
+	// Reject heights that have not been committed yet up front, as sub-stores
+	// would otherwise either fail in store-specific ways or silently answer
+	// with the latest data.
+	latest, err := rs.latestVersion()
+	if err != nil {
+		return sdkerrors.QueryResult(err)
+	}
+	if req.Height > latest {
+		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"cannot query with height in the future; requested %d, latest committed %d", req.Height, latest))
+	}
+
+	// Historical queries are answered by a versioned view of the multistore, so
+	// that sub-stores are read at the requested height regardless of whether
+	// they honor req.Height themselves. Only the queried store is loaded.
+	if req.Height > 0 && req.Height < latest {
+		storeName, _, err := parsePath(req.Path)
+		if err != nil {
+			return sdkerrors.QueryResult(err)
+		}
+		versioned, err := rs.versionedMultiStore(req.Height, map[string]bool{storeName: true})
+		if err != nil {
+			return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"failed to load state for height %d; ensure height has not been pruned: %s", req.Height, err))
+		}
+
+		return versioned.Query(req)
+	}
+
+	path := req.Path
+	storeName, subpath, err := parsePath(path)
+	if err != nil {
+		return sdkerrors.QueryResult(err)
+	}
+
+	store := rs.getStoreByName(storeName)
+	if store == nil {
+		if rs.isUnloaded(storeName) {
+			return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not loaded: %s", storeName))
+		}
+		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", storeName))
+	}
+
+	queryable, ok := store.(types.Queryable)
+	if !ok {
+		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s (type %T) doesn't support queries", storeName, store))
+	}
+
+	// trim the path and make the query
+	req.Path = subpath
+	res := queryable.Query(req)
+	if rs.maxQuerySize > 0 && res.Code == 0 && len(res.Value) > rs.maxQuerySize {
+		if res, err = truncateQueryResponse(subpath, res, rs.maxQuerySize); err != nil {
+			return sdkerrors.QueryResult(err)
+		}
+	}
+
+	if !req.Prove || !RequireProof(subpath) || rs.skipStoreProofs {
+		return res
+	}
+
+	if res.ProofOps == nil || len(res.ProofOps.Ops) == 0 {
+		return sdkerrors.QueryResult(sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "proof is unexpectedly empty; ensure height has not been pruned"))
+	}
+
+	commitInfo, err := rs.queryCommitInfo(res.Height)
+	if err != nil {
+		return sdkerrors.QueryResult(err)
+	}
+
+	// Restore origin path and append proof op.
+	if !commitInfoHasStore(commitInfo, storeName) {
+		return sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s is not part of the commit hash and can't be proven", storeName))
+	}
+	res.ProofOps.Ops = append(res.ProofOps.Ops, commitInfo.ProofOp(storeName))
+
+	return res
+}
+
+// TruncatedQueryInfo is the Info of a `/subspace` Query response cut off to the
+// maximum response size, see SetMaxQueryResponseSize.
+const TruncatedQueryInfo = "truncated"
+
+// truncateQueryResponse cuts off the KV pairs of a `/subspace` query response
+// to fit into maxSize bytes, keeping the leading pairs. Responses to any other
+// query can't be cut off, and an error is returned for them.
+func truncateQueryResponse(subpath string, res abci.ResponseQuery, maxSize int) (abci.ResponseQuery, error) {
+	if subpath != "/subspace" {
+		return res, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+			"query response of %d bytes exceeds the maximum of %d bytes", len(res.Value), maxSize)
+	}
+
+	pairs := kv.Pairs{}
+	if err := pairs.Unmarshal(res.Value); err != nil {
+		return res, sdkerrors.Wrap(err, "failed to decode subspace query response")
+	}
+
+	// each pair is encoded as a length-prefixed field with a one-byte tag
+	size, n := 0, 0
+	for _, pair := range pairs.Pairs {
+		pairSize := pair.Size()
+		size += 1 + proto.SizeVarint(uint64(pairSize)) + pairSize
+		if size > maxSize {
+			break
+		}
+		n++
+	}
+
+	total := len(pairs.Pairs)
+	pairs.Pairs = pairs.Pairs[:n]
+	bz, err := pairs.Marshal()
+	if err != nil {
+		return res, sdkerrors.Wrap(err, "failed to encode subspace query response")
+	}
+
+	res.Value = bz
+	res.Info = TruncatedQueryInfo
+	res.Log = fmt.Sprintf("response truncated to %d of %d pairs to fit into %d bytes", n, total, maxSize)
+
+	return res, nil
+}
+
+// commitInfoHasStore returns whether the named store is recorded in the commit
+// info.
+func commitInfoHasStore(commitInfo *types.CommitInfo, storeName string) bool {
+	for _, si := range commitInfo.StoreInfos {
+		if si.Name == storeName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queryCommitInfo returns the commit info used to prove a query result at the
+// given height. If the height is the latest height we've committed, then
+// utilize the store's lastCommitInfo as this commit info may not be flushed to
+// disk. Otherwise, we query for the commit info from disk.
+func (rs *Store) queryCommitInfo(height int64) (*types.CommitInfo, error) {
+	if height == rs.lastCommitInfo.Version {
+		return rs.lastCommitInfo, nil
+	}
+
+	commitInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, height)
+	if err != nil {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+			"failed to load commit info for height %d; ensure height has not been pruned: %s", height, err)
+	}
+
+	return commitInfo, nil
+}
+
+// StoreKeyQuery identifies a single key of a named sub-store in a QueryKeys
+// batch.
+type StoreKeyQuery struct {
+	StoreName string
+	Key       []byte
+}
+
+// QueryKeys queries many keys sharing a single height in one call. It is
+// equivalent to issuing a `/<storeName>/key` Query for each entry, but stores
+// are resolved, and commit info and the `multistore -> substore` proof op are
+// loaded, once per batch rather than once per key. Errors that apply to the
+// whole batch (e.g. an invalid height) are returned directly; errors for an
+// individual key are reported in its response, in request order. Unlike
+// Query, a height of 0 queries the latest committed version.
+func (rs *Store) QueryKeys(height int64, keys []StoreKeyQuery, prove bool) ([]abci.ResponseQuery, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	latest, err := rs.latestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if height == 0 {
+		height = latest
+	}
+	if height > latest {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"cannot query with height in the future; requested %d, latest committed %d", height, latest)
+	}
+
+	if height > 0 && height < latest {
+		// only the stores of the queried keys are loaded
+		names := make(map[string]bool, len(keys))
+		for _, k := range keys {
+			names[k.StoreName] = true
+		}
+		versioned, err := rs.versionedMultiStore(height, names)
+		if err != nil {
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"failed to load state for height %d; ensure height has not been pruned: %s", height, err)
+		}
+
+		return versioned.QueryKeys(height, keys, prove)
+	}
+
+	multiStoreProofs := prove && !rs.skipStoreProofs
+	var commitInfo *types.CommitInfo
+	if multiStoreProofs {
+		var err error
+		if commitInfo, err = rs.queryCommitInfo(latest); err != nil {
+			return nil, err
+		}
+	}
+
+	queryables := make(map[string]types.Queryable)
+	proofOps := make(map[string]tmcrypto.ProofOp)
+	responses := make([]abci.ResponseQuery, len(keys))
+
+	for i, k := range keys {
+		queryable, ok := queryables[k.StoreName]
+		if !ok {
+			store := rs.getStoreByName(k.StoreName)
+			if store == nil {
+				if rs.isUnloaded(k.StoreName) {
+					responses[i] = sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not loaded: %s", k.StoreName))
+				} else {
+					responses[i] = sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", k.StoreName))
+				}
+				continue
+			}
+
+			if queryable, ok = store.(types.Queryable); !ok {
+				responses[i] = sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store %s (type %T) doesn't support queries", k.StoreName, store))
+				continue
+			}
+
+			queryables[k.StoreName] = queryable
+		}
+
+		res := queryable.Query(abci.RequestQuery{Path: "/key", Data: k.Key, Height: height, Prove: prove})
+		if multiStoreProofs && res.Code == 0 {
+			if res.ProofOps == nil || len(res.ProofOps.Ops) == 0 {
+				responses[i] = sdkerrors.QueryResult(sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "proof is unexpectedly empty; ensure height has not been pruned"))
+				continue
+			}
+
+			proofOp, ok := proofOps[k.StoreName]
+			if !ok && !commitInfoHasStore(commitInfo, k.StoreName) {
+				responses[i] = sdkerrors.QueryResult(sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "store %s is not part of the commit hash and can't be proven", k.StoreName))
+				continue
+			}
+			if !ok {
+				proofOp = commitInfo.ProofOp(k.StoreName)
+				proofOps[k.StoreName] = proofOp
+			}
+
+			res.ProofOps.Ops = append(res.ProofOps.Ops, proofOp)
+		}
+
+		responses[i] = res
+	}
+
+	return responses, nil
+}
+
+// QuerySubspace returns the KV pairs of the named store under the given prefix
+// one page at a time, while a `/<storeName>/subspace` Query returns all of them
+// at once. Pages are requested with the standard query.PageRequest, by offset or
+// by the next key of the query.PageResponse of the previous page, which is
+// relative to the prefix. Keys of the returned pairs include the prefix, as for
+// `/subspace`. As for QueryKeys, a height of 0 queries the latest committed
+// version, so uncommitted writes to IAVL stores are never returned. Stores of
+// other types aren't versioned and are read at their current state.
+func (rs *Store) QuerySubspace(
+	storeName string, height int64, keyPrefix []byte, page *query.PageRequest,
+) ([]kv.Pair, *query.PageResponse, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	if err := rs.checkClosed(); err != nil {
+		return nil, nil, err
+	}
+
+	latest, err := rs.latestVersion()
+	if err != nil {
+		return nil, nil, err
+	}
+	if height == 0 {
+		height = latest
+	}
+	if height > latest {
+		return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidHeight,
+			"cannot query with height in the future; requested %d, latest committed %d", height, latest)
+	}
+
+	// The committed version is read rather than the working state, and only
+	// the queried store is loaded. Before the first commit, IAVL stores are
+	// read as of version 0, i.e. empty.
+	src := rs
+	if height > 0 {
+		src, err = rs.versionedMultiStore(height, map[string]bool{storeName: true})
+		if err != nil {
+			return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+				"failed to load state for height %d; ensure height has not been pruned: %s", height, err)
+		}
+	}
+
+	store := src.getStoreByName(storeName)
+	if store == nil {
+		if src.isUnloaded(storeName) {
+			return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not loaded: %s", storeName)
+		}
+		return nil, nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", storeName)
+	}
+	kvStore := store.(types.KVStore)
+	if height == 0 && store.GetStoreType() == types.StoreTypeIAVL {
+		if kvStore, err = rs.GetCommitKVStore(src.keysByName[storeName]).(*iavl.Store).GetImmutable(0); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pairs := []kv.Pair{}
+	res, err := query.Paginate(prefix.NewStore(kvStore, keyPrefix), page, func(key, value []byte) error {
+		pairs = append(pairs, kv.Pair{Key: append(append([]byte{}, keyPrefix...), key...), Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, err.Error())
+	}
+
+	return pairs, res, nil
+}
+
+// SetInitialVersion sets the initial version of the IAVL tree. It is used when
+// starting a new chain at an arbitrary height, e.g. when forking an existing
+// chain, so that the first Commit produces the given version. It applies to
+// the IAVL stores that are already loaded as well as to those loaded later,
+// and can only be called before the first commit.
+func (rs *Store) SetInitialVersion(version int64) error {
+	if version < 0 {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "initial version %d must not be negative", version)
+	}
+	if latest := rs.lastCommitInfo.GetVersion(); latest > 0 {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "cannot set initial version %d after version %d has been committed", version, latest)
+	}
+
+	rs.initialVersion = version
+
+	// Loop through all the stores, if it's an IAVL store, then set initial
+	// version on it.
+	for key, store := range rs.stores {
+		if store.GetStoreType() == types.StoreTypeIAVL {
+			// If the store is wrapped with an inter-block cache, we must first unwrap
+			// it to get the underlying IAVL store.
+			store = rs.GetCommitKVStore(key)
+			store.(*iavl.Store).SetInitialVersion(version)
+		}
+	}
+
 	return nil
 }
 
 // parsePath expects a format like /<storeName>[/<subpath>]
 // Must start with /, subpath may be empty
-// Returns error if it doesn't start with /
+// Returns error if it doesn't start with / or if the store name is empty
 func parsePath(path string) (storeName string, subpath string, err error) {
 	if !strings.HasPrefix(path, "/") {
 		return storeName, subpath, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "invalid path: %s", path)
 	}
 
-	paths := strings.SplitN(path[1:], "/", 2)
-	storeName = paths[0]
+	paths := strings.SplitN(path[1:], "/", 2)
+	storeName = paths[0]
+
+	if storeName == "" {
+		return "", "", sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "invalid path: empty store name: %s", path)
+	}
+
+	if len(paths) == 2 {
+		subpath = "/" + paths[1]
+	}
+
+	return storeName, subpath, nil
+}
+
+// ExportStore returns the IAVL export of a single IAVL store at the given
+// version, i.e. its nodes in the order produced by the IAVL exporter, which is
+// the order the IAVL importer expects them in. See ExportStoreFunc for a
+// streaming variant that doesn't hold the whole export in memory.
+func (rs *Store) ExportStore(key types.StoreKey, version int64) ([]*iavltree.ExportNode, error) {
+	nodes := []*iavltree.ExportNode{}
+	err := rs.ExportStoreFunc(key, version, func(node *iavltree.ExportNode) error {
+		nodes = append(nodes, node)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// ExportStoreFunc exports a single IAVL store at the given version, calling fn
+// with each exported node. Exporting is stopped at the first error returned by
+// fn, which is then returned.
+func (rs *Store) ExportStoreFunc(key types.StoreKey, version int64, fn func(*iavltree.ExportNode) error) error {
+	store, err := rs.iavlStoreWithVersion(key, version)
+	if err != nil {
+		return err
+	}
+
+	exporter, err := store.Export(version)
+	if err != nil {
+		return err
+	}
+	defer exporter.Close()
+
+	for {
+		node, err := exporter.Next()
+		if err == iavltree.ExportDone {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(node); err != nil {
+			return err
+		}
+	}
+}
+
+// StoreDiff returns the changes to the IAVL store with the given key from
+// fromVersion to toVersion, each sorted by key: the keys added and modified
+// with their values at toVersion, and the keys deleted with their values at
+// fromVersion. Immutable views of both versions are iterated side by side, so
+// the whole store is read even if only a few keys changed.
+func (rs *Store) StoreDiff(
+	key types.StoreKey, fromVersion, toVersion int64,
+) (added, modified, deleted []types.KVPair, err error) {
+	from, err := rs.immutableStoreWithVersion(key, fromVersion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	to, err := rs.immutableStoreWithVersion(key, toVersion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fromIter, toIter := from.Iterator(nil, nil), to.Iterator(nil, nil)
+	defer fromIter.Close()
+	defer toIter.Close()
+
+	for fromIter.Valid() || toIter.Valid() {
+		cmp := -1
+		switch {
+		case !fromIter.Valid():
+			cmp = 1
+		case toIter.Valid():
+			cmp = bytes.Compare(fromIter.Key(), toIter.Key())
+		}
+
+		switch {
+		case cmp < 0:
+			deleted = append(deleted, types.KVPair{Key: fromIter.Key(), Value: fromIter.Value()})
+			fromIter.Next()
+
+		case cmp > 0:
+			added = append(added, types.KVPair{Key: toIter.Key(), Value: toIter.Value()})
+			toIter.Next()
+
+		default:
+			if !bytes.Equal(fromIter.Value(), toIter.Value()) {
+				modified = append(modified, types.KVPair{Key: toIter.Key(), Value: toIter.Value()})
+			}
+			fromIter.Next()
+			toIter.Next()
+		}
+	}
+
+	return added, modified, deleted, nil
+}
+
+// IterateVersioned returns an iterator over the domain [start, end) of the IAVL
+// store with the given key as of the given committed version. Unlike the stores
+// of CacheMultiStoreWithVersion, which are read at the latest state if their
+// type isn't versioned, an error is returned for non-IAVL stores, as well as
+// for versions the store doesn't have. The iterator must be closed.
+func (rs *Store) IterateVersioned(key types.StoreKey, version int64, start, end []byte) (types.Iterator, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	store, err := rs.immutableStoreWithVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Iterator(start, end), nil
+}
+
+// ReverseIterateVersioned is like IterateVersioned, but iterates over the
+// domain in descending key order.
+func (rs *Store) ReverseIterateVersioned(key types.StoreKey, version int64, start, end []byte) (types.Iterator, error) {
+	rs.mtx.RLock()
+	defer rs.mtx.RUnlock()
+
+	store, err := rs.immutableStoreWithVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.ReverseIterator(start, end), nil
+}
+
+// iavlStoreWithVersion returns the mounted IAVL store with the given key,
+// which must have the given version.
+func (rs *Store) iavlStoreWithVersion(key types.StoreKey, version int64) (*iavl.Store, error) {
+	if err := rs.checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	if _, ok := rs.stores[key]; !ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no such store: %s", key.Name())
+	}
+	store, ok := rs.GetCommitKVStore(key).(*iavl.Store)
+	if !ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "store %q is not an IAVL store", key.Name())
+	}
+	if !store.VersionExists(version) {
+		return nil, sdkerrors.Wrapf(types.ErrVersionDoesNotExist, "store %s at version %d", key.Name(), version)
+	}
+
+	return store, nil
+}
+
+// immutableStoreWithVersion returns an immutable view of the mounted IAVL store
+// with the given key at the given version.
+func (rs *Store) immutableStoreWithVersion(key types.StoreKey, version int64) (*iavl.Store, error) {
+	store, err := rs.iavlStoreWithVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetImmutable(version)
+}
+
+//---------------------- Snapshotting ------------------
+
+// SnapshotOptions configures the chunk stream generated by SnapshotWithOptions.
+type SnapshotOptions struct {
+	// ChunkSize is the maximum size of each snapshot chunk in bytes. Every store is written into
+	// one continuous stream which is split at ChunkSize boundaries, so a single large store may
+	// span several chunks. Chunk hashes and ordering are recorded by the snapshot manager.
+	ChunkSize uint64
+
+	// CompressionLevel is the zlib compression level of the stream, from zlib.HuffmanOnly to
+	// zlib.BestCompression, trading snapshot size for CPU time. Restore decompresses streams of
+	// any level, but chunks are only interchangeable between nodes using the same level. 0, which
+	// would otherwise be zlib.NoCompression, uses the level of DefaultSnapshotOptions.
+	CompressionLevel int
+
+	// Workers is the maximum number of stores exported concurrently. Stores are still written
+	// to the stream in order, so the output doesn't depend on it, and a store exported ahead of
+	// the one being written only prefetches its first 1024 items. A non-positive value uses
+	// GOMAXPROCS.
+	Workers int
+
+	// Transform, if set, is applied to every key/value pair exported, e.g. to redact data before
+	// sharing a snapshot. Such snapshots must use TransformedSnapshotFormat.
+	Transform SnapshotTransform
+}
+
+// SnapshotTransform transforms a leaf node of the named store during a snapshot, returning the
+// node to export instead, or false to drop it. Only the key and value of the returned node are
+// used: the store's tree is rebuilt from the transformed pairs at the snapshot height, since the
+// importer requires a consistent tree. It may be called concurrently for different stores.
+type SnapshotTransform func(store string, node iavltree.ExportNode) (iavltree.ExportNode, bool)
+
+// TransformedSnapshotFormat is the format of snapshots taken with a SnapshotOptions.Transform. The
+// chunk stream has the same layout as snapshottypes.CurrentFormat, but the restored state doesn't
+// match the app hash of the snapshot height, so these snapshots can't be verified against it and
+// are not meant for state sync.
+const TransformedSnapshotFormat uint32 = 1<<31 | snapshottypes.CurrentFormat
+
+// DefaultSnapshotOptions returns the options used by Snapshot. Snapshots offered to other nodes
+// must use these, since chunks are only interchangeable between nodes using the same chunk size.
+func DefaultSnapshotOptions() SnapshotOptions {
+	return SnapshotOptions{
+		ChunkSize:        snapshotChunkSize,
+		CompressionLevel: snapshotCompressionLevel,
+	}
+}
+
+// Snapshot implements snapshottypes.Snapshotter. The snapshot output for a given format must be
+// identical across nodes such that chunks from different sources fit together. If the output for a
+// given format changes (at the byte level), the snapshot format must be bumped - see
+// TestMultistoreSnapshot_Checksum test.
+//
+// Every IAVL store is snapshotted. Transient and memory stores hold no persisted state and are
+// always skipped, so the set of skipped stores follows from the mounted store types, and Restore
+// fails if the snapshot lacks any other store.
+//
+// The store only produces the chunk stream. The snapshot metadata, i.e. height, format, chunk
+// count and chunk hashes, is recorded once per snapshot by the snapshot manager when saving the
+// stream, and is verified by it when restoring, see snapshots.Store.Save and snapshots.Manager.
+func (rs *Store) Snapshot(height uint64, format uint32) (<-chan io.ReadCloser, error) {
+	return rs.SnapshotWithOptions(height, format, DefaultSnapshotOptions())
+}
+
+// SnapshotWithOptions is like Snapshot, but generates the chunk stream using the given options.
+// Restore reassembles the stream from chunks of any size.
+func (rs *Store) SnapshotWithOptions(height uint64, format uint32, opts SnapshotOptions) (<-chan io.ReadCloser, error) {
+	return rs.SnapshotWithContext(context.Background(), height, format, opts)
+}
+
+// SnapshotWithContext is like SnapshotWithOptions, but aborts generating the chunk stream once ctx
+// is done, e.g. to enforce a time budget on a backup. The context is checked between items, and
+// the stream is then closed with ctx.Err(), which snapshots.Store.Save returns after removing the
+// chunks saved so far.
+func (rs *Store) SnapshotWithContext(
+	ctx context.Context, height uint64, format uint32, opts SnapshotOptions,
+) (<-chan io.ReadCloser, error) {
+	if err := rs.checkClosed(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize == 0 {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "snapshot chunk size cannot be 0")
+	}
+	if opts.CompressionLevel == 0 {
+		opts.CompressionLevel = snapshotCompressionLevel
+	}
+	if opts.CompressionLevel < zlib.HuffmanOnly || opts.CompressionLevel > zlib.BestCompression {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "invalid snapshot compression level %d", opts.CompressionLevel)
+	}
+	if opts.Transform != nil && format != TransformedSnapshotFormat {
+		return nil, sdkerrors.Wrapf(snapshottypes.ErrUnknownFormat,
+			"format %v, transformed snapshots must use format %v", format, TransformedSnapshotFormat)
+	}
+	if opts.Transform == nil {
+		if err := snapshottypes.ValidateFormat(format, snapshottypes.CurrentFormat); err != nil {
+			return nil, err
+		}
+	}
+	if height == 0 {
+		return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot snapshot height 0")
+	}
+	if height > uint64(rs.LastCommitID().Version) {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "cannot snapshot future height %v", height)
+	}
+
+	// Collect stores to snapshot (only IAVL stores are supported)
+	stores := []snapshotIAVLStore{}
+	for key := range rs.stores {
+		switch store := rs.GetCommitKVStore(key).(type) {
+		case *iavl.Store:
+			stores = append(stores, snapshotIAVLStore{name: key.Name(), Store: store})
+		case *transient.Store, *mem.Store:
+			// Non-persisted stores shouldn't be snapshotted
+			rs.logger.Debug("skipping snapshot of non-persisted store", "store", key.Name())
+			continue
+		default:
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic,
+				"don't know how to snapshot store %q of type %T", key.Name(), store)
+		}
+	}
+	sort.Slice(stores, func(i, j int) bool {
+		return strings.Compare(stores[i].name, stores[j].name) == -1
+	})
+
+	// Spawn goroutine to generate snapshot chunks and pass their io.ReadClosers through a channel
+	ch := make(chan io.ReadCloser)
+	go func() {
+		// Set up a stream pipeline to serialize snapshot nodes:
+		// ExportNode -> delimited Protobuf -> zlib -> buffer -> chunkWriter -> chan io.ReadCloser
+		chunkWriter := snapshots.NewChunkWriter(ch, opts.ChunkSize)
+		defer chunkWriter.Close()
+		bufWriter := bufio.NewWriterSize(chunkWriter, snapshotBufferSize)
+		defer func() {
+			if err := bufWriter.Flush(); err != nil {
+				chunkWriter.CloseWithError(err)
+			}
+		}()
+		zWriter, err := zlib.NewWriterLevel(bufWriter, opts.CompressionLevel)
+		if err != nil {
+			chunkWriter.CloseWithError(sdkerrors.Wrap(err, "zlib failure"))
+			return
+		}
+		defer func() {
+			if err := zWriter.Close(); err != nil {
+				chunkWriter.CloseWithError(err)
+			}
+		}()
+		protoWriter := protoio.NewDelimitedWriter(zWriter)
+		defer func() {
+			if err := protoWriter.Close(); err != nil {
+				chunkWriter.CloseWithError(err)
+			}
+		}()
+
+		// Export each IAVL store. Stores are serialized as a stream of SnapshotItem Protobuf
+		// messages. The first item contains a SnapshotStore with store metadata (i.e. name),
+		// and the following messages contain a SnapshotNode (i.e. an ExportNode). Store changes
+		// are demarcated by new SnapshotStore items. Stores are exported concurrently, but their
+		// items are written in store order.
+		done := make(chan struct{})
+		defer close(done)
+
+		for _, items := range exportSnapshotStores(stores, int64(height), opts.Workers, opts.Transform, done) {
+			for item := range items {
+				if err := ctx.Err(); err != nil {
+					chunkWriter.CloseWithError(err)
+					return
+				}
+				if item.err != nil {
+					chunkWriter.CloseWithError(item.err)
+					return
+				}
+				if err := protoWriter.WriteMsg(item.item); err != nil {
+					chunkWriter.CloseWithError(err)
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// snapshotIAVLStore is an IAVL store to snapshot, along with its name.
+type snapshotIAVLStore struct {
+	*iavl.Store
+	name string
+}
+
+// snapshotResult is a snapshot item exported from a store, or the error that
+// aborted its export.
+type snapshotResult struct {
+	item *types.SnapshotItem
+	err  error
+}
+
+// exportSnapshotStores exports the given stores at the given height with at
+// most workers stores exported concurrently, returning one stream of items per
+// store in the same order. Stores are exported in order, and each export only
+// runs ahead of its reader by a bounded number of items, so reading the
+// streams in order never blocks on a store that isn't being exported. As the
+// streams are read in order, a store exported ahead of the one being read only
+// prefetches its first snapshotExportBufferSize items and then waits. Only
+// stores of up to that many items are hence exported fully in parallel, larger
+// ones mostly as their stream is read. Closing done aborts all exports. If transform is given, it's applied to every store.
+func exportSnapshotStores(
+	stores []snapshotIAVLStore, height int64, workers int, transform SnapshotTransform, done <-chan struct{},
+) []<-chan snapshotResult {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(stores) {
+		workers = len(stores)
+	}
+
+	streams := make([]chan snapshotResult, len(stores))
+	results := make([]<-chan snapshotResult, len(stores))
+	for i := range streams {
+		streams[i] = make(chan snapshotResult, snapshotExportBufferSize)
+		results[i] = streams[i]
+	}
 
-	if len(paths) == 2 {
-		subpath = "/" + paths[1]
+	jobs := make(chan int)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				exportSnapshotStore(stores[j], height, transform, streams[j], done)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := range stores {
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// exportSnapshotStore exports a single store into out, which is closed once
+// the export is done, has failed or has been aborted by closing done.
+func exportSnapshotStore(
+	store snapshotIAVLStore, height int64, transform SnapshotTransform, out chan<- snapshotResult, done <-chan struct{},
+) {
+	defer close(out)
+
+	send := func(res snapshotResult) bool {
+		select {
+		case out <- res:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	var exporter *iavltree.Exporter
+	var err error
+	if transform != nil {
+		exporter, err = exportTransformedStore(store, height, transform)
+	} else {
+		exporter, err = store.Export(height)
+	}
+	if err != nil {
+		send(snapshotResult{err: err})
+		return
+	}
+	defer exporter.Close()
+
+	ok := send(snapshotResult{item: &types.SnapshotItem{
+		Item: &types.SnapshotItem_Store{
+			Store: &types.SnapshotStoreItem{
+				Name: store.name,
+			},
+		},
+	}})
+	if !ok {
+		return
+	}
+
+	for {
+		node, err := exporter.Next()
+		if err == iavltree.ExportDone {
+			return
+		} else if err != nil {
+			send(snapshotResult{err: err})
+			return
+		}
+
+		ok := send(snapshotResult{item: &types.SnapshotItem{
+			Item: &types.SnapshotItem_IAVL{
+				IAVL: &types.SnapshotIAVLItem{
+					Key:     node.Key,
+					Value:   node.Value,
+					Height:  int32(node.Height),
+					Version: node.Version,
+				},
+			},
+		}})
+		if !ok {
+			return
+		}
+	}
+}
+
+// exportTransformedStore rebuilds the given store at height from its leaf
+// nodes passed through transform, in a scratch in-memory tree, and returns an
+// exporter for that tree. The whole transformed store is hence held in memory.
+func exportTransformedStore(
+	store snapshotIAVLStore, height int64, transform SnapshotTransform,
+) (*iavltree.Exporter, error) {
+	source, err := store.Export(height)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	tree, err := iavltree.NewMutableTreeWithOpts(dbm.NewMemDB(), 0, &iavltree.Options{InitialVersion: uint64(height)})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		node, err := source.Next()
+		if err == iavltree.ExportDone {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if node.Height != 0 {
+			continue
+		}
+
+		leaf, ok := transform(store.name, *node)
+		if !ok {
+			continue
+		}
+		if leaf.Value == nil {
+			return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic,
+				"snapshot transform returned nil value for key %X in store %q", leaf.Key, store.name)
+		}
+		tree.Set(leaf.Key, leaf.Value)
+	}
+
+	if _, _, err := tree.SaveVersion(); err != nil {
+		return nil, sdkerrors.Wrapf(err, "failed to rebuild transformed store %q", store.name)
+	}
+	return tree.ImmutableTree.Export(), nil
+}
+
+// Restore implements snapshottypes.Snapshotter. The snapshot is streamed:
+// chunks are decompressed and decoded one item at a time and every IAVL node
+// is handed to the IAVL importer as soon as it is read, which flushes to the
+// DB in fixed-size batches. Peak memory is hence bounded by the size of a
+// single item (at most snapshotMaxItemSize) and the importer batch, not by the
+// size of the store being restored.
+func (rs *Store) Restore(
+	height uint64, format uint32, chunks <-chan io.ReadCloser, ready chan<- struct{},
+) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if rs.readOnly {
+		return sdkerrors.Wrap(types.ErrReadOnly, "cannot restore snapshot")
+	}
+	if err := snapshottypes.ValidateFormat(format, snapshottypes.CurrentFormat, TransformedSnapshotFormat); err != nil {
+		return err
+	}
+	if height == 0 {
+		return sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot restore snapshot at height 0")
+	}
+	if height > math.MaxInt64 {
+		return sdkerrors.Wrapf(snapshottypes.ErrInvalidMetadata,
+			"snapshot height %v cannot exceed %v", height, math.MaxInt64)
+	}
+	if err := rs.checkRestoreTargets(height); err != nil {
+		return err
+	}
+
+	// Signal readiness. Must be done before the readers below are set up, since the zlib
+	// reader reads from the stream on initialization, potentially causing deadlocks.
+	if ready != nil {
+		close(ready)
+	}
+
+	// Set up a restore stream pipeline
+	// chan io.ReadCloser -> chunkReader -> zlib -> delimited Protobuf -> ExportNode
+	chunkReader := snapshots.NewChunkReader(chunks)
+	defer chunkReader.Close()
+	zReader, err := zlib.NewReader(chunkReader)
+	if err == zlib.ErrHeader {
+		// Legacy snapshots were gob-encoded without compression, and are not supported.
+		return sdkerrors.Wrapf(snapshottypes.ErrUnknownFormat,
+			"snapshot chunks are not zlib-compressed Protobuf items for format %v", format)
+	} else if err != nil {
+		return sdkerrors.Wrap(err, "zlib failure")
+	}
+	defer zReader.Close()
+	protoReader := protoio.NewDelimitedReader(zReader, snapshotMaxItemSize)
+	defer protoReader.Close()
+
+	// Import nodes into stores. The first item is expected to be a SnapshotItem containing
+	// a SnapshotStoreItem, telling us which store to import into. The following items will contain
+	// SnapshotNodeItem (i.e. ExportNode) until we reach the next SnapshotStoreItem or EOF.
+	var importer *iavltree.Importer
+	restored := make(map[string]bool)
+	for {
+		item := &types.SnapshotItem{}
+		err := protoReader.ReadMsg(item)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return sdkerrors.Wrap(err, "invalid protobuf message")
+		}
+
+		switch item := item.Item.(type) {
+		case *types.SnapshotItem_Store:
+			if importer != nil {
+				err = importer.Commit()
+				if err != nil {
+					return sdkerrors.Wrap(err, "IAVL commit failed")
+				}
+				importer.Close()
+			}
+			store, err := rs.restoreTarget(item.Store.Name)
+			if err != nil {
+				return err
+			}
+			importer, err = store.Import(int64(height))
+			if err != nil {
+				return sdkerrors.Wrap(err, "import failed")
+			}
+			defer importer.Close()
+			restored[item.Store.Name] = true
+
+		case *types.SnapshotItem_IAVL:
+			if importer == nil {
+				return sdkerrors.Wrap(sdkerrors.ErrLogic, "received IAVL node item before store item")
+			}
+			node, err := snapshotExportNode(item.IAVL)
+			if err != nil {
+				return err
+			}
+			err = importer.Add(node)
+			if err != nil {
+				return sdkerrors.Wrap(err, "IAVL node import failed")
+			}
+
+		default:
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic, "unknown snapshot item %T", item)
+		}
+	}
+
+	if importer != nil {
+		err := importer.Commit()
+		if err != nil {
+			return sdkerrors.Wrap(err, "IAVL commit failed")
+		}
+		importer.Close()
+	}
+
+	if err := rs.checkRestoredStores(height, restored); err != nil {
+		return err
+	}
+
+	// persist the commit info and latest version of the restored height, so
+	// that the store resumes committing from the following version
+	flushMetadata(rs.db, rs.cInfoCodec, int64(height), rs.buildCommitInfo(int64(height)), []int64{}, rs.syncCommits)
+	return rs.LoadLatestVersion()
+}
+
+// checkRestoreTargets returns an error if any loaded IAVL store already holds
+// committed or uncommitted data, since the IAVL importer can only import into
+// an empty tree. It is checked up front, so that a restore into a non-empty
+// store fails before anything is imported rather than midway through.
+func (rs *Store) checkRestoreTargets(height uint64) error {
+	names := make([]string, 0, len(rs.stores))
+	for key, store := range rs.stores {
+		if store.GetStoreType() == types.StoreTypeIAVL {
+			names = append(names, key.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		store := rs.GetCommitKVStore(rs.keysByName[name]).(*iavl.Store)
+		if version := store.LastCommitID().Version; version > 0 {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic,
+				"cannot restore snapshot at height %d into store %q, which already contains data at version %d",
+				height, name, version)
+		}
+		if store.Size() > 0 {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic,
+				"cannot restore snapshot at height %d into store %q, which contains uncommitted data", height, name)
+		}
+	}
+
+	return nil
+}
+
+// EstimateSnapshotSize returns a rough estimate, in bytes, of the uncompressed size of the snapshot
+// stream of the given version, e.g. to check for disk space before snapshotting. It is derived from
+// the number of keys of each IAVL store and the average key and value size of a sample of its
+// keys, without exporting the stores. The stream is compressed, so the chunks written to disk are
+// usually considerably smaller.
+func (rs *Store) EstimateSnapshotSize(version int64) (int64, error) {
+	if version <= 0 {
+		return 0, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "invalid snapshot version %d", version)
+	}
+	if err := rs.checkVersion(version); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for key, store := range rs.stores {
+		if store.GetStoreType() != types.StoreTypeIAVL {
+			continue
+		}
+
+		// If the store is wrapped with an inter-block cache, we must first unwrap
+		// it to get the underlying IAVL store.
+		iavlStore, err := rs.GetCommitKVStore(key).(*iavl.Store).GetImmutable(version)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to load store %s at version %d", key.Name(), version)
+		}
+		size += estimateStoreSnapshotSize(key.Name(), iavlStore)
+	}
+
+	return size, nil
+}
+
+// estimateStoreSnapshotSize estimates the size of the snapshot items of a
+// single store, see EstimateSnapshotSize.
+func estimateStoreSnapshotSize(name string, store *iavl.Store) int64 {
+	// length prefix, field tags and lengths, version and height of an item
+	const itemOverhead = 16
+
+	size := int64(len(name) + itemOverhead)
+	leaves := store.Size()
+	if leaves == 0 {
+		return size
+	}
+
+	var sampled, keyBytes, valueBytes int64
+	itr := store.Iterator(nil, nil)
+	defer itr.Close()
+	for ; itr.Valid() && sampled < snapshotSizeSampleKeys; itr.Next() {
+		keyBytes += int64(len(itr.Key()))
+		valueBytes += int64(len(itr.Value()))
+		sampled++
+	}
+	if sampled == 0 {
+		return size
+	}
+	avgKey, avgValue := keyBytes/sampled, valueBytes/sampled
+
+	// a tree with n leaves has n-1 inner nodes, which are exported without value
+	return size + leaves*(avgKey+avgValue+itemOverhead) + (leaves-1)*(avgKey+itemOverhead)
+}
+
+// SnapshotLatest snapshots the latest committed version in the current format
+// into a local snapshot store, e.g. one opened with snapshots.NewStore on a
+// node's snapshot directory, and returns the commit ID of the snapshotted
+// version. It saves callers from looking up the version to snapshot, which
+// could otherwise be stale or not match the committed state.
+func (rs *Store) SnapshotLatest(snapshotStore *snapshots.Store) (types.CommitID, error) {
+	if err := rs.checkClosed(); err != nil {
+		return types.CommitID{}, err
+	}
+
+	commitID := rs.LastCommitID()
+	if commitID.Version == 0 {
+		return types.CommitID{}, sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot snapshot before the first commit")
+	}
+
+	chunks, err := rs.Snapshot(uint64(commitID.Version), snapshottypes.CurrentFormat)
+	if err != nil {
+		return types.CommitID{}, err
+	}
+	if _, err := snapshotStore.Save(uint64(commitID.Version), snapshottypes.CurrentFormat, chunks); err != nil {
+		return types.CommitID{}, err
+	}
+
+	return commitID, nil
+}
+
+// restoreTarget returns the loaded IAVL store a snapshot store item with the
+// given name is imported into. The name and the mounted type of the store are
+// checked before anything is imported into it, so that a snapshot naming a
+// store that isn't mounted, or mounted with another type, is refused with
+// ErrInvalidRequest.
+func (rs *Store) restoreTarget(name string) (*iavl.Store, error) {
+	key, ok := rs.keysByName[name]
+	if !ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot import into unmounted store %q", name)
+	}
+	if typ := rs.storesParams[key].typ; typ != types.StoreTypeIAVL {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot import into store %q mounted as %s, not %s", name, typ, types.StoreTypeIAVL)
+	}
+	if _, ok := rs.stores[key]; !ok {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot import into store %q, which isn't loaded", name)
+	}
+
+	// If the store is wrapped with an inter-block cache, we must first unwrap
+	// it to get the underlying IAVL store.
+	return rs.GetCommitKVStore(key).(*iavl.Store), nil
+}
+
+// checkRestoredStores returns an error if a loaded IAVL store wasn't restored
+// from the snapshot. Snapshots skip exactly the stores that aren't persisted,
+// i.e. transient and memory stores, so any other store missing from the
+// snapshot is a sign of lost data rather than an intentional skip.
+func (rs *Store) checkRestoredStores(height uint64, restored map[string]bool) error {
+	var missing []string
+	for key, store := range rs.stores {
+		switch store.GetStoreType() {
+		case types.StoreTypeIAVL:
+			if !restored[key.Name()] {
+				missing = append(missing, key.Name())
+			}
+		default:
+			rs.logger.Debug("store not restored from snapshot as it isn't persisted", "store", key.Name())
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+
+	return sdkerrors.Wrapf(sdkerrors.ErrLogic, "snapshot at height %d has no data for store(s) %s",
+		height, strings.Join(missing, ", "))
+}
+
+// RestoreFromSnapshotStore restores the snapshot of the given height and format
+// from a local snapshot store, e.g. one opened with snapshots.NewStore on a
+// node's snapshot directory, without going through state sync. Chunks are read
+// in order and verified against the chunk hashes recorded in the snapshot
+// metadata. If expectedHash is given, the app hash of the restored version must
+// match it, otherwise the restored data is removed again, see restoreSnapshot,
+// and an error is returned. Snapshots in TransformedSnapshotFormat can't be verified,
+// and are refused if expectedHash is given. On success the commit ID
+// of the restored version is returned, and the store resumes committing from
+// the following version.
+func (rs *Store) RestoreFromSnapshotStore(
+	snapshotStore *snapshots.Store, height uint64, format uint32, expectedHash []byte,
+) (types.CommitID, error) {
+	snapshot, chunks, err := snapshotStore.Load(height, format)
+	if err != nil {
+		return types.CommitID{}, err
+	}
+	if snapshot == nil {
+		return types.CommitID{}, sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no snapshot at height %v with format %v", height, format)
+	}
+	defer func() {
+		// release the loader if the restore failed before consuming all chunks
+		for chunk := range chunks {
+			chunk.Close()
+		}
+	}()
+
+	return rs.restoreSnapshot(snapshot, chunks, expectedHash)
+}
+
+// snapshotMetadataDBName is the name of the snapshot metadata DB in a node's
+// snapshot directory.
+const snapshotMetadataDBName = "metadata"
+
+// RestoreAndVerify restores the snapshot of the given version in the current
+// format from a node's snapshot directory, i.e. the directory of a
+// snapshots.Store with its metadata in a GoLevelDB named "metadata", which must
+// not be opened by anyone else meanwhile. Unlike RestoreFromSnapshotStore, the
+// app hash is required: the restore is only kept if the restored app hash
+// matches expectedAppHash, otherwise the restored data is removed again and an
+// error is returned.
+func (rs *Store) RestoreAndVerify(dir string, version int64, expectedAppHash []byte) error {
+	if version <= 0 {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "invalid snapshot version %d", version)
+	}
+	if len(expectedAppHash) == 0 {
+		return sdkerrors.Wrap(sdkerrors.ErrInvalidRequest, "expected app hash cannot be empty")
+	}
+
+	db, err := dbm.NewDB(snapshotMetadataDBName, dbm.GoLevelDBBackend, dir)
+	if err != nil {
+		return sdkerrors.Wrapf(err, "failed to open snapshot metadata in %q", dir)
+	}
+	defer db.Close()
+	snapshotStore, err := snapshots.NewStore(db, dir)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.RestoreFromSnapshotStore(snapshotStore, uint64(version), snapshottypes.CurrentFormat, expectedAppHash)
+	return err
+}
+
+// snapshotExportNode converts a snapshot item back into the IAVL node it was
+// exported from.
+func snapshotExportNode(item *types.SnapshotIAVLItem) (*iavltree.ExportNode, error) {
+	if item.Height > math.MaxInt8 {
+		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "node height %v cannot exceed %v",
+			item.Height, math.MaxInt8)
+	}
+	node := &iavltree.ExportNode{
+		Key:     item.Key,
+		Value:   item.Value,
+		Height:  int8(item.Height),
+		Version: item.Version,
+	}
+	// Protobuf does not differentiate between []byte{} as nil, but fortunately IAVL does
+	// not allow nil keys nor nil values for leaf nodes, so we can always set them to empty.
+	if node.Key == nil {
+		node.Key = []byte{}
+	}
+	if node.Height == 0 && node.Value == nil {
+		node.Value = []byte{}
 	}
 
-	return storeName, subpath, nil
+	return node, nil
 }
 
-//---------------------- Snapshotting ------------------
-
-// Snapshot implements snapshottypes.Snapshotter. The snapshot output for a given format must be
-// identical across nodes such that chunks from different sources fit together. If the output for a
-// given format changes (at the byte level), the snapshot format must be bumped - see
-// TestMultistoreSnapshot_Checksum test.
-func (rs *Store) Snapshot(height uint64, format uint32) (<-chan io.ReadCloser, error) {
-	if format != snapshottypes.CurrentFormat {
-		return nil, sdkerrors.Wrapf(snapshottypes.ErrUnknownFormat, "format %v", format)
+// restoreScratchPrefix is the DB prefix RestoreStore imports a store under
+// before swapping it in, followed by the store name.
+const restoreScratchPrefix = "s/restore/"
+
+// RestoreStore restores a single IAVL store from the snapshot of the given
+// version in a snapshot store, leaving the other stores untouched, e.g. to
+// recover a store with corrupted data. The version must be the latest committed
+// version, and the other stores must match the commit info persisted for it.
+// The snapshot is imported under a scratch prefix in the store's DB first, so
+// a snapshot that lacks the store, is truncated or corrupt leaves the store
+// untouched. Only then all data of the store, including earlier versions, is
+// replaced by the imported data, and the commit info of the version is
+// rewritten with the restored commit ID of the store. If the swap is
+// interrupted, the store has to be restored again.
+func (rs *Store) RestoreStore(key types.StoreKey, snapshotStore *snapshots.Store, version int64) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
 	}
-	if height == 0 {
-		return nil, sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot snapshot height 0")
+	if rs.readOnly {
+		return sdkerrors.Wrap(types.ErrReadOnly, "cannot restore store")
 	}
-	if height > uint64(rs.LastCommitID().Version) {
-		return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic, "cannot snapshot future height %v", height)
+	if rs.storesToLoad != nil {
+		return sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot restore a store when only a subset of the stores is loaded")
+	}
+	params, ok := rs.storesParams[key]
+	if !ok {
+		return sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "store not mounted: %s", key.Name())
+	}
+	if params.typ != types.StoreTypeIAVL {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "cannot restore non-IAVL store %s", key.Name())
+	}
+	if latest := rs.lastCommitInfo.GetVersion(); version <= 0 || version != latest {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+			"store %s can only be restored at the latest version %d, not %d", key.Name(), latest, version)
 	}
 
-	// Collect stores to snapshot (only IAVL stores are supported)
-	type namedStore struct {
-		*iavl.Store
-		name string
+	cInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, version)
+	if err != nil {
+		return err
 	}
-	stores := []namedStore{}
-	for key := range rs.stores {
-		switch store := rs.GetCommitKVStore(key).(type) {
-		case *iavl.Store:
-			stores = append(stores, namedStore{name: key.Name(), Store: store})
-		case *transient.Store, *mem.Store:
-			// Non-persisted stores shouldn't be snapshotted
+	for _, si := range cInfo.StoreInfos {
+		if si.Name == key.Name() {
 			continue
-		default:
-			return nil, sdkerrors.Wrapf(sdkerrors.ErrLogic,
-				"don't know how to snapshot store %q of type %T", key.Name(), store)
+		}
+		store := rs.getStoreByName(si.Name)
+		if store == nil {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic, "store %s of the commit info of version %d is not loaded", si.Name, version)
+		}
+		if id := store.(types.CommitStore).LastCommitID(); id.Version != si.CommitId.Version || !bytes.Equal(id.Hash, si.CommitId.Hash) {
+			return sdkerrors.Wrapf(sdkerrors.ErrLogic, "store %s diverges from the commit info of version %d: persisted %v, loaded %v",
+				si.Name, version, si.CommitId, id)
 		}
 	}
-	sort.Slice(stores, func(i, j int) bool {
-		return strings.Compare(stores[i].name, stores[j].name) == -1
-	})
 
-	// Spawn goroutine to generate snapshot chunks and pass their io.ReadClosers through a channel
-	ch := make(chan io.ReadCloser)
-	go func() {
-		// Set up a stream pipeline to serialize snapshot nodes:
-		// ExportNode -> delimited Protobuf -> zlib -> buffer -> chunkWriter -> chan io.ReadCloser
-		chunkWriter := snapshots.NewChunkWriter(ch, snapshotChunkSize)
-		defer chunkWriter.Close()
-		bufWriter := bufio.NewWriterSize(chunkWriter, snapshotBufferSize)
-		defer func() {
-			if err := bufWriter.Flush(); err != nil {
-				chunkWriter.CloseWithError(err)
-			}
-		}()
-		zWriter, err := zlib.NewWriterLevel(bufWriter, 7)
-		if err != nil {
-			chunkWriter.CloseWithError(sdkerrors.Wrap(err, "zlib failure"))
-			return
+	snapshot, chunks, err := snapshotStore.Load(uint64(version), snapshottypes.CurrentFormat)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return sdkerrors.Wrapf(sdkerrors.ErrUnknownRequest, "no snapshot at height %v with format %v",
+			version, snapshottypes.CurrentFormat)
+	}
+	defer func() {
+		// release the loader if the restore failed before consuming all chunks
+		for chunk := range chunks {
+			chunk.Close()
 		}
-		defer func() {
-			if err := zWriter.Close(); err != nil {
-				chunkWriter.CloseWithError(err)
-			}
-		}()
-		protoWriter := protoio.NewDelimitedWriter(zWriter)
-		defer func() {
-			if err := protoWriter.Close(); err != nil {
-				chunkWriter.CloseWithError(err)
-			}
-		}()
+	}()
 
-		// Export each IAVL store. Stores are serialized as a stream of SnapshotItem Protobuf
-		// messages. The first item contains a SnapshotStore with store metadata (i.e. name),
-		// and the following messages contain a SnapshotNode (i.e. an ExportNode). Store changes
-		// are demarcated by new SnapshotStore items.
-		for _, store := range stores {
-			exporter, err := store.Export(int64(height))
-			if err != nil {
-				chunkWriter.CloseWithError(err)
-				return
-			}
-			defer exporter.Close()
-			err = protoWriter.WriteMsg(&types.SnapshotItem{
-				Item: &types.SnapshotItem_Store{
-					Store: &types.SnapshotStoreItem{
-						Name: store.name,
-					},
-				},
-			})
-			if err != nil {
-				chunkWriter.CloseWithError(err)
-				return
-			}
+	storeDB := rs.db
+	if params.db != nil {
+		storeDB = params.db
+	}
+	prefix := rs.storePrefix(key, params)
+	scratchPrefix := []byte(restoreScratchPrefix + key.Name() + "/")
+	if err := rs.checkRestoreScratchPrefix(storeDB, scratchPrefix); err != nil {
+		return err
+	}
 
-			for {
-				node, err := exporter.Next()
-				if err == iavltree.ExportDone {
-					break
-				} else if err != nil {
-					chunkWriter.CloseWithError(err)
-					return
-				}
-				err = protoWriter.WriteMsg(&types.SnapshotItem{
-					Item: &types.SnapshotItem_IAVL{
-						IAVL: &types.SnapshotIAVLItem{
-							Key:     node.Key,
-							Value:   node.Value,
-							Height:  int32(node.Height),
-							Version: node.Version,
-						},
-					},
-				})
-				if err != nil {
-					chunkWriter.CloseWithError(err)
-					return
-				}
-			}
-			exporter.Close()
-		}
-	}()
+	// IAVL only imports into an empty tree, so leftovers of an earlier,
+	// interrupted restore are deleted first
+	scratch := commitDBStoreAdapter{Store: dbadapter.Store{DB: dbm.NewPrefixDB(storeDB, scratchPrefix)}}
+	if err := deleteKVStore(scratch); err != nil {
+		return errors.Wrapf(err, "failed to clear scratch data of store %s", key.Name())
+	}
+	store, err := iavl.LoadStore(scratch.DB, types.CommitID{}, false)
+	if err != nil {
+		return err
+	}
+	if err := importSnapshotStore(chunks, key.Name(), store.(*iavl.Store), version); err != nil {
+		return err
+	}
+	store, err = iavl.LoadStore(scratch.DB, types.CommitID{Version: version}, false)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load restored store %s", key.Name())
+	}
+	commitID := store.LastCommitID()
 
-	return ch, nil
-}
+	// swap the imported data in
+	live := commitDBStoreAdapter{Store: dbadapter.Store{DB: dbm.NewPrefixDB(storeDB, prefix)}}
+	if err := deleteKVStore(live); err != nil {
+		return errors.Wrapf(err, "failed to delete store %s", key.Name())
+	}
+	if err := moveKVStoreData(scratch, live); err != nil {
+		return errors.Wrapf(err, "failed to move restored data into store %s", key.Name())
+	}
 
-// Restore implements snapshottypes.Snapshotter.
-func (rs *Store) Restore(
-	height uint64, format uint32, chunks <-chan io.ReadCloser, ready chan<- struct{},
-) error {
-	if format != snapshottypes.CurrentFormat {
-		return sdkerrors.Wrapf(snapshottypes.ErrUnknownFormat, "format %v", format)
+	found := false
+	for i, si := range cInfo.StoreInfos {
+		if si.Name == key.Name() {
+			cInfo.StoreInfos[i].CommitId = commitID
+			found = true
+		}
 	}
-	if height == 0 {
-		return sdkerrors.Wrap(sdkerrors.ErrLogic, "cannot restore snapshot at height 0")
+	if !found && rs.includeInCommitHash(key, types.StoreTypeIAVL) {
+		cInfo.StoreInfos = append(cInfo.StoreInfos, types.StoreInfo{
+			Name:      key.Name(),
+			CommitId:  commitID,
+			StoreType: types.StoreTypeIAVL,
+		})
 	}
-	if height > math.MaxInt64 {
-		return sdkerrors.Wrapf(snapshottypes.ErrInvalidMetadata,
-			"snapshot height %v cannot exceed %v", height, math.MaxInt64)
+
+	batch := rs.db.NewBatch()
+	defer batch.Close()
+	setCommitInfo(batch, rs.cInfoCodec, version, cInfo)
+	if err := batch.WriteSync(); err != nil {
+		return errors.Wrap(err, "failed to write commit info")
 	}
 
-	// Signal readiness. Must be done before the readers below are set up, since the zlib
-	// reader reads from the stream on initialization, potentially causing deadlocks.
-	if ready != nil {
-		close(ready)
+	rs.logger.Info("restored store", "store", key.Name(), "version", version, "hash", fmt.Sprintf("%X", commitID.Hash))
+	return rs.loadVersion(version, nil)
+}
+
+// checkRestoreScratchPrefix returns an error if the scratch prefix RestoreStore
+// imports a store under overlaps the prefix of a store kept in the given DB,
+// which is only possible with a custom StorePrefixer.
+func (rs *Store) checkRestoreScratchPrefix(db dbm.DB, scratchPrefix []byte) error {
+	for key, params := range rs.storesParams {
+		if params.db != db && (params.db != nil || db != rs.db) {
+			continue
+		}
+		prefix := rs.storePrefix(key, params)
+		if bytes.HasPrefix(prefix, scratchPrefix) || bytes.HasPrefix(scratchPrefix, prefix) {
+			return fmt.Errorf("store %s has DB prefix %q overlapping the restore scratch prefix %q",
+				key.Name(), prefix, scratchPrefix)
+		}
 	}
 
-	// Set up a restore stream pipeline
-	// chan io.ReadCloser -> chunkReader -> zlib -> delimited Protobuf -> ExportNode
+	return nil
+}
+
+// importSnapshotStore imports the items of the named store from a snapshot
+// chunk stream into an empty IAVL store at the given version, skipping the
+// items of all other stores.
+func importSnapshotStore(chunks <-chan io.ReadCloser, name string, store *iavl.Store, version int64) error {
 	chunkReader := snapshots.NewChunkReader(chunks)
 	defer chunkReader.Close()
 	zReader, err := zlib.NewReader(chunkReader)
@@ -734,9 +4168,6 @@ func (rs *Store) Restore(
 	protoReader := protoio.NewDelimitedReader(zReader, snapshotMaxItemSize)
 	defer protoReader.Close()
 
-	// Import nodes into stores. The first item is expected to be a SnapshotItem containing
-	// a SnapshotStoreItem, telling us which store to import into. The following items will contain
-	// SnapshotNodeItem (i.e. ExportNode) until we reach the next SnapshotStoreItem or EOF.
 	var importer *iavltree.Importer
 	for {
 		item := &types.SnapshotItem{}
@@ -750,17 +4181,13 @@ func (rs *Store) Restore(
 		switch item := item.Item.(type) {
 		case *types.SnapshotItem_Store:
 			if importer != nil {
-				err = importer.Commit()
-				if err != nil {
-					return sdkerrors.Wrap(err, "IAVL commit failed")
-				}
-				importer.Close()
+				// all items of the store have been imported
+				return sdkerrors.Wrap(importer.Commit(), "IAVL commit failed")
 			}
-			store, ok := rs.getStoreByName(item.Store.Name).(*iavl.Store)
-			if !ok || store == nil {
-				return sdkerrors.Wrapf(sdkerrors.ErrLogic, "cannot import into non-IAVL store %q", item.Store.Name)
+			if item.Store.Name != name {
+				continue
 			}
-			importer, err = store.Import(int64(height))
+			importer, err = store.Import(version)
 			if err != nil {
 				return sdkerrors.Wrap(err, "import failed")
 			}
@@ -768,28 +4195,13 @@ func (rs *Store) Restore(
 
 		case *types.SnapshotItem_IAVL:
 			if importer == nil {
-				return sdkerrors.Wrap(sdkerrors.ErrLogic, "received IAVL node item before store item")
-			}
-			if item.IAVL.Height > math.MaxInt8 {
-				return sdkerrors.Wrapf(sdkerrors.ErrLogic, "node height %v cannot exceed %v",
-					item.IAVL.Height, math.MaxInt8)
-			}
-			node := &iavltree.ExportNode{
-				Key:     item.IAVL.Key,
-				Value:   item.IAVL.Value,
-				Height:  int8(item.IAVL.Height),
-				Version: item.IAVL.Version,
-			}
-			// Protobuf does not differentiate between []byte{} as nil, but fortunately IAVL does
-			// not allow nil keys nor nil values for leaf nodes, so we can always set them to empty.
-			if node.Key == nil {
-				node.Key = []byte{}
+				continue
 			}
-			if node.Height == 0 && node.Value == nil {
-				node.Value = []byte{}
-			}
-			err := importer.Add(node)
+			node, err := snapshotExportNode(item.IAVL)
 			if err != nil {
+				return err
+			}
+			if err := importer.Add(node); err != nil {
 				return sdkerrors.Wrap(err, "IAVL node import failed")
 			}
 
@@ -798,26 +4210,147 @@ func (rs *Store) Restore(
 		}
 	}
 
-	if importer != nil {
-		err := importer.Commit()
-		if err != nil {
-			return sdkerrors.Wrap(err, "IAVL commit failed")
+	if importer == nil {
+		return sdkerrors.Wrapf(sdkerrors.ErrLogic, "snapshot does not contain store %q", name)
+	}
+	return sdkerrors.Wrap(importer.Commit(), "IAVL commit failed")
+}
+
+// SnapshotToWriter writes a snapshot of the version with the given commit ID
+// in the current format as a tar archive to w, see snapshots.WriteArchive. It
+// streams to e.g. object storage without a local snapshot store. The commit ID
+// must match the committed version, so that a backup is never taken of
+// different state than the caller expects.
+func (rs *Store) SnapshotToWriter(commitID types.CommitID, w io.Writer) error {
+	if err := rs.checkClosed(); err != nil {
+		return err
+	}
+	if commitID.Version <= 0 || commitID.Version > rs.lastCommitInfo.GetVersion() {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "version %d has not been committed", commitID.Version)
+	}
+
+	cInfo, err := getCommitInfo(rs.db, rs.cInfoCodec, commitID.Version)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cInfo.Hash(), commitID.Hash) {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest, "hash %X does not match hash %X committed at version %d",
+			commitID.Hash, cInfo.Hash(), commitID.Version)
+	}
+
+	chunks, err := rs.Snapshot(uint64(commitID.Version), snapshottypes.CurrentFormat)
+	if err != nil {
+		return err
+	}
+	_, err = snapshots.WriteArchive(w, uint64(commitID.Version), snapshottypes.CurrentFormat, chunks)
+	return err
+}
+
+// RestoreFromReader restores a snapshot archive written by SnapshotToWriter
+// from r, see snapshots.ReadArchive. Chunks are verified against the checksums
+// in the archive before the restored state is persisted. As for
+// RestoreFromSnapshotStore, the restored app hash must match expectedHash if
+// given, or the restored data is removed again, and the commit ID of the
+// restored version is returned.
+func (rs *Store) RestoreFromReader(r io.Reader, expectedHash []byte) (types.CommitID, error) {
+	snapshot, chunks, err := snapshots.ReadArchive(r)
+	if err != nil {
+		return types.CommitID{}, err
+	}
+	defer func() {
+		// release the reader if the restore failed before consuming all chunks
+		for chunk := range chunks {
+			chunk.Close()
 		}
-		importer.Close()
+	}()
+
+	return rs.restoreSnapshot(snapshot, chunks, expectedHash)
+}
+
+// restoreSnapshot restores the given snapshot from its chunks. If expectedHash
+// is given and doesn't match the restored app hash, the restored version is
+// discarded: the data of the IAVL stores, which Restore requires to be empty
+// beforehand, is deleted, and the commit info and latest version are reverted.
+// Stores of other types aren't restored and hence left untouched.
+func (rs *Store) restoreSnapshot(
+	snapshot *snapshottypes.Snapshot, chunks <-chan io.ReadCloser, expectedHash []byte,
+) (types.CommitID, error) {
+	if err := checkRestoreVerifiable(snapshot, expectedHash); err != nil {
+		return types.CommitID{}, err
+	}
+	previous, err := getLatestVersion(rs.db)
+	if err != nil {
+		return types.CommitID{}, err
+	}
+	if err := rs.Restore(snapshot.Height, snapshot.Format, chunks, nil); err != nil {
+		return types.CommitID{}, err
 	}
 
-	flushMetadata(rs.db, int64(height), rs.buildCommitInfo(int64(height)), []int64{})
-	return rs.LoadLatestVersion()
+	commitID := rs.LastCommitID()
+	if expectedHash == nil || bytes.Equal(commitID.Hash, expectedHash) {
+		return commitID, nil
+	}
+
+	err = sdkerrors.Wrapf(types.ErrInvalidProof, "restored app hash %X does not match expected hash %X",
+		commitID.Hash, expectedHash)
+	if discardErr := rs.discardRestored(commitID.Version, previous); discardErr != nil {
+		return types.CommitID{}, sdkerrors.Wrapf(err, "failed to remove restored data: %v", discardErr)
+	}
+
+	return types.CommitID{}, err
+}
+
+// discardRestored removes the version restored by Restore, reverting the latest
+// version to previous. The metadata is reverted first, so that an interrupted
+// discard leaves the restored data unreferenced rather than a latest version
+// without data.
+func (rs *Store) discardRestored(version, previous int64) error {
+	batch := rs.db.NewBatch()
+	defer batch.Close()
+
+	if err := batch.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, version))); err != nil {
+		return err
+	}
+	if previous > 0 {
+		setLatestVersion(batch, previous)
+	} else if err := batch.Delete([]byte(latestVersionKey)); err != nil {
+		return err
+	}
+	setPruningHeights(batch, rs.pruneHeights)
+
+	if err := batch.WriteSync(); err != nil {
+		return errors.Wrap(err, "failed to write metadata")
+	}
+
+	for key, params := range rs.storesParams {
+		if _, ok := rs.stores[key]; ok && params.typ == types.StoreTypeIAVL {
+			if err := rs.deleteStoreData(key, params); err != nil {
+				return err
+			}
+		}
+	}
+
+	return rs.loadVersion(previous, nil)
+}
+
+// checkRestoreVerifiable returns an error if an expected app hash is given for a
+// snapshot which can't be verified against it.
+func checkRestoreVerifiable(snapshot *snapshottypes.Snapshot, expectedHash []byte) error {
+	if expectedHash != nil && snapshot.Format == TransformedSnapshotFormat {
+		return sdkerrors.Wrapf(sdkerrors.ErrInvalidRequest,
+			"snapshot at height %v has been transformed and can't be verified against an app hash", snapshot.Height)
+	}
+	return nil
 }
 
 func (rs *Store) loadCommitStoreFromParams(key types.StoreKey, id types.CommitID, params storeParams) (types.CommitKVStore, error) {
 	var db dbm.DB
 
+	prefix := rs.storePrefix(params.key, params)
 	if params.db != nil {
-		db = dbm.NewPrefixDB(params.db, []byte("s/_/"))
+		db = dbm.NewPrefixDB(params.db, prefix)
 	} else {
-		prefix := "s/k:" + params.key.Name() + "/"
-		db = dbm.NewPrefixDB(rs.db, []byte(prefix))
+		db = dbm.NewPrefixDB(rs.db, prefix)
 	}
 
 	switch params.typ {
@@ -828,14 +4361,22 @@ func (rs *Store) loadCommitStoreFromParams(key types.StoreKey, id types.CommitID
 		var store types.CommitKVStore
 		var err error
 
+		lazyLoading := rs.lazyLoading
+		if params.lazyLoading != nil {
+			lazyLoading = *params.lazyLoading
+		}
+
 		if params.initialVersion == 0 {
-			store, err = iavl.LoadStore(db, id, rs.lazyLoading)
+			store, err = iavl.LoadStore(db, id, lazyLoading)
 		} else {
-			store, err = iavl.LoadStoreWithInitialVersion(db, id, rs.lazyLoading, params.initialVersion)
+			store, err = iavl.LoadStoreWithInitialVersion(db, id, lazyLoading, params.initialVersion)
 		}
 
 		if err != nil {
-			return nil, err
+			// name the commit ID and DB location, as a single store with a stale or
+			// corrupt commit ID is otherwise hard to pin down among many
+			return nil, errors.Wrapf(err, "failed to load IAVL version %d with hash %X under DB prefix %q",
+				id.Version, id.Hash, prefix)
 		}
 
 		if rs.interBlockCache != nil {
@@ -873,12 +4414,13 @@ func (rs *Store) loadCommitStoreFromParams(key types.StoreKey, id types.CommitID
 func (rs *Store) buildCommitInfo(version int64) *types.CommitInfo {
 	storeInfos := []types.StoreInfo{}
 	for key, store := range rs.stores {
-		if store.GetStoreType() == types.StoreTypeTransient {
+		if !rs.includeInCommitHash(key, store.GetStoreType()) {
 			continue
 		}
 		storeInfos = append(storeInfos, types.StoreInfo{
-			Name:     key.Name(),
-			CommitId: store.LastCommitID(),
+			Name:      key.Name(),
+			CommitId:  store.LastCommitID(),
+			StoreType: store.GetStoreType(),
 		})
 	}
 	return &types.CommitInfo{
@@ -892,50 +4434,193 @@ type storeParams struct {
 	db             dbm.DB
 	typ            types.StoreType
 	initialVersion uint64
+	pruning        *types.PruningOptions
+	lazyLoading    *bool
+
+	// excludeFromHash excludes the store from the commit info, see
+	// ExcludeFromCommitHash
+	excludeFromHash bool
 }
 
-func getLatestVersion(db dbm.DB) int64 {
+func getLatestVersion(db dbm.DB) (int64, error) {
 	bz, err := db.Get([]byte(latestVersionKey))
 	if err != nil {
-		panic(err)
+		return 0, errors.Wrap(err, "failed to get latest version")
 	} else if bz == nil {
-		return 0
+		return 0, nil
 	}
 
 	var latestVersion int64
 
 	if err := gogotypes.StdInt64Unmarshal(&latestVersion, bz); err != nil {
-		panic(err)
+		return 0, errors.Wrap(err, "failed to unmarshal latest version")
 	}
 
-	return latestVersion
+	return latestVersion, nil
 }
 
-// Commits each store and returns a new commitInfo.
-func commitStores(version int64, storeMap map[types.StoreKey]types.CommitKVStore) *types.CommitInfo {
-	storeInfos := make([]types.StoreInfo, 0, len(storeMap))
+// Commits each store and returns a new commitInfo. Stores are committed
+// concurrently by at most workers goroutines; if workers is not positive,
+// GOMAXPROCS is used. The resulting StoreInfos are sorted by name so the output
+// is deterministic regardless of scheduling. A panic raised while committing
+// any store is re-raised on the calling goroutine once all workers are done.
+func commitStores(
+	version int64, storeMap map[types.StoreKey]types.CommitKVStore, workers int, metrics StoreMetrics,
+	includeInHash func(types.StoreKey, types.StoreType) bool,
+) *types.CommitInfo {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(storeMap) {
+		workers = len(storeMap)
+	}
+
+	type commitResult struct {
+		key       types.StoreKey
+		name      string
+		commitID  types.CommitID
+		storeType types.StoreType
+		duration  time.Duration
+	}
+
+	var (
+		wg         sync.WaitGroup
+		mtx        sync.Mutex
+		panicked   interface{}
+		panicStore string
+	)
+
+	keys := make(chan types.StoreKey)
+	results := make(chan commitResult, len(storeMap))
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							mtx.Lock()
+							if panicked == nil {
+								panicked, panicStore = r, key.Name()
+							}
+							mtx.Unlock()
+						}
+					}()
+
+					store := storeMap[key]
+					start := time.Now()
+					commitID := store.Commit()
+					results <- commitResult{
+						key:       key,
+						name:      key.Name(),
+						commitID:  commitID,
+						storeType: store.GetStoreType(),
+						duration:  time.Since(start),
+					}
+				}()
+			}
+		}()
+	}
+
+	for key := range storeMap {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+	close(results)
+
+	if panicked != nil {
+		panic(fmt.Errorf("failed to commit store %s: %v", panicStore, panicked))
+	}
 
-	for key, store := range storeMap {
-		commitID := store.Commit()
+	storeInfos := make([]types.StoreInfo, 0, len(storeMap))
+	for res := range results {
+		metrics.StoreCommitted(res.name, res.commitID.Version, res.duration)
 
-		if store.GetStoreType() == types.StoreTypeTransient {
+		if !includeInHash(res.key, res.storeType) {
 			continue
 		}
 
 		si := types.StoreInfo{}
-		si.Name = key.Name()
-		si.CommitId = commitID
+		si.Name = res.name
+		si.CommitId = res.commitID
+		si.StoreType = res.storeType
 		storeInfos = append(storeInfos, si)
 	}
 
+	sort.Slice(storeInfos, func(i, j int) bool {
+		return storeInfos[i].Name < storeInfos[j].Name
+	})
+
 	return &types.CommitInfo{
 		Version:    version,
 		StoreInfos: storeInfos,
 	}
 }
 
+// getCommitInfoVersions returns the versions of all commit infos persisted in
+// the DB, in no particular order.
+func getCommitInfoVersions(db dbm.DB) ([]int64, error) {
+	// commit info keys are s/<version>, so restrict the range to keys that start
+	// with a digit to avoid iterating over store data under s/k:<name>/.
+	itr, err := db.Iterator([]byte(fmt.Sprintf(commitInfoKeyFmt, 0)), []byte("s/:"))
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	versions := []int64{}
+	for ; itr.Valid(); itr.Next() {
+		version, err := strconv.ParseInt(strings.TrimPrefix(string(itr.Key()), "s/"), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, itr.Error()
+}
+
+// checkLatestCommitInfo returns a descriptive error if the latest version
+// recorded in the DB has no commit info persisted for it, which may happen when
+// a node crashed or its DB was modified out of band. The error names the highest
+// version that can still be loaded, if any.
+func checkLatestCommitInfo(db dbm.DB, latest int64) error {
+	if latest == 0 {
+		return nil
+	}
+
+	ok, err := db.Has([]byte(fmt.Sprintf(commitInfoKeyFmt, latest)))
+	if err != nil {
+		return errors.Wrap(err, "failed to get commit info")
+	} else if ok {
+		return nil
+	}
+
+	versions, err := getCommitInfoVersions(db)
+	if err != nil {
+		return err
+	}
+
+	var recoverable int64
+	for _, version := range versions {
+		if version < latest && version > recoverable {
+			recoverable = version
+		}
+	}
+	if recoverable == 0 {
+		return fmt.Errorf("latest version %d has no commit info and no earlier commit info exists", latest)
+	}
+
+	return fmt.Errorf(
+		"latest version %d has no commit info; the highest version with commit info is %d, "+
+			"which can be loaded with LoadVersion or RollbackToVersion to recover", latest, recoverable)
+}
+
 // Gets commitInfo from disk.
-func getCommitInfo(db dbm.DB, ver int64) (*types.CommitInfo, error) {
+func getCommitInfo(db dbm.DB, codec CommitInfoCodec, ver int64) (*types.CommitInfo, error) {
 	cInfoKey := fmt.Sprintf(commitInfoKeyFmt, ver)
 
 	bz, err := db.Get([]byte(cInfoKey))
@@ -945,16 +4630,22 @@ func getCommitInfo(db dbm.DB, ver int64) (*types.CommitInfo, error) {
 		return nil, errors.New("no commit info found")
 	}
 
+	// A row that is present but can't be decoded, e.g. one truncated by a
+	// crash, is reported as ErrCorruptCommitInfo rather than as missing, as the
+	// version was committed and may have to be rolled back.
+	if len(bz) == 0 {
+		return nil, sdkerrors.Wrapf(types.ErrCorruptCommitInfo, "version %d: empty row", ver)
+	}
 	cInfo := &types.CommitInfo{}
-	if err = cInfo.Unmarshal(bz); err != nil {
-		return nil, errors.Wrap(err, "failed unmarshal commit info")
+	if err = codec.Unmarshal(bz, cInfo); err != nil {
+		return nil, sdkerrors.Wrapf(types.ErrCorruptCommitInfo, "version %d (%d bytes): %v", ver, len(bz), err)
 	}
 
 	return cInfo, nil
 }
 
-func setCommitInfo(batch dbm.Batch, version int64, cInfo *types.CommitInfo) {
-	bz, err := cInfo.Marshal()
+func setCommitInfo(batch dbm.Batch, codec CommitInfoCodec, version int64, cInfo *types.CommitInfo) {
+	bz, err := codec.Marshal(cInfo)
 	if err != nil {
 		panic(err)
 	}
@@ -963,6 +4654,27 @@ func setCommitInfo(batch dbm.Batch, version int64, cInfo *types.CommitInfo) {
 	batch.Set([]byte(cInfoKey), bz)
 }
 
+// deleteCommitInfos removes the commit info persisted for the given versions.
+func deleteCommitInfos(db dbm.DB, versions []int64) {
+	if len(versions) == 0 {
+		return
+	}
+
+	batch := db.NewBatch()
+	defer batch.Close()
+
+	for _, version := range versions {
+		cInfoKey := fmt.Sprintf(commitInfoKeyFmt, version)
+		if err := batch.Delete([]byte(cInfoKey)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := batch.Write(); err != nil {
+		panic(fmt.Errorf("error on batch write %w", err))
+	}
+}
+
 func setLatestVersion(batch dbm.Batch, version int64) {
 	bz, err := gogotypes.StdInt64Marshal(version)
 	if err != nil {
@@ -1003,15 +4715,23 @@ func getPruningHeights(db dbm.DB) ([]int64, error) {
 	return prunedHeights, nil
 }
 
-func flushMetadata(db dbm.DB, version int64, cInfo *types.CommitInfo, pruneHeights []int64) {
+func flushMetadata(
+	db dbm.DB, codec CommitInfoCodec, version int64, cInfo *types.CommitInfo, pruneHeights []int64, sync bool,
+) {
 	batch := db.NewBatch()
 	defer batch.Close()
 
-	setCommitInfo(batch, version, cInfo)
+	setCommitInfoCodec(batch, codec)
+	setCommitInfo(batch, codec, version, cInfo)
 	setLatestVersion(batch, version)
 	setPruningHeights(batch, pruneHeights)
 
-	if err := batch.Write(); err != nil {
+	write := batch.Write
+	if sync {
+		write = batch.WriteSync
+	}
+
+	if err := write(); err != nil {
 		panic(fmt.Errorf("error on batch write %w", err))
 	}
 }
@@ -1,26 +1,41 @@
 package rootmulti
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	iavltree "github.com/cosmos/iavl"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/libs/log"
 	dbm "github.com/tendermint/tm-db"
 
+	"github.com/cosmos/cosmos-sdk/snapshots"
 	snapshottypes "github.com/cosmos/cosmos-sdk/snapshots/types"
+	"github.com/cosmos/cosmos-sdk/store/cache"
+	"github.com/cosmos/cosmos-sdk/store/dbadapter"
 	"github.com/cosmos/cosmos-sdk/store/iavl"
 	sdkmaps "github.com/cosmos/cosmos-sdk/store/internal/maps"
 	"github.com/cosmos/cosmos-sdk/store/types"
 	sdkerrors "github.com/cosmos/cosmos-sdk/types/errors"
+	"github.com/cosmos/cosmos-sdk/types/kv"
+	"github.com/cosmos/cosmos-sdk/types/query"
 )
 
 func TestStoreType(t *testing.T) {
@@ -46,6 +61,36 @@ func TestGetCommitKVStore(t *testing.T) {
 	require.IsType(t, &iavl.Store{}, store2)
 }
 
+func TestNewStoreWithOptions(t *testing.T) {
+	require.Equal(t, NewStore(dbm.NewMemDB()).GetPruning(), NewStoreWithOptions(dbm.NewMemDB(), DefaultOptions()).GetPruning())
+
+	db := dbm.NewMemDB()
+	opts := DefaultOptions()
+	opts.Pruning = types.PruneEverything
+	opts.InitialVersion = 5
+	opts.CommitInfoCodec = jsonCommitInfoCodec{}
+	store := NewStoreWithOptions(db, opts)
+	key := types.NewKVStoreKey("store1")
+	store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, types.PruneEverything, store.GetPruning())
+	require.Equal(t, int64(5), store.Commit().Version)
+
+	opts = DefaultOptions()
+	opts.ReadOnly = true
+	store = NewStoreWithOptions(db, opts)
+	store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	require.Error(t, store.LoadLatestVersion(), "the commit info codec must be configured")
+
+	opts.CommitInfoCodec = jsonCommitInfoCodec{}
+	store = NewStoreWithOptions(db, opts)
+	store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	require.NoError(t, store.LoadLatestVersion())
+	require.True(t, store.IsReadOnly())
+	require.Equal(t, int64(5), store.LastCommitID().Version)
+	require.Panics(t, func() { store.Commit() })
+}
+
 func TestStoreMount(t *testing.T) {
 	db := dbm.NewMemDB()
 	store := NewStore(db)
@@ -62,6 +107,20 @@ func TestStoreMount(t *testing.T) {
 	require.Panics(t, func() { store.MountStoreWithDB(dup1, types.StoreTypeIAVL, db) })
 }
 
+func TestStoreMountErr(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db)
+
+	key1 := types.NewKVStoreKey("store1")
+	dup1 := types.NewKVStoreKey("store1")
+
+	require.NoError(t, store.MountStoreWithDBErr(key1, types.StoreTypeIAVL, db))
+	require.EqualError(t, store.MountStoreWithDBErr(nil, types.StoreTypeIAVL, db), "MountIAVLStore() key cannot be nil")
+	require.Error(t, store.MountStoreWithDBErr(key1, types.StoreTypeIAVL, db))
+	require.Error(t, store.MountStoreWithDBErr(dup1, types.StoreTypeIAVL, db))
+	require.Len(t, store.storesParams, 1)
+}
+
 func TestCacheMultiStoreWithVersion(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	ms := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -79,9 +138,9 @@ func TestCacheMultiStoreWithVersion(t *testing.T) {
 	cID := ms.Commit()
 	require.Equal(t, int64(1), cID.Version)
 
-	// require no failure when given an invalid or pruned version
+	// require a typed failure when given a version that was never committed
 	_, err = ms.CacheMultiStoreWithVersion(cID.Version + 1)
-	require.NoError(t, err)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
 
 	// require a valid version can be cache-loaded
 	cms, err := ms.CacheMultiStoreWithVersion(cID.Version)
@@ -99,6 +158,56 @@ func TestCacheMultiStoreWithVersion(t *testing.T) {
 	})
 }
 
+func TestCacheMultiStoreWithVersion_ImmutableCache(t *testing.T) {
+	ms := newMultiStoreWithMounts(dbm.NewMemDB(), types.NewPruningOptions(2, 0, 1))
+	ms.SetImmutableCacheSize(2)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	key := ms.keysByName["store1"]
+	for i := byte(1); i <= 3; i++ {
+		ms.GetKVStore(key).Set([]byte("key"), []byte{i})
+		ms.Commit()
+	}
+
+	// repeated calls share the immutable stores, but not the cache layered on top
+	cms1, err := ms.CacheMultiStoreWithVersion(3)
+	require.NoError(t, err)
+	cached, _ := ms.immutableCache.get(3)
+	require.NotNil(t, cached)
+	cms2, err := ms.CacheMultiStoreWithVersion(3)
+	require.NoError(t, err)
+	again, _ := ms.immutableCache.get(3)
+	require.Equal(t, fmt.Sprintf("%p", cached), fmt.Sprintf("%p", again))
+	cms1.GetKVStore(key).Set([]byte("key"), []byte{42})
+	require.Equal(t, []byte{3}, cms2.GetKVStore(key).Get([]byte("key")))
+
+	// the least recently used version is evicted
+	for _, version := range []int64{2, 1} {
+		_, err = ms.CacheMultiStoreWithVersion(version)
+		require.NoError(t, err)
+	}
+	require.Len(t, ms.immutableCache.versions, 2)
+	cached, _ = ms.immutableCache.get(3)
+	require.Nil(t, cached)
+
+	// pruned versions are evicted
+	ms.GetKVStore(key).Set([]byte("key"), []byte{4})
+	ms.Commit()
+	require.False(t, ms.GetCommitKVStore(key).(*iavl.Store).VersionExists(1))
+	cached, _ = ms.immutableCache.get(1)
+	require.Nil(t, cached)
+	cached, _ = ms.immutableCache.get(2)
+	require.NotNil(t, cached)
+
+	// reloading drops all versions
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Empty(t, ms.immutableCache.versions)
+
+	cms, err := ms.CacheMultiStoreWithVersion(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, cms.GetKVStore(key).Get([]byte("key")))
+}
+
 func TestHashStableWithEmptyCommit(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	ms := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -123,6 +232,52 @@ func TestHashStableWithEmptyCommit(t *testing.T) {
 	require.Equal(t, hash, cID.Hash)
 }
 
+func TestCommitStoresConcurrent(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	serial := newMultiStoreWithMounts(db, types.PruneNothing)
+	serial.SetCommitWorkers(1)
+	require.NoError(t, serial.LoadLatestVersion())
+
+	parallel := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	parallel.SetCommitWorkers(8)
+	require.NoError(t, parallel.LoadLatestVersion())
+
+	for _, ms := range []*Store{serial, parallel} {
+		for i, name := range []string{"store1", "store2", "store3"} {
+			ms.getStoreByName(name).(types.KVStore).Set([]byte(name), []byte{byte(i)})
+		}
+	}
+
+	serialID := serial.Commit()
+	parallelID := parallel.Commit()
+	require.Equal(t, serialID, parallelID)
+
+	names := []string{}
+	for _, si := range parallel.lastCommitInfo.StoreInfos {
+		names = append(names, si.Name)
+	}
+	require.Equal(t, []string{"store1", "store2", "store3"}, names)
+}
+
+type panicCommitStore struct {
+	types.CommitKVStore
+}
+
+func (panicCommitStore) Commit() types.CommitID { panic("commit failed") }
+
+func TestCommitStoresPanic(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+
+	key := ms.keysByName["store2"]
+	ms.stores[key] = panicCommitStore{ms.stores[key]}
+
+	require.PanicsWithError(t, "failed to commit store store2: commit failed", func() {
+		ms.Commit()
+	})
+}
+
 func TestMultistoreCommitLoad(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	store := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -170,6 +325,201 @@ func TestMultistoreCommitLoad(t *testing.T) {
 	checkStore(t, store, commitID, commitID)
 }
 
+func TestMultistoreRollbackToVersion(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	commitIDs := []types.CommitID{}
+	for i := byte(1); i <= 5; i++ {
+		store.getStoreByName("store1").(types.KVStore).Set([]byte("key"), []byte{i})
+		commitIDs = append(commitIDs, store.Commit())
+	}
+
+	require.Error(t, store.RollbackToVersion(0))
+	require.True(t, errors.Is(store.RollbackToVersion(6), types.ErrVersionDoesNotExist))
+
+	require.NoError(t, store.RollbackToVersion(3))
+	checkStore(t, store, commitIDs[2], store.LastCommitID())
+	require.Equal(t, []byte{3}, store.getStoreByName("store1").(types.KVStore).Get([]byte("key")))
+
+	for v := int64(4); v <= 5; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.Error(t, err)
+	}
+
+	// re-committing different data at a rolled back height must succeed
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("key"), []byte{42})
+	commitID := store.Commit()
+	require.Equal(t, int64(4), commitID.Version)
+	require.NotEqual(t, commitIDs[3].Hash, commitID.Hash)
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+}
+
+func TestMultistoreReset(t *testing.T) {
+	db, ownDB := dbm.NewMemDB(), dbm.NewMemDB()
+	newStore := func(db dbm.DB) *Store {
+		store := newMultiStoreWithMounts(db, types.PruneNothing)
+		store.MountStoreWithDB(types.NewKVStoreKey("own"), types.StoreTypeIAVL, ownDB)
+		store.MountStoreWithDB(types.NewKVStoreKey("plain"), types.StoreTypeDB, nil)
+		require.NoError(t, store.LoadLatestVersion())
+		return store
+	}
+	write := func(store *Store, value byte) types.CommitID {
+		for _, name := range []string{"store1", "own", "plain"} {
+			store.getStoreByName(name).(types.KVStore).Set([]byte("key"), []byte{value})
+		}
+		return store.Commit()
+	}
+
+	store := newStore(db)
+	for i := byte(1); i <= 3; i++ {
+		write(store, i)
+	}
+
+	require.NoError(t, store.Reset())
+	require.Equal(t, types.CommitID{}, store.LastCommitID())
+	for _, name := range []string{"store1", "own", "plain"} {
+		require.Nil(t, store.getStoreByName(name).(types.KVStore).Get([]byte("key")), name)
+	}
+	versions, err := getCommitInfoVersions(db)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	// the store commits as if it had just been set up
+	ownDB = dbm.NewMemDB()
+	expected := write(newStore(dbm.NewMemDB()), 42)
+	require.Equal(t, expected, write(store, 42))
+}
+
+func TestMultistoreHasVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.NewPruningOptions(1, 0, 1))
+	require.NoError(t, store.LoadLatestVersion())
+	for i := 0; i < 4; i++ {
+		store.Commit()
+	}
+
+	// a fresh store can probe versions before loading any
+	probe := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.True(t, probe.HasVersion(0))
+	require.False(t, probe.HasVersion(-1))
+	require.False(t, probe.HasVersion(1))
+	require.True(t, probe.HasVersion(4))
+	require.False(t, probe.HasVersion(5))
+	require.Error(t, probe.LoadVersion(1))
+	require.NoError(t, probe.LoadVersion(4))
+
+	require.NoError(t, probe.Close())
+	require.False(t, probe.HasVersion(4))
+}
+
+func TestMultistoreCommitIDForVersion(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB(), types.NewPruningOptions(1, 0, 1))
+	require.NoError(t, store.LoadLatestVersion())
+	commitIDs := []types.CommitID{}
+	for i := 0; i < 4; i++ {
+		store.getStoreByName("store1").(types.KVStore).Set([]byte("key"), []byte{byte(i)})
+		commitIDs = append(commitIDs, store.Commit())
+	}
+
+	for _, version := range []int64{3, 4} {
+		commitID, err := store.CommitIDForVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, commitIDs[version-1], commitID)
+	}
+
+	_, err := store.CommitIDForVersion(1)
+	require.True(t, errors.Is(err, types.ErrVersionPruned))
+	_, err = store.CommitIDForVersion(5)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+	_, err = store.CommitIDForVersion(0)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+}
+
+func TestMultistoreWarmup(t *testing.T) {
+	db := dbm.NewMemDB()
+	newMultiStoreWithMixedMountsAndBasicData(db)
+	store := newMultiStoreWithMixedMounts(db)
+	require.NoError(t, store.LoadLatestVersion())
+
+	require.NoError(t, store.Warmup())
+	require.NoError(t, store.Warmup(store.keysByName["iavl1"], store.keysByName["iavl2"]))
+	require.Equal(t, []byte{2}, store.GetKVStore(store.keysByName["iavl1"]).Get([]byte("b")))
+
+	err := store.Warmup(store.keysByName["trans1"])
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	err = store.Warmup(types.NewKVStoreKey("unmounted"))
+	require.True(t, errors.Is(err, sdkerrors.ErrUnknownRequest))
+}
+
+func TestMultistoreUnmountedStores(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Empty(t, store.UnmountedStores())
+	store.Commit()
+
+	newStore := func() *Store {
+		store := NewStore(db)
+		store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, nil)
+		return store
+	}
+
+	store = newStore()
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, []string{"store2", "store3"}, store.UnmountedStores())
+
+	store = newStore()
+	store.SetRejectUnmountedStores(true)
+	err := store.LoadLatestVersion()
+	require.EqualError(t, err,
+		"stores store2, store3 are persisted at version 1 but not mounted; mount them or delete them with a store upgrade")
+
+	// stores declared deleted or renamed by an upgrade are not reported
+	store = newStore()
+	store.SetRejectUnmountedStores(true)
+	store.MountStoreWithDB(types.NewKVStoreKey("renamed3"), types.StoreTypeIAVL, nil)
+	upgrades := &types.StoreUpgrades{
+		Deleted: []string{"store2"},
+		Renamed: []types.StoreRename{{OldKey: "store3", NewKey: "renamed3"}},
+	}
+	require.NoError(t, store.LoadLatestVersionAndUpgrade(upgrades))
+	require.Empty(t, store.UnmountedStores())
+}
+
+func TestMultistoreLogger(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
+	store.Commit()
+
+	buf := &bytes.Buffer{}
+	store = NewStore(db)
+	store.SetLogger(log.NewTMLogger(buf))
+	store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("renamed3"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("store4"), types.StoreTypeIAVL, nil)
+	upgrades := &types.StoreUpgrades{
+		Added:   []string{"store4"},
+		Renamed: []types.StoreRename{{OldKey: "store3", NewKey: "renamed3"}},
+	}
+	require.NoError(t, store.LoadLatestVersionAndUpgrade(upgrades))
+	require.Regexp(t, `store is persisted but not mounted +module=rootmulti store=store2 version=2`, buf.String())
+	require.Regexp(t, `adding store +module=rootmulti store=store4 version=3`, buf.String())
+	require.Regexp(t, `renaming store +module=rootmulti from=store3 to=renamed3`, buf.String())
+
+	buf.Reset()
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetLogger(log.NewTMLogger(buf))
+	require.NoError(t, store.RollbackToVersion(1))
+	require.Regexp(t, `rolled back +module=rootmulti from=2 to=1`, buf.String())
+}
+
 func TestMultistoreLoadWithUpgrade(t *testing.T) {
 	var db dbm.DB = dbm.NewMemDB()
 	store := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -200,7 +550,7 @@ func TestMultistoreLoadWithUpgrade(t *testing.T) {
 	expectedCommitID := getExpectedCommitID(store, 1)
 	checkStore(t, store, expectedCommitID, commitID)
 
-	ci, err := getCommitInfo(db, 1)
+	ci, err := getCommitInfo(db, DefaultCommitInfoCodec, 1)
 	require.NoError(t, err)
 	require.Equal(t, int64(1), ci.Version)
 	require.Equal(t, 3, len(ci.StoreInfos))
@@ -284,132 +634,2044 @@ func TestMultistoreLoadWithUpgrade(t *testing.T) {
 	require.Equal(t, v4, rl4.Get(k4))
 
 	// check commitInfo in storage
-	ci, err = getCommitInfo(db, 2)
+	ci, err = getCommitInfo(db, DefaultCommitInfoCodec, 2)
 	require.NoError(t, err)
 	require.Equal(t, int64(2), ci.Version)
 	require.Equal(t, 4, len(ci.StoreInfos), ci.StoreInfos)
 	checkContains(t, ci.StoreInfos, []string{"store1", "restore2", "store3", "store4"})
 }
 
-func TestParsePath(t *testing.T) {
-	_, _, err := parsePath("foo")
-	require.Error(t, err)
-
-	store, subpath, err := parsePath("/foo")
-	require.NoError(t, err)
-	require.Equal(t, store, "foo")
-	require.Equal(t, subpath, "")
+func TestMultistoreLoadWithUpgrade_AddExisting(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
 
-	store, subpath, err = parsePath("/fizz/bang/baz")
-	require.NoError(t, err)
-	require.Equal(t, store, "fizz")
-	require.Equal(t, subpath, "/bang/baz")
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err := store.LoadLatestVersionAndUpgrade(&types.StoreUpgrades{Added: []string{"store2"}})
+	require.EqualError(t, err, "store store2 is marked as added but already exists at version 1")
+}
 
-	substore, subsubpath, err := parsePath(subpath)
-	require.NoError(t, err)
-	require.Equal(t, substore, "bang")
-	require.Equal(t, subsubpath, "/baz")
+func TestMultistoreLoadWithUpgrade_ChangeStoreType(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("store2"), types.StoreTypeDB, nil)
+	require.NoError(t, store.LoadLatestVersion())
 
-}
+	k, v := []byte("key"), []byte("value")
+	store.getStoreByName("store2").(types.KVStore).Set(k, v)
+	store.Commit()
 
-func TestMultiStoreRestart(t *testing.T) {
-	db := dbm.NewMemDB()
-	pruning := types.PruningOptions{
-		KeepRecent: 2,
-		KeepEvery:  3,
-		Interval:   1,
+	oldType := types.StoreTypeDB
+	upgrades := &types.StoreUpgrades{
+		Renamed: []types.StoreRename{{
+			OldKey:       "store2",
+			NewKey:       "restore2",
+			OldStoreType: &oldType,
+		}},
+	}
+	oldStoreSize := func() int {
+		itr, err := dbm.IteratePrefix(db, []byte("s/k:store2/"))
+		require.NoError(t, err)
+		defer itr.Close()
+		n := 0
+		for ; itr.Valid(); itr.Next() {
+			n++
+		}
+		return n
 	}
-	multi := newMultiStoreWithMounts(db, pruning)
-	err := multi.LoadLatestVersion()
-	require.Nil(t, err)
 
-	initCid := multi.LastCommitID()
+	// the old DB-backed store is kept until the copy is committed, so that
+	// loading again, e.g. after a crash, repeats the rename
+	for i := 0; i < 2; i++ {
+		store = NewStore(db)
+		store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(types.NewKVStoreKey("restore2"), types.StoreTypeIAVL, nil)
+		require.NoError(t, store.LoadLatestVersionAndUpgrade(upgrades))
+
+		rs2 := store.getStoreByName("restore2")
+		require.IsType(t, &iavl.Store{}, rs2)
+		require.Equal(t, v, rs2.(types.KVStore).Get(k))
+		require.Equal(t, 1, oldStoreSize())
+	}
 
-	k, v := "wind", "blows"
-	k2, v2 := "water", "flows"
-	k3, v3 := "fire", "burns"
+	commitID := store.Commit()
+	require.Zero(t, oldStoreSize())
+	store = NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("restore2"), types.StoreTypeIAVL, nil)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, commitID, store.LastCommitID())
+	require.Equal(t, v, store.getStoreByName("restore2").(types.KVStore).Get(k))
+}
 
-	for i := 1; i < 3; i++ {
-		// Set and commit data in one store.
-		store1 := multi.getStoreByName("store1").(types.KVStore)
-		store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, i)))
+func TestMoveKVStoreDataInBatches(t *testing.T) {
+	defer func(size int) { storeMigrationBatchSize = size }(storeMigrationBatchSize)
+	storeMigrationBatchSize = 3
+
+	for _, typ := range []types.StoreType{types.StoreTypeIAVL, types.StoreTypeDB} {
+		db := dbm.NewMemDB()
+		store := NewStore(db)
+		oldKey, newKey := types.NewKVStoreKey("old"), types.NewKVStoreKey("new")
+		store.MountStoreWithDB(oldKey, typ, nil)
+		store.MountStoreWithDB(newKey, typ, nil)
+		require.NoError(t, store.LoadLatestVersion())
+
+		oldStore := store.GetKVStore(oldKey)
+		for i := byte(0); i < 10; i++ {
+			oldStore.Set([]byte{i}, []byte{i})
+		}
+		store.Commit()
 
-		// ... and another.
-		store2 := multi.getStoreByName("store2").(types.KVStore)
-		store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, i)))
+		newStore := store.GetKVStore(newKey)
+		require.NoError(t, moveKVStoreData(oldStore, newStore), typ)
+		store.Commit()
 
-		// ... and another.
-		store3 := multi.getStoreByName("store3").(types.KVStore)
-		store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, i)))
+		for i := byte(0); i < 10; i++ {
+			require.Equal(t, []byte{i}, newStore.Get([]byte{i}), typ)
+			require.Nil(t, oldStore.Get([]byte{i}), typ)
+		}
+	}
+}
 
-		multi.Commit()
+func TestMultistoreCommitAfterFailedUpgrade(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
 
-		cinfo, err := getCommitInfo(multi.db, int64(i))
-		require.NoError(t, err)
-		require.Equal(t, int64(i), cinfo.Version)
-	}
+	// a failed load that didn't touch any data can still be committed
+	require.Error(t, store.LoadVersion(99))
+	require.NotPanics(t, func() { store.Commit() })
 
-	// Set and commit data in one store.
-	store1 := multi.getStoreByName("store1").(types.KVStore)
-	store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, 3)))
+	// mount a DB store whose deletes fail and delete it in an upgrade
+	memDB := dbm.NewMemDB()
+	dbKey := types.NewKVStoreKey("store4")
 
-	// ... and another.
-	store2 := multi.getStoreByName("store2").(types.KVStore)
-	store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, 3)))
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.MountStoreWithDB(dbKey, types.StoreTypeDB, memDB)
+	require.NoError(t, store.LoadLatestVersion())
+	store.GetKVStore(dbKey).Set([]byte("key"), []byte("value"))
+	store.Commit()
 
-	multi.Commit()
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.MountStoreWithDB(dbKey, types.StoreTypeDB, failingBatchDB{memDB})
+	err := store.LoadLatestVersionAndUpgrade(&types.StoreUpgrades{Deleted: []string{"store4"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to delete store store4")
+	require.Panics(t, func() { store.Commit() })
+	require.Equal(t, []byte("value"), dbadapter.Store{DB: dbm.NewPrefixDB(memDB, []byte("s/_/"))}.Get([]byte("key")))
 
-	flushedCinfo, err := getCommitInfo(multi.db, 3)
-	require.Nil(t, err)
-	require.NotEqual(t, initCid, flushedCinfo, "CID is different after flush to disk")
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.MountStoreWithDB(dbKey, types.StoreTypeDB, memDB)
+	require.NoError(t, store.LoadLatestVersion())
+	require.NotPanics(t, func() { store.Commit() })
+}
 
-	// ... and another.
-	store3 := multi.getStoreByName("store3").(types.KVStore)
-	store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, 3)))
+type failingBatchDB struct {
+	dbm.DB
+}
 
-	multi.Commit()
+func (db failingBatchDB) NewBatch() dbm.Batch {
+	return failingBatch{db.DB.NewBatch()}
+}
 
-	postFlushCinfo, err := getCommitInfo(multi.db, 4)
-	require.NoError(t, err)
-	require.Equal(t, int64(4), postFlushCinfo.Version, "Commit changed after in-memory commit")
+type failingBatch struct {
+	dbm.Batch
+}
 
-	multi = newMultiStoreWithMounts(db, pruning)
-	err = multi.LoadLatestVersion()
-	require.Nil(t, err)
+func (b failingBatch) Write() error {
+	return errors.New("disk failure")
+}
 
-	reloadedCid := multi.LastCommitID()
-	require.Equal(t, int64(4), reloadedCid.Version, "Reloaded CID is not the same as last flushed CID")
+func TestDeleteKVStore_DBAdapter(t *testing.T) {
+	defer func(size int) { storeMigrationBatchSize = size }(storeMigrationBatchSize)
+	storeMigrationBatchSize = 2
 
-	// Check that store1 and store2 retained date from 3rd commit
-	store1 = multi.getStoreByName("store1").(types.KVStore)
-	val := store1.Get([]byte(k))
-	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v, 3)), val, "Reloaded value not the same as last flushed value")
+	db := dbm.NewMemDB()
+	kv := commitDBStoreAdapter{Store: dbadapter.Store{DB: db}}
+	for i := byte(0); i < 5; i++ {
+		kv.Set([]byte{i}, []byte{i})
+	}
 
-	store2 = multi.getStoreByName("store2").(types.KVStore)
-	val2 := store2.Get([]byte(k2))
-	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v2, 3)), val2, "Reloaded value not the same as last flushed value")
+	// a failed delete leaves all data in place
+	require.Error(t, deleteKVStore(commitDBStoreAdapter{Store: dbadapter.Store{DB: failingBatchDB{db}}}))
+	for i := byte(0); i < 5; i++ {
+		require.Equal(t, []byte{i}, kv.Get([]byte{i}))
+	}
 
-	// Check that store3 still has data from last commit even though update happened on 2nd commit
-	store3 = multi.getStoreByName("store3").(types.KVStore)
-	val3 := store3.Get([]byte(k3))
-	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v3, 3)), val3, "Reloaded value not the same as last flushed value")
+	require.NoError(t, deleteKVStore(kv))
+	itr := kv.Iterator(nil, nil)
+	require.False(t, itr.Valid())
+	require.NoError(t, itr.Close())
 }
 
-func TestMultiStoreQuery(t *testing.T) {
-	db := dbm.NewMemDB()
-	multi := newMultiStoreWithMounts(db, types.PruneNothing)
-	err := multi.LoadLatestVersion()
-	require.Nil(t, err)
-
+func TestMultistoreReadOnly(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
 	k, v := []byte("wind"), []byte("blows")
-	k2, v2 := []byte("water"), []byte("flows")
-	// v3 := []byte("is cold")
+	store.getStoreByName("store1").(types.KVStore).Set(k, v)
+	cID := store.Commit()
 
-	cid := multi.Commit()
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetReadOnly(true)
+	require.True(t, store.IsReadOnly())
+	require.True(t, errors.Is(store.LoadLatestVersionAndUpgrade(&types.StoreUpgrades{}), types.ErrReadOnly))
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cID, store.LastCommitID())
+
+	key := store.keysByName["store1"]
+	kv := store.GetKVStore(key)
+	require.Equal(t, v, kv.Get(k))
+	require.Panics(t, func() { kv.Set(k, []byte("new")) })
+	require.Panics(t, func() { kv.Delete(k) })
+
+	cms := store.CacheMultiStore()
+	cms.GetKVStore(key).Set(k, []byte("new"))
+	require.Panics(t, func() { cms.Write() })
+
+	require.Panics(t, func() { store.Commit() })
+	require.True(t, errors.Is(store.MountStoreWithDBErr(types.NewKVStoreKey("store4"), types.StoreTypeIAVL, nil), types.ErrReadOnly))
+	require.True(t, errors.Is(store.RollbackToVersion(1), types.ErrReadOnly))
+
+	res := store.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: cID.Version})
+	require.EqualValues(t, 0, res.Code)
+	require.Equal(t, v, res.Value)
+
+	cms, err := store.CacheMultiStoreWithVersion(cID.Version)
+	require.NoError(t, err)
+	require.Equal(t, v, cms.GetKVStore(key).Get(k))
+}
 
-	// Make sure we can get by name.
-	garbage := multi.getStoreByName("bad-name")
-	require.Nil(t, garbage)
+func TestGetVersionedMultiStore(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	k, v1, v2 := []byte("wind"), []byte("blows"), []byte("howls")
+	store1 := store.getStoreByName("store1").(types.KVStore)
+	store1.Set(k, v1)
+	cID1 := store.Commit()
+	store1.Set(k, v2)
+	cID2 := store.Commit()
+
+	_, err := store.GetVersionedMultiStore(cID2.Version + 1)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+
+	versioned, err := store.GetVersionedMultiStore(cID1.Version)
+	require.NoError(t, err)
+	require.Equal(t, cID1, versioned.LastCommitID())
+
+	key := store.keysByName["store1"]
+	require.Equal(t, v1, versioned.GetKVStore(key).Get(k))
+	require.Panics(t, func() { versioned.GetKVStore(key).Set(k, v2) })
+	require.Panics(t, func() { versioned.Commit() })
+
+	res := versioned.(types.Queryable).Query(abci.RequestQuery{Path: "/store1/key", Data: k, Prove: true})
+	require.EqualValues(t, 0, res.Code, res.Log)
+	require.Equal(t, cID1.Version, res.Height)
+	require.Equal(t, v1, res.Value)
+	require.NotNil(t, res.ProofOps)
+
+	prt := DefaultProofRuntime()
+	require.NoError(t, prt.VerifyValue(res.ProofOps, cID1.Hash, "/store1/wind", v1))
+	require.Error(t, prt.VerifyValue(res.ProofOps, cID2.Hash, "/store1/wind", v1))
+
+	// the original store is untouched
+	require.Equal(t, cID2, store.LastCommitID())
+	require.Equal(t, v2, store1.Get(k))
+}
+
+func TestMultistoreLoadStoreTypeMismatch(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	cID := store.Commit()
+
+	cInfo, err := getCommitInfo(db, DefaultCommitInfoCodec, cID.Version)
+	require.NoError(t, err)
+	for _, si := range cInfo.StoreInfos {
+		require.Equal(t, types.StoreTypeIAVL, si.StoreType)
+	}
+
+	// mounting a committed store with another type is rejected
+	store = NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeDB, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("store2"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("store3"), types.StoreTypeIAVL, nil)
+	err = store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "store store1 is mounted as StoreTypeDB but was committed as StoreTypeIAVL")
+
+	// commit info written without store types loads with any mounted type
+	for i := range cInfo.StoreInfos {
+		cInfo.StoreInfos[i].StoreType = types.StoreTypeMulti
+	}
+	flushMetadata(db, DefaultCommitInfoCodec, cID.Version, cInfo, nil, false)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cID, store.LastCommitID())
+}
+
+func TestCommitHashCache(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("key"), []byte("value"))
+	cID := store.Commit()
+	require.Equal(t, store.lastCommitInfo.Hash(), cID.Hash)
+	require.Equal(t, cID, store.LastCommitID())
+
+	// the hash is recomputed once a new commit info is set
+	store.getStoreByName("store2").(types.KVStore).Set([]byte("key"), []byte("value"))
+	cID2 := store.Commit()
+	require.NotEqual(t, cID.Hash, cID2.Hash)
+	require.Equal(t, store.lastCommitInfo.Hash(), store.LastCommitID().Hash)
+
+	require.NoError(t, store.LoadVersion(cID.Version))
+	require.Equal(t, cID, store.LastCommitID())
+}
+
+type syncCountingDB struct {
+	dbm.DB
+	writes, syncWrites *int
+}
+
+func (db syncCountingDB) NewBatch() dbm.Batch {
+	return syncCountingBatch{db.DB.NewBatch(), db.writes, db.syncWrites}
+}
+
+type syncCountingBatch struct {
+	dbm.Batch
+	writes, syncWrites *int
+}
+
+func (b syncCountingBatch) Write() error {
+	*b.writes++
+	return b.Batch.Write()
+}
+
+func (b syncCountingBatch) WriteSync() error {
+	*b.syncWrites++
+	return b.Batch.WriteSync()
+}
+
+func TestMultistoreSyncCommits(t *testing.T) {
+	var writes, syncWrites int
+	db := syncCountingDB{dbm.NewMemDB(), &writes, &syncWrites}
+
+	// mount the stores on their own DB so only metadata writes are counted
+	store := NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("store1"), types.StoreTypeIAVL, dbm.NewMemDB())
+	require.NoError(t, store.LoadLatestVersion())
+
+	store.Commit()
+	require.Equal(t, 1, writes)
+	require.Equal(t, 0, syncWrites)
+
+	store.SetSyncCommits(true)
+	cID := store.Commit()
+	require.Equal(t, 1, writes)
+	require.Equal(t, 1, syncWrites)
+
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cID, store.LastCommitID())
+}
+
+func TestMultistoreLoadMissingLatestCommitInfo(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	cID := store.Commit()
+	store.Commit()
+
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, 2))))
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "latest version 2 has no commit info; the highest version with commit info is 1")
+
+	require.NoError(t, store.RollbackToVersion(1))
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cID, store.LastCommitID())
+
+	// without any commit info left there is nothing to recover to
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, 1))))
+	err = store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "latest version 1 has no commit info and no earlier commit info exists")
+}
+
+func TestMultistorePrunableStores(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	store.MountStoreWithDB(types.NewKVStoreKey("db1"), types.StoreTypeDB, nil)
+
+	names := []string{}
+	for _, key := range store.PrunableStores() {
+		names = append(names, key.Name())
+	}
+	require.Equal(t, []string{"iavl1", "iavl2", "iavl3"}, names)
+}
+
+func TestMultistoreQueryableStores(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	require.Equal(t, []string{"iavl1", "iavl2", "iavl3"}, store.QueryableStores())
+
+	for _, name := range store.QueryableStores() {
+		res := store.Query(abci.RequestQuery{Path: "/" + name + "/key", Data: []byte("a")})
+		require.EqualValues(t, 0, res.Code)
+	}
+
+	res := store.Query(abci.RequestQuery{Path: "/trans1/key", Data: []byte("a")})
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), res.Code)
+
+	// stores wrapped in the inter-block cache are still reported
+	cached := NewStore(dbm.NewMemDB())
+	cached.SetInterBlockCache(cache.NewCommitKVStoreCacheManager(cache.DefaultCommitKVStoreCacheSize))
+	cached.MountStoreWithDB(types.NewKVStoreKey("iavl1"), types.StoreTypeIAVL, nil)
+	require.NoError(t, cached.LoadLatestVersion())
+	require.Equal(t, []string{"iavl1"}, cached.QueryableStores())
+}
+
+func TestMultistoreDB(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMixedMountsAndBasicData(db)
+	require.Same(t, db, store.DB())
+
+	latest, err := getLatestVersion(store.DB())
+	require.NoError(t, err)
+	require.Equal(t, store.LastCommitID().Version, latest)
+}
+
+func TestMultistoreStoreKeys(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	names := []string{}
+	for _, key := range store.StoreKeys() {
+		names = append(names, key.Name())
+		require.Equal(t, store.GetCommitKVStore(key), store.GetStoreByName(key.Name()))
+	}
+	require.Equal(t, []string{"iavl1", "iavl2", "iavl3", "trans1"}, names)
+	require.Nil(t, store.GetStoreByName("unknown"))
+
+	// unloaded stores are listed, but not returned
+	partial := NewStore(dbm.NewMemDB())
+	key1, key2 := types.NewKVStoreKey("store1"), types.NewKVStoreKey("store2")
+	partial.MountStoreWithDB(key1, types.StoreTypeIAVL, nil)
+	partial.MountStoreWithDB(key2, types.StoreTypeIAVL, nil)
+	partial.SetStoresToLoad(key1)
+	require.NoError(t, partial.LoadLatestVersion())
+	require.Equal(t, []types.StoreKey{key1, key2}, partial.StoreKeys())
+	require.NotNil(t, partial.GetStoreByName("store1"))
+	require.Nil(t, partial.GetStoreByName("store2"))
+}
+
+func TestMultistoreQuerySubspace(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	kvStore := store.getStoreByName("iavl1").(types.KVStore)
+	for i := byte(1); i <= 5; i++ {
+		kvStore.Set([]byte{'p', i}, []byte{i})
+	}
+	kvStore.Set([]byte("q"), []byte{0})
+
+	// uncommitted writes are never returned
+	pairs, _, err := store.QuerySubspace("iavl1", 0, []byte("p"), nil)
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+
+	cID := store.Commit()
+	kvStore.Set([]byte{'p', 6}, []byte{6})
+	store.Commit()
+	kvStore.Set([]byte{'p', 7}, []byte{7})
+
+	pairs, page, err := store.QuerySubspace("iavl1", 0, []byte("p"), &query.PageRequest{Limit: 4})
+	require.NoError(t, err)
+	require.Len(t, pairs, 4)
+	require.Equal(t, kv.Pair{Key: []byte{'p', 1}, Value: []byte{1}}, pairs[0])
+	require.Equal(t, []byte{5}, page.NextKey)
+
+	pairs, page, err = store.QuerySubspace("iavl1", 0, []byte("p"), &query.PageRequest{Key: page.NextKey, Limit: 4})
+	require.NoError(t, err)
+	require.Equal(t, []kv.Pair{{Key: []byte{'p', 5}, Value: []byte{5}}, {Key: []byte{'p', 6}, Value: []byte{6}}}, pairs)
+	require.Nil(t, page.NextKey)
+
+	// older heights are served from a versioned view
+	pairs, _, err = store.QuerySubspace("iavl1", cID.Version, []byte("p"), &query.PageRequest{Offset: 3, Limit: 4})
+	require.NoError(t, err)
+	require.Equal(t, []kv.Pair{{Key: []byte{'p', 4}, Value: []byte{4}}, {Key: []byte{'p', 5}, Value: []byte{5}}}, pairs)
+
+	_, _, err = store.QuerySubspace("iavl4", 0, []byte("p"), nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrUnknownRequest))
+	_, _, err = store.QuerySubspace("iavl1", 3, []byte("p"), nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidHeight))
+}
+
+func TestMultistoreMaxQueryResponseSize(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	kvStore := store.getStoreByName("iavl1").(types.KVStore)
+	for i := byte(1); i <= 5; i++ {
+		kvStore.Set([]byte{'p', i}, bytes.Repeat([]byte{i}, 10))
+	}
+	store.Commit()
+
+	req := abci.RequestQuery{Path: "/iavl1/subspace", Data: []byte("p")}
+	full := store.Query(req)
+	require.EqualValues(t, 0, full.Code)
+	require.Empty(t, full.Info)
+
+	store.SetMaxQueryResponseSize(len(full.Value) - 1)
+	res := store.Query(req)
+	require.EqualValues(t, 0, res.Code)
+	require.Equal(t, TruncatedQueryInfo, res.Info)
+	require.LessOrEqual(t, len(res.Value), len(full.Value)-1)
+
+	pairs := kv.Pairs{}
+	require.NoError(t, pairs.Unmarshal(res.Value))
+	require.Len(t, pairs.Pairs, 4)
+	require.Equal(t, []byte{'p', 4}, pairs.Pairs[3].Key)
+
+	// other responses can't be cut off
+	store.SetMaxQueryResponseSize(5)
+	res = store.Query(abci.RequestQuery{Path: "/iavl1/key", Data: []byte{'p', 1}})
+	require.EqualValues(t, sdkerrors.ErrInvalidRequest.ABCICode(), res.Code)
+}
+
+func TestMultistoreSkipMultiStoreProofs(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := store.LastCommitID().Version
+	req := abci.RequestQuery{Path: "/iavl1/key", Data: []byte("a"), Prove: true}
+	res := store.Query(req)
+	require.EqualValues(t, 0, res.Code)
+	require.Len(t, res.ProofOps.Ops, 2)
+
+	store.SetSkipMultiStoreProofs(true)
+	res = store.Query(req)
+	require.EqualValues(t, 0, res.Code)
+	require.Len(t, res.ProofOps.Ops, 1)
+
+	responses, err := store.QueryKeys(0, []StoreKeyQuery{{StoreName: "iavl1", Key: []byte("a")}}, true)
+	require.NoError(t, err)
+	require.Len(t, responses[0].ProofOps.Ops, 1)
+
+	// historical queries are answered by a versioned view, which skips them too
+	store.Commit()
+	req.Height = version
+	res = store.Query(req)
+	require.EqualValues(t, 0, res.Code)
+	require.Len(t, res.ProofOps.Ops, 1)
+}
+
+func TestMultistoreConcurrentReadsDuringCommit(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	key := store.keysByName["store1"]
+	commit := func() {
+		// every version stores its own number under "key"
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, uint64(store.LastCommitID().Version+1))
+		store.GetKVStore(key).Set([]byte("key"), version)
+		store.Commit()
+	}
+	commit()
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				res := store.Query(abci.RequestQuery{Path: "/store1/key", Data: []byte("key"), Prove: true})
+				if assert.EqualValues(t, 0, res.Code, res.Log) {
+					assert.EqualValues(t, res.Height, binary.BigEndian.Uint64(res.Value))
+				}
+
+				results, err := store.QueryKeys(0, []StoreKeyQuery{{StoreName: "store1", Key: []byte("key")}}, true)
+				if assert.NoError(t, err) && assert.EqualValues(t, 0, results[0].Code, results[0].Log) {
+					assert.EqualValues(t, results[0].Height, binary.BigEndian.Uint64(results[0].Value))
+				}
+
+				version := store.LastCommitID().Version
+				cms, err := store.CacheMultiStoreWithVersion(version)
+				if assert.NoError(t, err) {
+					assert.EqualValues(t, version, binary.BigEndian.Uint64(cms.GetKVStore(key).Get([]byte("key"))))
+				}
+
+				versioned, err := store.GetVersionedMultiStore(version)
+				if assert.NoError(t, err) {
+					assert.EqualValues(t, version, binary.BigEndian.Uint64(versioned.GetKVStore(key).Get([]byte("key"))))
+				}
+				store.CacheMultiStore()
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		commit()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMultistoreSetPruningAfterLoad(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	for i := 0; i < 3; i++ {
+		store.Commit()
+	}
+	require.Empty(t, store.pruneHeights)
+
+	// the new strategy applies from the next commit onwards
+	store.SetPruning(types.NewPruningOptions(1, 0, 10))
+	store.Commit()
+	require.Equal(t, []int64{2}, store.pruneHeights)
+}
+
+func TestMultistoreSetPruningErr(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	store.MountStoreWithDB(types.NewKVStoreKey("db1"), types.StoreTypeDB, nil)
+	store.SetStorePruning(store.keysByName["store2"], types.PruneNothing)
+
+	// before loading, no store has uncommitted writes
+	accepted, err := store.SetPruningErr(types.NewPruningOptions(1, 0, 10))
+	require.NoError(t, err)
+	require.Equal(t, []types.StoreKey{store.keysByName["store1"], store.keysByName["store3"]}, accepted)
+
+	require.NoError(t, store.LoadLatestVersion())
+	_, err = store.SetPruningErr(types.PruneEverything)
+	require.NoError(t, err)
+
+	// a change mid-block is rejected and leaves the strategy unchanged
+	store.GetKVStore(store.keysByName["store1"]).Set([]byte("key"), []byte("value"))
+	_, err = store.SetPruningErr(types.PruneNothing)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+	require.Equal(t, types.PruneEverything, store.GetPruning())
+
+	// SetPruning defers it until after the next commit instead
+	require.NotPanics(t, func() { store.SetPruning(types.PruneNothing) })
+	require.Equal(t, types.PruneEverything, store.GetPruning())
+	store.Commit()
+	require.Equal(t, types.PruneNothing, store.GetPruning())
+
+	_, err = store.SetPruningErr(types.PruneEverything)
+	require.NoError(t, err)
+	require.Equal(t, types.PruneEverything, store.GetPruning())
+
+}
+
+func TestMultistoreSetStorePruning(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(1, 0, 1))
+	key1, key2 := ms.keysByName["store1"], ms.keysByName["store2"]
+	ms.SetStorePruning(key2, types.PruneNothing)
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, types.NewPruningOptions(1, 0, 1), ms.GetPruning())
+	require.Equal(t, types.NewPruningOptions(1, 0, 1), ms.GetStorePruning(key1))
+	require.Equal(t, types.PruneNothing, ms.GetStorePruning(key2))
+
+	for i := 0; i < 5; i++ {
+		ms.Commit()
+	}
+
+	store1 := ms.GetCommitKVStore(key1).(*iavl.Store)
+	store2 := ms.GetCommitKVStore(key2).(*iavl.Store)
+	require.Equal(t, []int{4, 5}, store1.AvailableVersions())
+	require.Equal(t, []int{1, 2, 3, 4, 5}, store2.AvailableVersions())
+
+	// commit infos are kept for the versions store2 still holds
+	for v := int64(1); v <= 5; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.NoError(t, err, "version %d", v)
+	}
+	_, err := ms.CacheMultiStoreWithVersion(2)
+	require.NoError(t, err)
+
+	// once store2 prunes as well, the commit infos of unserved versions go away
+	ms.SetStorePruning(key2, types.NewPruningOptions(0, 0, 1))
+	ms.Commit()
+	require.Equal(t, []int{5, 6}, store1.AvailableVersions())
+	require.Equal(t, []int{6}, store2.AvailableVersions())
+	for v := int64(1); v <= 4; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.Error(t, err, "version %d", v)
+	}
+
+	require.Panics(t, func() { ms.SetStorePruning(types.NewKVStoreKey("store4"), types.PruneNothing) })
+	require.Panics(t, func() { ms.GetStorePruning(types.NewKVStoreKey("store4")) })
+}
+
+func TestMultistoreMemoryStore(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	newStore := func() *Store {
+		store := NewStore(db)
+		store.MountStoreWithDB(types.NewKVStoreKey("iavl1"), types.StoreTypeIAVL, nil)
+		store.MountStoreWithDB(types.NewMemoryStoreKey("mem1"), types.StoreTypeMemory, nil)
+		require.NoError(t, store.LoadLatestVersion())
+		return store
+	}
+
+	store := newStore()
+	memKey := store.keysByName["mem1"]
+	k, v := []byte("key"), []byte("value")
+
+	emptyID := store.Commit()
+	store.GetKVStore(memKey).Set(k, v)
+	cID := store.Commit()
+
+	// entries are kept across commits but are not part of the app hash
+	require.Equal(t, v, store.GetKVStore(memKey).Get(k))
+	require.Equal(t, emptyID.Hash, cID.Hash)
+
+	// and they are not persisted
+	store = newStore()
+	require.Equal(t, cID, store.LastCommitID())
+	require.Nil(t, store.GetKVStore(store.keysByName["mem1"]).Get(k))
+}
+
+func TestMultistoreLatestCommitInfo(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	version, stores, err := store.LatestCommitInfo()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, version)
+	require.Empty(t, stores)
+
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("key"), []byte("value"))
+	cID := store.Commit()
+
+	version, stores, err = store.LatestCommitInfo()
+	require.NoError(t, err)
+	require.Equal(t, cID.Version, version)
+	require.Len(t, stores, 3)
+	for _, name := range []string{"store1", "store2", "store3"} {
+		require.Equal(t, store.getStoreByName(name).(types.CommitKVStore).LastCommitID(), stores[name])
+	}
+}
+
+func TestMultistoreWorkingHash(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+
+	store.getStoreByName("iavl1").(types.KVStore).Set([]byte("key"), []byte("value"))
+	store.getStoreByName("trans1").(types.KVStore).Set([]byte("key"), []byte("value"))
+
+	workingHash := store.WorkingHash()
+	require.Equal(t, workingHash, store.WorkingHash())
+	require.EqualValues(t, 0, store.LastCommitID().Version)
+
+	cID := store.Commit()
+	require.Equal(t, workingHash, cID.Hash)
+	require.Equal(t, cID.Hash, store.WorkingHash())
+
+	store.getStoreByName("iavl2").(types.KVStore).Set([]byte("key"), []byte("value"))
+	require.NotEqual(t, cID.Hash, store.WorkingHash())
+}
+
+func TestMultistoreTraceStoreName(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	var buf bytes.Buffer
+	store.SetTracer(&buf)
+	store.SetTracingContext(types.TraceContext{"blockHeight": 64})
+
+	store.GetKVStore(store.keysByName["store1"]).Set([]byte("key"), []byte("value"))
+	require.Contains(t, buf.String(), `"metadata":{"blockHeight":64,"store":"store1"}`)
+
+	// a user-supplied store key takes precedence
+	buf.Reset()
+	store.SetTracingContext(types.TraceContext{TraceContextStoreKey: "custom"})
+	store.GetKVStore(store.keysByName["store2"]).Set([]byte("key"), []byte("value"))
+	require.Contains(t, buf.String(), `"metadata":{"blockHeight":64,"store":"custom"}`)
+}
+
+func TestMultistoreExcludeFromTracing(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	key1, key2 := store.keysByName["store1"], store.keysByName["store2"]
+	k, v := []byte("key"), []byte("value")
+
+	var buf bytes.Buffer
+	store.SetTracer(&buf)
+	store.ExcludeFromTracing(key1)
+	require.True(t, store.TracingEnabled())
+
+	store.GetKVStore(key1).Set(k, v)
+	require.Empty(t, buf.String())
+
+	cms := store.CacheMultiStore()
+	cms.GetKVStore(key1).Set(k, v)
+	nested := cms.CacheMultiStore()
+	nested.GetKVStore(key1).Set(k, v)
+	nested.Write()
+	cms.Write()
+	require.Empty(t, buf.String())
+
+	cms.GetKVStore(key2).Set(k, v)
+	cms.Write()
+	require.NotEmpty(t, buf.String())
+}
+
+func TestGetKVStoreSafe(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	key1, key2 := store.keysByName["store1"], store.keysByName["store2"]
+	store.SetStoresToLoad(key1)
+	require.NoError(t, store.LoadLatestVersion())
+
+	kvStore, err := store.GetKVStoreSafe(key1)
+	require.NoError(t, err)
+	kvStore.Set([]byte("key"), []byte("value"))
+	require.Equal(t, []byte("value"), store.GetKVStore(key1).Get([]byte("key")))
+
+	_, err = store.GetKVStoreSafe(key2)
+	require.EqualError(t, err, "store not loaded: store2: unknown request")
+	_, err = store.GetKVStoreSafe(types.NewKVStoreKey("store4"))
+	require.EqualError(t, err, "store not mounted: store4: unknown request")
+	_, err = store.GetKVStoreSafe(nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+}
+
+func TestMultistoreInterBlockCache(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetInterBlockCache(cache.NewCommitKVStoreCacheManager(cache.DefaultCommitKVStoreCacheSize))
+	require.NoError(t, store.LoadLatestVersion())
+
+	key := store.keysByName["store1"]
+	k, v1, v2 := []byte("key"), []byte("value1"), []byte("value2")
+
+	// writes through GetKVStore are visible to queries and vice versa
+	store.GetKVStore(key).Set(k, v1)
+	cID := store.Commit()
+	res := store.Query(abci.RequestQuery{Path: "/store1/key", Data: k})
+	require.Equal(t, v1, res.Value)
+	require.Equal(t, v1, store.GetKVStore(key).Get(k))
+
+	store.GetKVStore(key).Set(k, v2)
+	store.Commit()
+	require.Equal(t, v2, store.GetKVStore(key).Get(k))
+
+	// reloading replaces the cached stores instead of serving stale entries
+	require.NoError(t, store.LoadVersion(cID.Version))
+	require.Equal(t, v1, store.GetKVStore(key).Get(k))
+	res = store.Query(abci.RequestQuery{Path: "/store1/key", Data: k})
+	require.Equal(t, v1, res.Value)
+	require.Equal(t, store.GetCommitKVStore(key), store.getStoreByName("store1"))
+
+	// GetStore unwraps the inter-block cache, GetStoreCached doesn't
+	require.IsType(t, &iavl.Store{}, store.GetStore(key))
+	require.IsType(t, &cache.CommitKVStoreCache{}, store.GetStoreCached(key))
+	require.Equal(t, v1, store.GetStoreCached(key).(types.KVStore).Get(k))
+	require.Panics(t, func() { store.GetStoreCached(types.NewKVStoreKey("store4")) })
+
+	// reads through the cache are reported in its statistics
+	stats := store.InterBlockCacheStats()
+	require.Len(t, stats, 3)
+	require.EqualValues(t, 1, stats["store1"].Entries)
+	require.NotZero(t, stats["store1"].Hits)
+	require.Nil(t, newMultiStoreWithMounts(db, types.PruneNothing).InterBlockCacheStats())
+}
+
+type closeCountingDB struct {
+	dbm.DB
+	closed *int
+}
+
+func (db closeCountingDB) Close() error {
+	*db.closed++
+	return db.DB.Close()
+}
+
+func TestMultistoreClose(t *testing.T) {
+	var rootClosed, storeClosed int
+	db := closeCountingDB{dbm.NewMemDB(), &rootClosed}
+	storeDB := closeCountingDB{dbm.NewMemDB(), &storeClosed}
+
+	store := NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("iavl1"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("iavl2"), types.StoreTypeIAVL, storeDB)
+	store.MountStoreWithDB(types.NewKVStoreKey("db1"), types.StoreTypeDB, nil)
+	store.MountStoreWithDB(types.NewTransientStoreKey("trans1"), types.StoreTypeTransient, nil)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
+
+	require.NoError(t, store.Close())
+	require.Equal(t, 1, rootClosed)
+	require.Equal(t, 1, storeClosed)
+
+	require.True(t, errors.Is(store.Close(), types.ErrStoreClosed))
+	require.Equal(t, 1, rootClosed)
+
+	require.True(t, errors.Is(store.LoadLatestVersion(), types.ErrStoreClosed))
+	require.True(t, errors.Is(store.LoadVersion(1), types.ErrStoreClosed))
+	_, err := store.CacheMultiStoreWithVersion(1)
+	require.True(t, errors.Is(err, types.ErrStoreClosed))
+	_, err = store.Snapshot(1, snapshottypes.CurrentFormat)
+	require.True(t, errors.Is(err, types.ErrStoreClosed))
+
+	res := store.Query(abci.RequestQuery{Path: "/iavl1/key", Data: []byte("key")})
+	require.EqualValues(t, types.ErrStoreClosed.ABCICode(), res.Code)
+	require.Panics(t, func() { store.Commit() })
+
+	key := types.NewKVStoreKey("iavl1")
+	require.PanicsWithValue(t, types.ErrStoreClosed, func() { store.GetKVStore(key) })
+	require.PanicsWithValue(t, types.ErrStoreClosed, func() { store.GetStore(key) })
+	require.PanicsWithValue(t, types.ErrStoreClosed, func() { store.GetStoreCached(key) })
+	_, err = store.GetKVStoreSafe(key)
+	require.True(t, errors.Is(err, types.ErrStoreClosed))
+}
+
+func TestMultistoreLoadMode(t *testing.T) {
+	var db dbm.DB = dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	k, v := []byte("key"), []byte("value")
+	store.getStoreByName("store1").(types.KVStore).Set(k, v)
+	cID := store.Commit()
+
+	// wipe store2 and store3 so they can't be loaded anymore
+	for _, name := range []string{"store2", "store3"} {
+		itr, err := dbm.IteratePrefix(db, []byte("s/k:"+name+"/"))
+		require.NoError(t, err)
+		keys := [][]byte{}
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, itr.Key())
+		}
+		itr.Close()
+		for _, key := range keys {
+			require.NoError(t, db.Delete(key))
+		}
+	}
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to load store store")
+	require.Regexp(t, `failed to load IAVL version 1 with hash [0-9A-F]+ under DB prefix "s/k:store[23]/"`, err.Error())
+
+	store.SetLoadMode(LoadModeCollect)
+	err = store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to load 2 store(s): store2: ")
+	require.Contains(t, err.Error(), "; store3: ")
+
+	store.SetLoadMode(LoadModeDegraded)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cID, store.LastCommitID())
+	require.Len(t, store.FailedStores(), 2)
+	require.Contains(t, store.FailedStores(), "store2")
+	require.Contains(t, store.FailedStores(), "store3")
+
+	// healthy stores can be inspected, but nothing can be committed
+	require.Equal(t, v, store.GetKVStore(store.keysByName["store1"]).Get(k))
+	res := store.Query(abci.RequestQuery{Path: "/store2/key", Data: k})
+	require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), res.Code)
+	require.Panics(t, func() { store.Commit() })
+}
+
+func TestMultistoreExportStore(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	key := store.keysByName["iavl1"]
+	kv := store.GetKVStore(key)
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Set([]byte("b"), []byte("2"))
+	cID := store.Commit()
+	kv.Set([]byte("c"), []byte("3"))
+	store.Commit()
+
+	nodes, err := store.ExportStore(key, cID.Version)
+	require.NoError(t, err)
+
+	leaves := map[string]string{}
+	for _, node := range nodes {
+		if node.Height == 0 {
+			leaves[string(node.Key)] = string(node.Value)
+		}
+	}
+	require.Equal(t, map[string]string{"a": "1", "b": "2"}, leaves)
+
+	// the export can be imported into a fresh IAVL tree with the same hash
+	tree, err := iavltree.NewMutableTree(dbm.NewMemDB(), 0)
+	require.NoError(t, err)
+	importer, err := tree.Import(cID.Version)
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	importer.Close()
+	immutable, err := store.GetCommitKVStore(key).(*iavl.Store).GetImmutable(cID.Version)
+	require.NoError(t, err)
+	require.Equal(t, immutable.LastCommitID().Hash, tree.Hash())
+
+	// exporting stops at the first callback error
+	stop := errors.New("stop")
+	count := 0
+	err = store.ExportStoreFunc(key, cID.Version, func(*iavltree.ExportNode) error {
+		count++
+		return stop
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, 1, count)
+
+	_, err = store.ExportStore(key, 3)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+	_, err = store.ExportStore(store.keysByName["trans1"], cID.Version)
+	require.Error(t, err)
+	_, err = store.ExportStore(types.NewKVStoreKey("iavl4"), cID.Version)
+	require.Error(t, err)
+}
+
+type recordingMetrics struct {
+	NoopStoreMetrics
+
+	storeCommits map[string]int64
+	commits      []int64
+	loads        []int64
+	queries      []string
+	sizes        map[string]int64
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{storeCommits: map[string]int64{}, sizes: map[string]int64{}}
+}
+
+func (m *recordingMetrics) StoreCommitted(name string, version int64, _ time.Duration) {
+	m.storeCommits[name] = version
+}
+
+func (m *recordingMetrics) Committed(version int64, _ time.Duration) {
+	m.commits = append(m.commits, version)
+}
+
+func (m *recordingMetrics) VersionLoaded(version int64, _ time.Duration) {
+	m.loads = append(m.loads, version)
+}
+
+func (m *recordingMetrics) Queried(path string, _ uint32, _ time.Duration) {
+	m.queries = append(m.queries, path)
+}
+
+func (m *recordingMetrics) StoreSize(name string, numKeys int64) {
+	m.sizes[name] = numKeys
+}
+
+func TestMultistoreMetrics(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMixedMounts(db)
+	metrics := newRecordingMetrics()
+	store.SetMetrics(metrics)
+
+	store.getStoreByName("iavl1").(types.KVStore).Set([]byte("a"), []byte{1})
+	store.getStoreByName("iavl1").(types.KVStore).Set([]byte("b"), []byte{1})
+	store.getStoreByName("iavl2").(types.KVStore).Set([]byte("a"), []byte{1})
+	store.Commit()
+
+	require.Equal(t, []int64{1}, metrics.commits)
+	require.Equal(t, map[string]int64{"iavl1": 1, "iavl2": 1, "iavl3": 1, "trans1": 0}, metrics.storeCommits)
+
+	store.Query(abci.RequestQuery{Path: "/iavl1/key", Data: []byte("a")})
+	require.Equal(t, []string{"/iavl1/key"}, metrics.queries)
+
+	store.ReportStoreSizes()
+	require.Equal(t, map[string]int64{"iavl1": 2, "iavl2": 1, "iavl3": 0}, metrics.sizes)
+
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, []int64{1}, metrics.loads)
+
+	// nil restores the no-op metrics
+	store.SetMetrics(nil)
+	store.Commit()
+	require.Equal(t, []int64{1}, metrics.commits)
+}
+
+func TestMultistoreStoreDiff(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	key := store.keysByName["iavl1"]
+	kv := store.GetKVStore(key)
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Set([]byte("b"), []byte("2"))
+	kv.Set([]byte("c"), []byte("3"))
+	from := store.Commit()
+	kv.Set([]byte("b"), []byte("22"))
+	kv.Set([]byte("c"), []byte("3")) // rewritten, but unchanged
+	kv.Delete([]byte("a"))
+	kv.Set([]byte("d"), []byte("4"))
+	store.Commit()
+	kv.Set([]byte("e"), []byte("5"))
+	to := store.Commit()
+
+	added, modified, deleted, err := store.StoreDiff(key, from.Version, to.Version)
+	require.NoError(t, err)
+	require.Equal(t, []types.KVPair{{Key: []byte("d"), Value: []byte("4")}, {Key: []byte("e"), Value: []byte("5")}}, added)
+	require.Equal(t, []types.KVPair{{Key: []byte("b"), Value: []byte("22")}}, modified)
+	require.Equal(t, []types.KVPair{{Key: []byte("a"), Value: []byte("1")}}, deleted)
+
+	added, modified, deleted, err = store.StoreDiff(key, to.Version, to.Version)
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, modified)
+	require.Empty(t, deleted)
+
+	_, _, _, err = store.StoreDiff(key, from.Version, to.Version+1)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+	_, _, _, err = store.StoreDiff(store.keysByName["trans1"], from.Version, to.Version)
+	require.Error(t, err)
+}
+
+func TestMultistoreIterateVersioned(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	key := store.keysByName["iavl2"]
+
+	collect := func(itr types.Iterator) []string {
+		defer itr.Close()
+		keys := []string{}
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Key()))
+		}
+		return keys
+	}
+
+	itr, err := store.IterateVersioned(key, 1, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"A", "X"}, collect(itr))
+	itr, err = store.IterateVersioned(key, 3, []byte("B"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"B", "C"}, collect(itr))
+	itr, err = store.ReverseIterateVersioned(key, 2, nil, []byte("X"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"B", "A"}, collect(itr))
+
+	_, err = store.IterateVersioned(key, 4, nil, nil)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+	_, err = store.IterateVersioned(key, 0, nil, nil)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+	_, err = store.ReverseIterateVersioned(store.keysByName["trans1"], 3, nil, nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+	_, err = store.IterateVersioned(types.NewKVStoreKey("unmounted"), 3, nil, nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrUnknownRequest))
+}
+
+func TestMultistoreCommitListener(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	var first, second []types.CommitID
+	store.RegisterCommitListener(func(commitID types.CommitID) {
+		// the commit is durable by the time listeners are invoked
+		ci, err := getCommitInfo(db, DefaultCommitInfoCodec, commitID.Version)
+		require.NoError(t, err)
+		require.Equal(t, ci.CommitID(), commitID)
+
+		first = append(first, commitID)
+	})
+	store.RegisterCommitListener(func(commitID types.CommitID) {
+		second = append(second, commitID)
+	})
+
+	cid := store.Commit()
+	require.Equal(t, []types.CommitID{cid}, first)
+	require.Equal(t, []types.CommitID{cid}, second)
+
+	// a panicking listener is logged, and doesn't stop the others or Commit
+	buf := &bytes.Buffer{}
+	store.SetLogger(log.NewTMLogger(buf))
+	store.RegisterCommitListener(func(types.CommitID) { panic("boom") })
+	store.RegisterCommitListener(func(commitID types.CommitID) {
+		second = append(second, commitID)
+	})
+	require.NotPanics(t, func() { store.Commit() })
+	require.Regexp(t, `commit listener panicked +module=rootmulti listener=2 version=2 err=boom`, buf.String())
+	require.Len(t, first, 2)
+	require.Len(t, second, 3)
+	require.Equal(t, int64(2), store.LastCommitID().Version)
+	latest, err := getLatestVersion(db)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), latest)
+}
+
+type changeSetRecord struct {
+	store      string
+	op         byte
+	key, value []byte
+}
+
+func readChangeSetBlock(t *testing.T, r *bytes.Reader) (int64, []changeSetRecord) {
+	readUvarint := func(r *bytes.Reader) uint64 {
+		x, err := binary.ReadUvarint(r)
+		require.NoError(t, err)
+		return x
+	}
+	readBytes := func(r *bytes.Reader) []byte {
+		bz := make([]byte, readUvarint(r))
+		_, err := io.ReadFull(r, bz)
+		require.NoError(t, err)
+		return bz
+	}
+
+	block := bytes.NewReader(readBytes(r))
+	version := int64(readUvarint(block))
+	records := make([]changeSetRecord, readUvarint(block))
+	for i := range records {
+		records[i].store = string(readBytes(block))
+		op, err := block.ReadByte()
+		require.NoError(t, err)
+		records[i].op = op
+		records[i].key = readBytes(block)
+		if op == ChangeSetOpSet {
+			records[i].value = readBytes(block)
+		}
+	}
+	require.Zero(t, block.Len())
+
+	return version, records
+}
+
+func TestMultistoreChangeSetWriter(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	var buf bytes.Buffer
+	store.SetChangeSetWriter(&buf)
+
+	iavl1 := store.keysByName["iavl1"]
+	iavl2 := store.keysByName["iavl2"]
+	trans1 := store.keysByName["trans1"]
+
+	store.GetKVStore(iavl1).Set([]byte("a"), []byte("1"))
+	store.GetKVStore(iavl2).Set([]byte("b"), []byte("2"))
+	store.GetKVStore(trans1).Set([]byte("t"), []byte("1"))
+
+	cms := store.CacheMultiStore()
+	cms.GetKVStore(iavl1).Delete([]byte("a"))
+	cms.GetKVStore(trans1).Set([]byte("t"), []byte("2"))
+	require.Zero(t, buf.Len())
+	cms.Write()
+
+	store.Commit()
+	store.Commit()
+
+	r := bytes.NewReader(buf.Bytes())
+	version, records := readChangeSetBlock(t, r)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, []changeSetRecord{
+		{"iavl1", ChangeSetOpSet, []byte("a"), []byte("1")},
+		{"iavl2", ChangeSetOpSet, []byte("b"), []byte("2")},
+		{"iavl1", ChangeSetOpDelete, []byte("a"), nil},
+	}, records)
+
+	version, records = readChangeSetBlock(t, r)
+	require.Equal(t, int64(2), version)
+	require.Empty(t, records)
+	require.Zero(t, r.Len())
+
+	// disabling change sets stops recording
+	written := buf.Len()
+	store.SetChangeSetWriter(nil)
+	store.GetKVStore(iavl1).Set([]byte("c"), []byte("3"))
+	store.Commit()
+	require.Equal(t, written, buf.Len())
+}
+
+type failingWriter struct{ fail bool }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("write failed")
+	}
+	return len(p), nil
+}
+
+func TestMultistoreChangeSetWriterErrors(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMixedMounts(db)
+	w := &failingWriter{fail: true}
+	store.SetChangeSetWriter(w)
+	iavl1 := store.keysByName["iavl1"]
+	iavl2 := store.keysByName["iavl2"]
+
+	// a failing writer aborts the commit, and keeps the records for a retry
+	store.GetKVStore(iavl1).Set([]byte("a"), []byte("1"))
+	require.Panics(t, func() { store.Commit() })
+	require.Zero(t, store.LastCommitID().Version)
+	latest, err := getLatestVersion(db)
+	require.NoError(t, err)
+	require.Zero(t, latest)
+	require.True(t, store.changeSet.recorded("iavl1"))
+
+	w.fail = false
+	require.Equal(t, int64(1), store.Commit().Version)
+	require.False(t, store.changeSet.recorded("iavl1"))
+
+	// loading a version discards the recorded writes
+	store.GetKVStore(iavl1).Set([]byte("b"), []byte("2"))
+	require.NoError(t, store.LoadLatestVersion())
+	require.False(t, store.changeSet.recorded("iavl1"))
+
+	// writes bypassing the recording are logged
+	buf := &bytes.Buffer{}
+	store.SetLogger(log.NewTMLogger(buf))
+	store.GetCommitKVStore(iavl2).Set([]byte("c"), []byte("3"))
+	store.Commit()
+	require.Regexp(t, `writes bypassed the change set +module=rootmulti store=iavl2`, buf.String())
+}
+
+func TestMultistoreStorePrefixer(t *testing.T) {
+	db := dbm.NewMemDB()
+	legacyPrefixer := func(key types.StoreKey, hasOwnDB bool) []byte {
+		return []byte("legacy/" + key.Name() + "/")
+	}
+
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetStorePrefixer(legacyPrefixer)
+	require.NoError(t, store.LoadLatestVersion())
+	store.GetKVStore(store.keysByName["store1"]).Set([]byte("key"), []byte("value"))
+	cid := store.Commit()
+
+	itr, err := db.Iterator([]byte("s/k:"), []byte("s/k;"))
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	itr.Close()
+
+	itr, err = db.Iterator([]byte("legacy/store1/"), []byte("legacy/store10"))
+	require.NoError(t, err)
+	require.True(t, itr.Valid())
+	itr.Close()
+
+	// reading the legacy layout requires the same prefixer
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.Error(t, store.LoadLatestVersion())
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetStorePrefixer(legacyPrefixer)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cid, store.LastCommitID())
+	require.Equal(t, []byte("value"), store.GetKVStore(store.keysByName["store1"]).Get([]byte("key")))
+}
+
+type jsonCommitInfoCodec struct{}
+
+func (jsonCommitInfoCodec) Name() string { return "json" }
+
+func (jsonCommitInfoCodec) Marshal(cInfo *types.CommitInfo) ([]byte, error) {
+	return json.Marshal(cInfo)
+}
+
+func (jsonCommitInfoCodec) Unmarshal(bz []byte, cInfo *types.CommitInfo) error {
+	return json.Unmarshal(bz, cInfo)
+}
+
+func TestMultistoreCommitInfoCodec(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetCommitInfoCodec(jsonCommitInfoCodec{})
+	require.NoError(t, store.LoadLatestVersion())
+	store.GetKVStore(store.keysByName["store1"]).Set([]byte("key"), []byte("value"))
+	cid := store.Commit()
+
+	bz, err := db.Get([]byte(fmt.Sprintf(commitInfoKeyFmt, cid.Version)))
+	require.NoError(t, err)
+	cInfo := &types.CommitInfo{}
+	require.NoError(t, json.Unmarshal(bz, cInfo))
+	require.Equal(t, cid.Hash, cInfo.Hash())
+
+	// reading the DB requires the same codec
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err = store.LoadLatestVersion()
+	require.EqualError(t, err,
+		`commit infos in the DB are encoded with codec "json", but the store is configured with codec "proto"`)
+	_, _, err = store.LatestCommitInfo()
+	require.Error(t, err)
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetCommitInfoCodec(jsonCommitInfoCodec{})
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, cid, store.LastCommitID())
+
+	// a DB written with the default codec can't be switched to another one
+	db = dbm.NewMemDB()
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetCommitInfoCodec(jsonCommitInfoCodec{})
+	err = store.LoadLatestVersion()
+	require.EqualError(t, err,
+		`commit infos in the DB are encoded with codec "proto", but the store is configured with codec "json"`)
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	store.SetCommitInfoCodec(nil)
+	require.NoError(t, store.LoadLatestVersion())
+}
+
+func TestMultistoreOverlappingStorePrefixes(t *testing.T) {
+	store := NewStore(dbm.NewMemDB())
+	store.MountStoreWithDB(types.NewKVStoreKey("a"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("a/b"), types.StoreTypeIAVL, nil)
+	err := store.LoadLatestVersion()
+	require.EqualError(t, err, `stores a and a/b have overlapping DB prefixes "s/k:a/" and "s/k:a/b/"`)
+
+	store = NewStore(dbm.NewMemDB())
+	store.SetStorePrefixer(func(key types.StoreKey, _ bool) []byte { return []byte("s/" + key.Name()) })
+	store.MountStoreWithDB(types.NewKVStoreKey("latest"), types.StoreTypeIAVL, nil)
+	err = store.LoadLatestVersion()
+	require.EqualError(t, err, `store latest has DB prefix "s/latest" overlapping the root store metadata key "s/latest"`)
+
+	store = NewStore(dbm.NewMemDB())
+	store.SetStorePrefixer(func(key types.StoreKey, _ bool) []byte { return []byte("s/" + key.Name()) })
+	store.MountStoreWithDB(types.NewKVStoreKey("12"), types.StoreTypeIAVL, nil)
+	err = store.LoadLatestVersion()
+	require.EqualError(t, err, `store 12 has DB prefix "s/12" overlapping the root store metadata key "s/1"`)
+
+	// stores kept in different DBs don't overlap
+	db := dbm.NewMemDB()
+	store = NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("a"), types.StoreTypeIAVL, dbm.NewMemDB())
+	store.MountStoreWithDB(types.NewKVStoreKey("a/b"), types.StoreTypeIAVL, nil)
+	require.NoError(t, store.LoadLatestVersion())
+}
+
+func TestMultistoreSharedStoreDB(t *testing.T) {
+	db, sharedDB, ownDB := dbm.NewMemDB(), dbm.NewMemDB(), dbm.NewMemDB()
+	newStore := func() *Store {
+		store := NewStore(db)
+		store.MountStoreWithDB(types.NewKVStoreKey("a"), types.StoreTypeIAVL, sharedDB)
+		store.MountStoreWithDB(types.NewKVStoreKey("b"), types.StoreTypeIAVL, sharedDB)
+		store.MountStoreWithDB(types.NewKVStoreKey("c"), types.StoreTypeIAVL, ownDB)
+		require.NoError(t, store.LoadLatestVersion())
+		return store
+	}
+
+	store := newStore()
+	for _, name := range []string{"a", "b", "c"} {
+		store.getStoreByName(name).(types.KVStore).Set([]byte("key"), []byte(name))
+	}
+	commitID := store.Commit()
+
+	// the stores sharing a DB are kept apart by name, the one with its own DB isn't
+	store = newStore()
+	require.Equal(t, commitID, store.LastCommitID())
+	for _, name := range []string{"a", "b", "c"} {
+		require.Equal(t, []byte(name), store.getStoreByName(name).(types.KVStore).Get([]byte("key")))
+	}
+	for prefix, db := range map[string]dbm.DB{"s/k:a/": sharedDB, "s/k:b/": sharedDB, "s/_/": ownDB} {
+		itr, err := dbm.IteratePrefix(db, []byte(prefix))
+		require.NoError(t, err)
+		require.True(t, itr.Valid(), prefix)
+		require.NoError(t, itr.Close())
+	}
+
+	// a DB with data of a single store can't become shared
+	store = NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("a"), types.StoreTypeIAVL, sharedDB)
+	store.MountStoreWithDB(types.NewKVStoreKey("b"), types.StoreTypeIAVL, sharedDB)
+	store.MountStoreWithDB(types.NewKVStoreKey("c"), types.StoreTypeIAVL, ownDB)
+	store.MountStoreWithDB(types.NewKVStoreKey("d"), types.StoreTypeIAVL, ownDB)
+	err := store.LoadLatestVersion()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `shares its DB with other stores, but the DB has data under prefix "s/_/"`)
+}
+
+func TestMultistoreDebugDump(t *testing.T) {
+	store := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	store.getStoreByName("trans1").(types.KVStore).Set([]byte("x2"), []byte{92})
+
+	// uncommitted writes aren't dumped
+	store.getStoreByName("iavl1").(types.KVStore).Set([]byte("d"), []byte{4})
+	store.getStoreByName("iavl2").(types.KVStore).Delete([]byte("A"))
+
+	var buf bytes.Buffer
+	require.NoError(t, store.DebugDump(&buf))
+	require.Equal(t, "iavl1\t61\t01\n"+
+		"iavl1\t62\t02\n"+
+		"iavl1\t63\t03\n"+
+		"iavl2\t41\t65\n"+
+		"iavl2\t42\t66\n"+
+		"iavl2\t43\t67\n", buf.String())
+}
+
+func TestMultistoreVerifyIntegrity(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	require.NoError(t, store.VerifyIntegrity())
+
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{1})
+	cid := store.Commit()
+	require.NoError(t, store.VerifyIntegrity())
+
+	// corrupt the persisted hash of store2
+	cInfo, err := getCommitInfo(db, DefaultCommitInfoCodec, cid.Version)
+	require.NoError(t, err)
+	for i, si := range cInfo.StoreInfos {
+		if si.Name == "store2" {
+			cInfo.StoreInfos[i].CommitId.Hash = []byte("corrupted")
+		}
+	}
+	batch := db.NewBatch()
+	setCommitInfo(batch, DefaultCommitInfoCodec, cid.Version, cInfo)
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+
+	err = store.VerifyIntegrity()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "store2: persisted")
+	require.NotContains(t, err.Error(), "store1")
+}
+
+func TestMultistoreCorruptCommitInfo(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
+	cid := store.Commit()
+
+	// truncate the commit info row, as a crash during the write might
+	cInfoKey := []byte(fmt.Sprintf(commitInfoKeyFmt, cid.Version))
+	bz, err := db.Get(cInfoKey)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(cInfoKey, bz[:len(bz)-1]))
+
+	_, err = getCommitInfo(db, DefaultCommitInfoCodec, cid.Version)
+	require.True(t, errors.Is(err, types.ErrCorruptCommitInfo))
+	require.Contains(t, err.Error(), fmt.Sprintf("version %d (%d bytes)", cid.Version, len(bz)-1))
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.True(t, errors.Is(store.LoadLatestVersion(), types.ErrCorruptCommitInfo))
+
+	// a missing row is not reported as corrupt
+	_, err = getCommitInfo(db, DefaultCommitInfoCodec, cid.Version+1)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, types.ErrCorruptCommitInfo))
+
+	// the corrupt version can be rolled back
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.RollbackToVersion(cid.Version-1))
+	require.Equal(t, cid.Version-1, store.LastCommitID().Version)
+}
+
+type failingGetDB struct {
+	dbm.DB
+	key []byte
+}
+
+func (db failingGetDB) Get(key []byte) ([]byte, error) {
+	if bytes.Equal(key, db.key) {
+		return nil, errors.New("disk failure")
+	}
+	return db.DB.Get(key)
+}
+
+func TestMultistoreLoadLatestVersionDBError(t *testing.T) {
+	memDB := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(memDB, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	store.Commit()
+
+	db := failingGetDB{memDB, []byte(latestVersionKey)}
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	err := store.LoadLatestVersion()
+	require.EqualError(t, err, "failed to get latest version: disk failure")
+
+	err = store.LoadLatestVersionAndUpgrade(nil)
+	require.EqualError(t, err, "failed to get latest version: disk failure")
+
+	_, _, err = store.LatestCommitInfo()
+	require.EqualError(t, err, "failed to get latest version: disk failure")
+
+	// the DB recovers
+	store = newMultiStoreWithMounts(memDB, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	require.Equal(t, int64(1), store.LastCommitID().Version)
+}
+
+func TestMultistoreValidateUpgrades(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	cid := store.Commit()
+
+	restore, upgrades := newMultiStoreWithModifiedMounts(db, types.PruneNothing)
+	require.NoError(t, restore.ValidateUpgrades(upgrades, cid.Version))
+	require.NoError(t, restore.ValidateUpgrades(nil, cid.Version))
+
+	invalid := &types.StoreUpgrades{
+		Added:   []string{"store1", "store5"},
+		Renamed: []types.StoreRename{{OldKey: "store0", NewKey: "restore2"}},
+		Deleted: []string{"store4", "store1"},
+	}
+	err := restore.ValidateUpgrades(invalid, cid.Version)
+	require.EqualError(t, err, "invalid store upgrades for version 1: "+
+		"added store store1 already exists; "+
+		"added store store5 is not mounted; "+
+		"deleted store store4 does not exist; "+
+		"store store1 is both added and deleted; "+
+		"store store0 renamed to restore2 does not exist")
+
+	// nothing was mutated, so the valid plan still loads
+	require.NoError(t, restore.LoadVersionAndUpgrade(cid.Version, upgrades))
+}
+
+func TestMultistoreRenameChain(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := NewStore(db)
+	for _, name := range []string{"a", "b"} {
+		store.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+	}
+	require.NoError(t, store.LoadLatestVersion())
+	store.getStoreByName("a").(types.KVStore).Set([]byte("key"), []byte("from a"))
+	store.getStoreByName("b").(types.KVStore).Set([]byte("key"), []byte("from b"))
+	store.getStoreByName("b").(types.KVStore).Set([]byte("only-b"), []byte("from b"))
+	cid := store.Commit()
+
+	newStore := func() *Store {
+		store := NewStore(db)
+		for _, name := range []string{"b", "c"} {
+			store.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+		}
+		return store
+	}
+
+	// listed in either order, the chain is applied as b -> c, then a -> b
+	for _, renamed := range [][]types.StoreRename{
+		{{OldKey: "a", NewKey: "b"}, {OldKey: "b", NewKey: "c"}},
+		{{OldKey: "b", NewKey: "c"}, {OldKey: "a", NewKey: "b"}},
+	} {
+		upgrades := &types.StoreUpgrades{Renamed: renamed}
+
+		restore := newStore()
+		require.NoError(t, restore.ValidateUpgrades(upgrades, cid.Version))
+		require.NoError(t, restore.LoadVersionAndUpgrade(cid.Version, upgrades))
+
+		b := restore.getStoreByName("b").(types.KVStore)
+		c := restore.getStoreByName("c").(types.KVStore)
+		require.Equal(t, []byte("from a"), b.Get([]byte("key")))
+		require.Nil(t, b.Get([]byte("only-b")))
+		require.Equal(t, []byte("from b"), c.Get([]byte("key")))
+		require.Equal(t, []byte("from b"), c.Get([]byte("only-b")))
+	}
+
+	// cycles are rejected
+	cycle := &types.StoreUpgrades{Renamed: []types.StoreRename{
+		{OldKey: "b", NewKey: "c"},
+		{OldKey: "c", NewKey: "b"},
+	}}
+	restore := newStore()
+	err := restore.ValidateUpgrades(cycle, cid.Version)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "store renames form a cycle")
+
+	err = restore.LoadVersionAndUpgrade(cid.Version, cycle)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "store renames form a cycle")
+
+	// a DB store can't be emptied for the next rename before its copy into an
+	// IAVL store is committed
+	db = dbm.NewMemDB()
+	store = NewStore(db)
+	store.MountStoreWithDB(types.NewKVStoreKey("a"), types.StoreTypeIAVL, nil)
+	store.MountStoreWithDB(types.NewKVStoreKey("b"), types.StoreTypeDB, nil)
+	require.NoError(t, store.LoadLatestVersion())
+	store.getStoreByName("b").(types.KVStore).Set([]byte("key"), []byte("from b"))
+	cid = store.Commit()
+
+	restore = NewStore(db)
+	restore.MountStoreWithDB(types.NewKVStoreKey("b"), types.StoreTypeDB, nil)
+	restore.MountStoreWithDB(types.NewKVStoreKey("c"), types.StoreTypeIAVL, nil)
+	err = restore.LoadVersionAndUpgrade(cid.Version, &types.StoreUpgrades{Renamed: []types.StoreRename{
+		{OldKey: "a", NewKey: "b"},
+		{OldKey: "b", NewKey: "c"},
+	}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot rename store b to c")
+	require.Equal(t, []byte("from b"), dbadapter.Store{DB: dbm.NewPrefixDB(db, []byte("s/k:b/"))}.Get([]byte("key")))
+}
+
+func TestMultistoreExcludeFromCommitHash(t *testing.T) {
+	db := dbm.NewMemDB()
+	newStore := func(exclude bool) *Store {
+		store := newMultiStoreWithMounts(db, types.PruneNothing)
+		store.MountStoreWithDB(types.NewKVStoreKey("cache"), types.StoreTypeDB, nil)
+		store.MountStoreWithDB(types.NewKVStoreKey("ephemeral"), types.StoreTypeIAVL, nil)
+		if exclude {
+			store.ExcludeFromCommitHash(store.keysByName["cache"])
+			store.ExcludeFromCommitHash(store.keysByName["ephemeral"])
+		}
+		require.NoError(t, store.LoadLatestVersion())
+		return store
+	}
+
+	store := newStore(true)
+	require.Panics(t, func() { store.ExcludeFromCommitHash(types.NewKVStoreKey("unmounted")) })
+
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{1})
+	store.getStoreByName("cache").(types.KVStore).Set([]byte("a"), []byte{1})
+	store.getStoreByName("ephemeral").(types.KVStore).Set([]byte("a"), []byte{1})
+	workingHash := store.WorkingHash()
+	cid := store.Commit()
+	require.Equal(t, workingHash, cid.Hash)
+	require.NoError(t, store.VerifyIntegrity())
+
+	names := []string{}
+	for _, si := range store.lastCommitInfo.StoreInfos {
+		names = append(names, si.Name)
+	}
+	require.Equal(t, []string{"store1", "store2", "store3"}, names)
+
+	// the root hash only depends on the included stores
+	expected := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, expected.LoadLatestVersion())
+	expected.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{1})
+	require.Equal(t, expected.Commit().Hash, cid.Hash)
+
+	// excluded stores are still committed, but can't be proven
+	reloaded := newStore(true)
+	require.Equal(t, cid, reloaded.LastCommitID())
+	require.Equal(t, []byte{1}, reloaded.getStoreByName("ephemeral").(types.KVStore).Get([]byte("a")))
+
+	res := reloaded.Query(abci.RequestQuery{Path: "/ephemeral/key", Data: []byte("a"), Prove: true})
+	require.EqualValues(t, sdkerrors.ErrInvalidRequest.ABCICode(), res.Code)
+	require.Contains(t, res.Log, "not part of the commit hash")
+
+	res = reloaded.Query(abci.RequestQuery{Path: "/ephemeral/key", Data: []byte("a")})
+	require.EqualValues(t, 0, res.Code)
+	require.Equal(t, []byte{1}, res.Value)
+}
+
+func TestMultistoreBranch(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	store.MountStoreWithDB(types.NewKVStoreKey("own"), types.StoreTypeDB, dbm.NewMemDB())
+	require.NoError(t, store.LoadLatestVersion())
+
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{1})
+	parentID := store.Commit()
+	parentDB := dbm.NewMemDB()
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		require.NoError(t, parentDB.Set(itr.Key(), itr.Value()))
+	}
+	require.NoError(t, itr.Close())
+
+	branch, err := store.Branch()
+	require.NoError(t, err)
+	require.Equal(t, parentID, branch.LastCommitID())
+	require.Equal(t, []byte{1}, branch.getStoreByName("store1").(types.KVStore).Get([]byte("a")))
+
+	// commits on the branch produce the same hashes as on the store itself
+	// but leave the store and its DBs untouched
+	for i := byte(2); i < 4; i++ {
+		branch.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{i})
+		branch.getStoreByName("store2").(types.KVStore).Set([]byte{i}, []byte{i})
+		branch.getStoreByName("own").(types.KVStore).Set([]byte{i}, []byte{i})
+		branchID := branch.Commit()
+
+		store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{i})
+		store.getStoreByName("store2").(types.KVStore).Set([]byte{i}, []byte{i})
+		if i == 2 {
+			checkStore(t, store, parentID, parentID)
+			require.Nil(t, store.getStoreByName("own").(types.KVStore).Get([]byte{i}))
+			requireDBEqual(t, parentDB, db)
+		}
+		store.getStoreByName("own").(types.KVStore).Set([]byte{i}, []byte{i})
+		require.Equal(t, store.Commit(), branchID)
+	}
+
+	store.Close()
+	_, err = store.Branch()
+	require.True(t, errors.Is(err, types.ErrStoreClosed))
+}
+
+func TestMultistoreBranchCommitInfoCodec(t *testing.T) {
+	store := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	store.SetCommitInfoCodec(jsonCommitInfoCodec{})
+	require.NoError(t, store.LoadLatestVersion())
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{1})
+	store.Commit()
+
+	branch, err := store.Branch()
+	require.NoError(t, err)
+	require.Equal(t, jsonCommitInfoCodec{}, branch.cInfoCodec)
+	require.Equal(t, store.LastCommitID(), branch.LastCommitID())
+
+	// the branch is only valid until the store is committed
+	branch.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{2})
+	branchID := branch.Commit()
+	store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{2})
+	require.Equal(t, store.Commit(), branchID)
+}
+
+func requireDBEqual(t *testing.T, expected, actual dbm.DB) {
+	t.Helper()
+
+	expItr, err := expected.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer expItr.Close()
+	actItr, err := actual.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer actItr.Close()
+
+	for ; expItr.Valid(); expItr.Next() {
+		require.True(t, actItr.Valid())
+		require.Equal(t, expItr.Key(), actItr.Key())
+		require.Equal(t, expItr.Value(), actItr.Value())
+		actItr.Next()
+	}
+	require.False(t, actItr.Valid())
+}
+
+func TestMultistoreIterateCommitInfos(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+
+	hashes := map[int64][]byte{}
+	for i := byte(1); i <= 12; i++ {
+		store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{i})
+		cid := store.Commit()
+		hashes[cid.Version] = cid.Hash
+	}
+	deleteCommitInfos(db, []int64{3, 4})
+
+	type entry struct {
+		version int64
+		hash    []byte
+	}
+	collect := func(start, end int64, limit int) []entry {
+		entries := []entry{}
+		require.NoError(t, store.IterateCommitInfos(start, end, func(version int64, hash []byte) bool {
+			entries = append(entries, entry{version, hash})
+			return len(entries) < limit
+		}))
+		return entries
+	}
+
+	// versions 10-12 sort before 2 lexicographically, but are visited in order
+	entries := collect(2, 11, 100)
+	versions := []int64{}
+	for _, e := range entries {
+		versions = append(versions, e.version)
+		require.Equal(t, hashes[e.version], e.hash)
+	}
+	require.Equal(t, []int64{2, 5, 6, 7, 8, 9, 10, 11}, versions)
+
+	require.Len(t, collect(1, 12, 3), 3)
+	require.Empty(t, collect(13, 20, 100))
+
+	err := store.IterateCommitInfos(5, 4, func(int64, []byte) bool { return true })
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+}
+
+func TestMultistoreSetStoresToLoad(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	for i := byte(1); i <= 2; i++ {
+		store.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{i})
+		store.getStoreByName("store2").(types.KVStore).Set([]byte("a"), []byte{i})
+		store.Commit()
+	}
+
+	partial := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.Panics(t, func() { partial.SetStoresToLoad(types.NewKVStoreKey("unmounted")) })
+	partial.SetStoresToLoad(partial.keysByName["store1"])
+	require.NoError(t, partial.LoadLatestVersion())
+	require.Len(t, partial.stores, 1)
+
+	res := partial.Query(abci.RequestQuery{Path: "/store1/key", Data: []byte("a"), Height: 2})
+	require.EqualValues(t, 0, res.Code)
+	require.Equal(t, []byte{2}, res.Value)
+
+	for _, height := range []int64{1, 2} {
+		res = partial.Query(abci.RequestQuery{Path: "/store2/key", Data: []byte("a"), Height: height})
+		require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), res.Code)
+		require.Contains(t, res.Log, "store not loaded: store2")
+	}
+
+	res = partial.Query(abci.RequestQuery{Path: "/unknown/key", Data: []byte("a")})
+	require.Contains(t, res.Log, "no such store: unknown")
+
+	responses, err := partial.QueryKeys(0, []StoreKeyQuery{{StoreName: "store2", Key: []byte("a")}}, false)
+	require.NoError(t, err)
+	require.Contains(t, responses[0].Log, "store not loaded: store2")
+
+	require.Panics(t, func() { partial.Commit() })
+	err = partial.LoadLatestVersionAndUpgrade(&types.StoreUpgrades{Deleted: []string{"store3"}})
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+
+	// without keys all stores are loaded again
+	partial.SetStoresToLoad()
+	require.NoError(t, partial.LoadLatestVersion())
+	require.Len(t, partial.stores, 3)
+	require.Equal(t, store.LastCommitID(), partial.LastCommitID())
+}
+
+func TestMultistoreSetStoreLazyLoading(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, store.LoadLatestVersion())
+	for i := byte(1); i <= 2; i++ {
+		for _, name := range []string{"store1", "store2", "store3"} {
+			store.getStoreByName(name).(types.KVStore).Set([]byte("a"), []byte{i})
+		}
+		store.Commit()
+	}
+
+	store = newMultiStoreWithMounts(db, types.PruneNothing)
+	require.Panics(t, func() { store.SetStoreLazyLoading(types.NewKVStoreKey("unmounted"), true) })
+	store.SetLazyLoading(true)
+	store.SetStoreLazyLoading(store.keysByName["store2"], false)
+	require.NoError(t, store.LoadLatestVersion())
+
+	// a lazily loaded IAVL store only knows about the loaded version
+	require.False(t, store.getStoreByName("store1").(*iavl.Store).VersionExists(1))
+	require.False(t, store.getStoreByName("store3").(*iavl.Store).VersionExists(1))
+	require.True(t, store.getStoreByName("store2").(*iavl.Store).VersionExists(1))
+	for _, name := range []string{"store1", "store2", "store3"} {
+		require.True(t, store.getStoreByName(name).(*iavl.Store).VersionExists(2), name)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	_, _, err := parsePath("foo")
+	require.Error(t, err)
+
+	store, subpath, err := parsePath("/foo")
+	require.NoError(t, err)
+	require.Equal(t, store, "foo")
+	require.Equal(t, subpath, "")
+
+	store, subpath, err = parsePath("/fizz/bang/baz")
+	require.NoError(t, err)
+	require.Equal(t, store, "fizz")
+	require.Equal(t, subpath, "/bang/baz")
+
+	substore, subsubpath, err := parsePath(subpath)
+	require.NoError(t, err)
+	require.Equal(t, substore, "bang")
+	require.Equal(t, subsubpath, "/baz")
+
+	_, _, err = parsePath("//foo")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "empty store name")
+
+	_, _, err = parsePath("/")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "empty store name")
+}
+
+func TestMultiStoreRestart(t *testing.T) {
+	db := dbm.NewMemDB()
+	pruning := types.PruningOptions{
+		KeepRecent: 2,
+		KeepEvery:  3,
+		Interval:   1,
+	}
+	multi := newMultiStoreWithMounts(db, pruning)
+	err := multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	initCid := multi.LastCommitID()
+
+	k, v := "wind", "blows"
+	k2, v2 := "water", "flows"
+	k3, v3 := "fire", "burns"
+
+	for i := 1; i < 3; i++ {
+		// Set and commit data in one store.
+		store1 := multi.getStoreByName("store1").(types.KVStore)
+		store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, i)))
+
+		// ... and another.
+		store2 := multi.getStoreByName("store2").(types.KVStore)
+		store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, i)))
+
+		// ... and another.
+		store3 := multi.getStoreByName("store3").(types.KVStore)
+		store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, i)))
+
+		multi.Commit()
+
+		cinfo, err := getCommitInfo(multi.db, DefaultCommitInfoCodec, int64(i))
+		require.NoError(t, err)
+		require.Equal(t, int64(i), cinfo.Version)
+	}
+
+	// Set and commit data in one store.
+	store1 := multi.getStoreByName("store1").(types.KVStore)
+	store1.Set([]byte(k), []byte(fmt.Sprintf("%s:%d", v, 3)))
+
+	// ... and another.
+	store2 := multi.getStoreByName("store2").(types.KVStore)
+	store2.Set([]byte(k2), []byte(fmt.Sprintf("%s:%d", v2, 3)))
+
+	multi.Commit()
+
+	flushedCinfo, err := getCommitInfo(multi.db, DefaultCommitInfoCodec, 3)
+	require.Nil(t, err)
+	require.NotEqual(t, initCid, flushedCinfo, "CID is different after flush to disk")
+
+	// ... and another.
+	store3 := multi.getStoreByName("store3").(types.KVStore)
+	store3.Set([]byte(k3), []byte(fmt.Sprintf("%s:%d", v3, 3)))
+
+	multi.Commit()
+
+	postFlushCinfo, err := getCommitInfo(multi.db, DefaultCommitInfoCodec, 4)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), postFlushCinfo.Version, "Commit changed after in-memory commit")
+
+	multi = newMultiStoreWithMounts(db, pruning)
+	err = multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	reloadedCid := multi.LastCommitID()
+	require.Equal(t, int64(4), reloadedCid.Version, "Reloaded CID is not the same as last flushed CID")
+
+	// Check that store1 and store2 retained date from 3rd commit
+	store1 = multi.getStoreByName("store1").(types.KVStore)
+	val := store1.Get([]byte(k))
+	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v, 3)), val, "Reloaded value not the same as last flushed value")
+
+	store2 = multi.getStoreByName("store2").(types.KVStore)
+	val2 := store2.Get([]byte(k2))
+	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v2, 3)), val2, "Reloaded value not the same as last flushed value")
+
+	// Check that store3 still has data from last commit even though update happened on 2nd commit
+	store3 = multi.getStoreByName("store3").(types.KVStore)
+	val3 := store3.Get([]byte(k3))
+	require.Equal(t, []byte(fmt.Sprintf("%s:%d", v3, 3)), val3, "Reloaded value not the same as last flushed value")
+}
+
+func TestMultiStoreQuery(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	err := multi.LoadLatestVersion()
+	require.Nil(t, err)
+
+	k, v := []byte("wind"), []byte("blows")
+	k2, v2 := []byte("water"), []byte("flows")
+	// v3 := []byte("is cold")
+
+	cid := multi.Commit()
+
+	// Make sure we can get by name.
+	garbage := multi.getStoreByName("bad-name")
+	require.Nil(t, garbage)
 
 	// Set and commit data in one store.
 	store1 := multi.getStoreByName("store1").(types.KVStore)
@@ -458,11 +2720,114 @@ func TestMultiStoreQuery(t *testing.T) {
 	require.EqualValues(t, 0, qres.Code)
 	require.Nil(t, qres.Value)
 
-	// Test store2 data.
-	query.Data = k2
-	qres = multi.Query(query)
-	require.EqualValues(t, 0, qres.Code)
-	require.Equal(t, v2, qres.Value)
+	// Test store2 data.
+	query.Data = k2
+	qres = multi.Query(query)
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, v2, qres.Value)
+
+	// Test height above the latest committed version.
+	query.Height = ver + 1
+	qres = multi.Query(query)
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.ABCICode(), qres.Code)
+	require.EqualValues(t, sdkerrors.ErrInvalidHeight.Codespace(), qres.Codespace)
+	require.Contains(t, qres.Log, fmt.Sprintf("requested %d, latest committed %d", ver+1, ver))
+}
+
+func TestMultiStoreQueryHistorical(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	k, v1, v2 := []byte("wind"), []byte("blows"), []byte("howls")
+
+	store1 := multi.getStoreByName("store1").(types.KVStore)
+	store1.Set(k, v1)
+	cid1 := multi.Commit()
+
+	store1.Set(k, v2)
+	cid2 := multi.Commit()
+
+	prt := DefaultProofRuntime()
+
+	qres := multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: cid1.Version, Prove: true})
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, v1, qres.Value)
+	require.Equal(t, cid1.Version, qres.Height)
+	require.NoError(t, prt.VerifyValue(qres.ProofOps, cid1.Hash, "/store1/wind", v1))
+
+	qres = multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: cid2.Version, Prove: true})
+	require.EqualValues(t, 0, qres.Code)
+	require.Equal(t, v2, qres.Value)
+	require.NoError(t, prt.VerifyValue(qres.ProofOps, cid2.Hash, "/store1/wind", v2))
+
+	// a height without commit info persisted cannot be queried
+	require.NoError(t, db.Delete([]byte(fmt.Sprintf(commitInfoKeyFmt, cid1.Version))))
+	qres = multi.Query(abci.RequestQuery{Path: "/store1/key", Data: k, Height: cid1.Version})
+	require.EqualValues(t, sdkerrors.ErrInvalidRequest.ABCICode(), qres.Code)
+	require.Contains(t, qres.Log, "ensure height has not been pruned")
+}
+
+func TestMultiStoreQueryKeys(t *testing.T) {
+	db := dbm.NewMemDB()
+	multi := newMultiStoreWithMounts(db, types.PruneNothing)
+	require.NoError(t, multi.LoadLatestVersion())
+
+	k, v1, v2 := []byte("wind"), []byte("blows"), []byte("howls")
+	k2, v3 := []byte("water"), []byte("flows")
+
+	store1 := multi.getStoreByName("store1").(types.KVStore)
+	store2 := multi.getStoreByName("store2").(types.KVStore)
+	store1.Set(k, v1)
+	store2.Set(k2, v3)
+	cid1 := multi.Commit()
+
+	store1.Set(k, v2)
+	cid2 := multi.Commit()
+
+	keys := []StoreKeyQuery{
+		{StoreName: "store1", Key: k},
+		{StoreName: "store2", Key: k2},
+		{StoreName: "store2", Key: k},
+		{StoreName: "garbage", Key: k},
+	}
+
+	prt := DefaultProofRuntime()
+
+	for _, tc := range []struct {
+		cid   types.CommitID
+		value []byte
+	}{
+		{cid1, v1},
+		{cid2, v2},
+	} {
+		responses, err := multi.QueryKeys(tc.cid.Version, keys, true)
+		require.NoError(t, err)
+		require.Len(t, responses, len(keys))
+
+		require.EqualValues(t, 0, responses[0].Code)
+		require.Equal(t, tc.value, responses[0].Value)
+		require.NoError(t, prt.VerifyValue(responses[0].ProofOps, tc.cid.Hash, "/store1/wind", tc.value))
+
+		require.EqualValues(t, 0, responses[1].Code)
+		require.Equal(t, v3, responses[1].Value)
+		require.NoError(t, prt.VerifyValue(responses[1].ProofOps, tc.cid.Hash, "/store2/water", v3))
+
+		require.EqualValues(t, 0, responses[2].Code)
+		require.Nil(t, responses[2].Value)
+		require.NoError(t, prt.VerifyAbsence(responses[2].ProofOps, tc.cid.Hash, "/store2/wind"))
+
+		require.EqualValues(t, sdkerrors.ErrUnknownRequest.ABCICode(), responses[3].Code)
+	}
+
+	// latest height without proofs
+	responses, err := multi.QueryKeys(0, keys[:1], false)
+	require.NoError(t, err)
+	require.Equal(t, v2, responses[0].Value)
+	require.Nil(t, responses[0].ProofOps)
+
+	_, err = multi.QueryKeys(cid2.Version+1, keys, false)
+	require.True(t, sdkerrors.ErrInvalidHeight.Is(err))
 }
 
 func TestMultiStore_Pruning(t *testing.T) {
@@ -494,17 +2859,82 @@ func TestMultiStore_Pruning(t *testing.T) {
 
 			for _, v := range tc.saved {
 				_, err := ms.CacheMultiStoreWithVersion(v)
-				require.NoError(t, err, "expected error when loading height: %d", v)
+				require.NoError(t, err, "expected no error when loading height: %d", v)
 			}
 
 			for _, v := range tc.deleted {
 				_, err := ms.CacheMultiStoreWithVersion(v)
-				require.NoError(t, err, "expected error when loading height: %d", v)
+				require.True(t, errors.Is(err, types.ErrVersionPruned), "expected error when loading height: %d", v)
 			}
 		})
 	}
 }
 
+func TestMultiStore_PruneKeepRecent(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruneKeepRecent(2))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := int64(0); i < 10; i++ {
+		ms.Commit()
+	}
+
+	for v := int64(1); v <= 7; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.Error(t, err, "expected commit info to be pruned at height: %d", v)
+		require.False(t, ms.GetCommitKVStore(ms.keysByName["store1"]).(*iavl.Store).VersionExists(v))
+	}
+	for v := int64(8); v <= 10; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.NoError(t, err, "expected commit info at height: %d", v)
+	}
+}
+
+func TestMultiStore_PruneStaleCommitInfos(t *testing.T) {
+	db := dbm.NewMemDB()
+	ms := newMultiStoreWithMounts(db, types.NewPruneKeepRecent(2))
+	require.NoError(t, ms.LoadLatestVersion())
+
+	for i := int64(0); i < 10; i++ {
+		ms.Commit()
+	}
+
+	// simulate rows left behind for pruned heights
+	batch := db.NewBatch()
+	for v := int64(1); v <= 7; v++ {
+		setCommitInfo(batch, DefaultCommitInfoCodec, v, ms.lastCommitInfo)
+	}
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+
+	deleted, err := ms.PruneStaleCommitInfos()
+	require.NoError(t, err)
+	require.Equal(t, 7, deleted)
+
+	for v := int64(1); v <= 7; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.Error(t, err)
+	}
+	for v := int64(8); v <= 10; v++ {
+		_, err := getCommitInfo(db, DefaultCommitInfoCodec, v)
+		require.NoError(t, err)
+	}
+
+	// store data must not be touched
+	deleted, err = ms.PruneStaleCommitInfos()
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+	require.NoError(t, ms.LoadLatestVersion())
+	require.Equal(t, int64(10), ms.LastCommitID().Version)
+
+	// a read-only store doesn't delete anything
+	ms = newMultiStoreWithMounts(db, types.NewPruneKeepRecent(2))
+	ms.SetReadOnly(true)
+	require.NoError(t, ms.LoadLatestVersion())
+	_, err = ms.PruneStaleCommitInfos()
+	require.True(t, errors.Is(err, types.ErrReadOnly))
+}
+
 func TestMultiStore_PruningRestart(t *testing.T) {
 	db := dbm.NewMemDB()
 	ms := newMultiStoreWithMounts(db, types.NewPruningOptions(2, 3, 11))
@@ -535,7 +2965,7 @@ func TestMultiStore_PruningRestart(t *testing.T) {
 
 	for _, v := range pruneHeights {
 		_, err := ms.CacheMultiStoreWithVersion(v)
-		require.NoError(t, err, "expected error when loading height: %d", v)
+		require.True(t, errors.Is(err, types.ErrVersionPruned), "expected error when loading height: %d", v)
 	}
 }
 
@@ -626,6 +3056,100 @@ func TestMultistoreRestore_Errors(t *testing.T) {
 			}
 		})
 	}
+
+	err := store.Restore(1, 9, nil, nil)
+	require.EqualError(t, err, "unsupported snapshot format version 9: unknown snapshot format")
+}
+
+func TestMultistoreRestore_LegacyGob(t *testing.T) {
+	store := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(struct {
+		Store   string
+		Version int64
+	}{"iavl1", 1})
+	require.NoError(t, err)
+
+	chunks := make(chan io.ReadCloser, 1)
+	chunks <- ioutil.NopCloser(buf)
+	close(chunks)
+
+	err = store.Restore(1, snapshottypes.CurrentFormat, chunks, nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, snapshottypes.ErrUnknownFormat))
+}
+
+func TestMultistoreRestore_UnmountedStore(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	target := NewStore(dbm.NewMemDB())
+	target.MountStoreWithDB(types.NewKVStoreKey("iavl2"), types.StoreTypeIAVL, nil)
+	require.NoError(t, target.LoadLatestVersion())
+	version := uint64(source.LastCommitID().Version)
+
+	chunks, err := source.Snapshot(version, snapshottypes.CurrentFormat)
+	require.NoError(t, err)
+	err = target.Restore(version, snapshottypes.CurrentFormat, chunks, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unmounted store "iavl1"`)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+}
+
+func TestMultistoreRestore_NonIAVLStore(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	target := NewStore(dbm.NewMemDB())
+	target.MountStoreWithDB(types.NewKVStoreKey("iavl1"), types.StoreTypeDB, nil)
+	target.MountStoreWithDB(types.NewKVStoreKey("iavl2"), types.StoreTypeIAVL, nil)
+	target.MountStoreWithDB(types.NewKVStoreKey("iavl3"), types.StoreTypeIAVL, nil)
+	require.NoError(t, target.LoadLatestVersion())
+	version := uint64(source.LastCommitID().Version)
+
+	chunks, err := source.Snapshot(version, snapshottypes.CurrentFormat)
+	require.NoError(t, err)
+	err = target.Restore(version, snapshottypes.CurrentFormat, chunks, nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	require.Contains(t, err.Error(), `store "iavl1" mounted as StoreTypeDB, not StoreTypeIAVL`)
+}
+
+func TestMultistoreRestore_MissingStore(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+
+	// the transient store is skipped by snapshots, but IAVL stores must be restored
+	targetDB := dbm.NewMemDB()
+	target := NewStore(targetDB)
+	for _, name := range []string{"iavl1", "iavl2", "iavl3", "iavl4"} {
+		target.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+	}
+	target.MountStoreWithDB(types.NewTransientStoreKey("trans1"), types.StoreTypeTransient, nil)
+	require.NoError(t, target.LoadLatestVersion())
+
+	chunks, err := source.Snapshot(version, snapshottypes.CurrentFormat)
+	require.NoError(t, err)
+	err = target.Restore(version, snapshottypes.CurrentFormat, chunks, nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+	require.Contains(t, err.Error(), "snapshot at height 3 has no data for store(s) iavl4")
+
+	latest, err := getLatestVersion(targetDB)
+	require.NoError(t, err)
+	require.Zero(t, latest)
+}
+
+func TestMultistoreRestore_NonEmptyStore(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+
+	target := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	err := target.Restore(version, snapshottypes.CurrentFormat, nil, nil)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+	require.Contains(t, err.Error(), `into store "iavl1", which already contains data at version 3`)
+
+	target = newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	target.GetKVStore(target.keysByName["iavl2"]).Set([]byte("key"), []byte("value"))
+	err = target.Restore(version, snapshottypes.CurrentFormat, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `into store "iavl2", which contains uncommitted data`)
 }
 
 func TestMultistoreSnapshotRestore(t *testing.T) {
@@ -654,6 +3178,526 @@ func TestMultistoreSnapshotRestore(t *testing.T) {
 	}
 }
 
+func TestMultistoreRestoreFromSnapshotStore(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+
+	snapshotStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+	require.NoError(t, err)
+	chunks, err := source.SnapshotWithOptions(version, snapshottypes.CurrentFormat, SnapshotOptions{ChunkSize: 64})
+	require.NoError(t, err)
+	snapshot, err := snapshotStore.Save(version, snapshottypes.CurrentFormat, chunks)
+	require.NoError(t, err)
+	require.Greater(t, snapshot.Chunks, uint32(1))
+
+	targetDB := dbm.NewMemDB()
+	target := newMultiStoreWithMixedMounts(targetDB)
+	commitID, err := target.RestoreFromSnapshotStore(snapshotStore, version, snapshottypes.CurrentFormat, source.LastCommitID().Hash)
+	require.NoError(t, err)
+	require.Equal(t, source.LastCommitID(), commitID)
+	require.Equal(t, source.LastCommitID(), target.LastCommitID())
+
+	// the restored version is persisted, and both the restored and a reloaded
+	// store resume committing from the following version
+	reloaded := newMultiStoreWithMixedMounts(targetDB)
+	require.NoError(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+	require.EqualValues(t, version+1, target.Commit().Version)
+
+	// a mismatching hash removes the restored data again
+	targetDB = dbm.NewMemDB()
+	target = newMultiStoreWithMixedMounts(targetDB)
+	_, err = target.RestoreFromSnapshotStore(snapshotStore, version, snapshottypes.CurrentFormat, []byte("wrong"))
+	require.True(t, errors.Is(err, types.ErrInvalidProof))
+	require.Equal(t, types.CommitID{}, target.LastCommitID())
+	require.Nil(t, target.GetStoreByName("iavl1").(types.KVStore).Get([]byte("a")))
+	versions, err := getCommitInfoVersions(targetDB)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	latest, err := getLatestVersion(targetDB)
+	require.NoError(t, err)
+	require.Zero(t, latest)
+
+	// the store can be restored again
+	commitID, err = target.RestoreFromSnapshotStore(snapshotStore, version, snapshottypes.CurrentFormat, source.LastCommitID().Hash)
+	require.NoError(t, err)
+	require.Equal(t, source.LastCommitID(), commitID)
+
+	// only the restored IAVL stores are removed, not other stores' data
+	targetDB = dbm.NewMemDB()
+	target = NewStore(targetDB)
+	for _, name := range []string{"iavl1", "iavl2", "iavl3"} {
+		target.MountStoreWithDB(types.NewKVStoreKey(name), types.StoreTypeIAVL, nil)
+	}
+	db1 := types.NewKVStoreKey("db1")
+	target.MountStoreWithDB(db1, types.StoreTypeDB, nil)
+	require.NoError(t, target.LoadLatestVersion())
+	target.GetKVStore(db1).Set([]byte("key"), []byte("value"))
+	_, err = target.RestoreFromSnapshotStore(snapshotStore, version, snapshottypes.CurrentFormat, []byte("wrong"))
+	require.True(t, errors.Is(err, types.ErrInvalidProof))
+	require.Equal(t, types.CommitID{}, target.LastCommitID())
+	require.Nil(t, target.GetStoreByName("iavl1").(types.KVStore).Get([]byte("a")))
+	require.Equal(t, []byte("value"), target.GetKVStore(db1).Get([]byte("key")))
+
+	target = newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	_, err = target.RestoreFromSnapshotStore(snapshotStore, version+1, snapshottypes.CurrentFormat, nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrUnknownRequest))
+}
+
+// TestMultistoreSnapshotRestore_Random snapshots stores with random contents,
+// built up over several versions with random writes and deletes, in random
+// chunk sizes, and restores them into fresh stores from a snapshot store. The
+// restored stores must have the same commit hash and contents.
+func TestMultistoreSnapshotRestore_Random(t *testing.T) {
+	runs := 20
+	if testing.Short() {
+		runs = 5
+	}
+
+	for seed := int64(1); seed <= int64(runs); seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			r := rand.New(rand.NewSource(seed))
+			randBytes := func(max int) []byte {
+				bz := make([]byte, 1+r.Intn(max))
+				r.Read(bz)
+				return bz
+			}
+
+			keys := []types.StoreKey{}
+			for i := 0; i < 1+r.Intn(5); i++ {
+				keys = append(keys, types.NewKVStoreKey(fmt.Sprintf("store%d", i)))
+			}
+			newStore := func() *Store {
+				store := NewStore(dbm.NewMemDB())
+				for _, key := range keys {
+					store.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+				}
+				require.NoError(t, store.LoadLatestVersion())
+				return store
+			}
+
+			source := newStore()
+			for v := 0; v < 1+r.Intn(3); v++ {
+				for _, key := range keys {
+					kv := source.GetKVStore(key)
+					for i := r.Intn(200); i > 0; i-- {
+						kv.Set(randBytes(32), randBytes(256))
+					}
+
+					existing := [][]byte{}
+					iter := kv.Iterator(nil, nil)
+					for ; iter.Valid(); iter.Next() {
+						existing = append(existing, iter.Key())
+					}
+					require.NoError(t, iter.Close())
+					for _, k := range existing {
+						if r.Intn(4) == 0 {
+							kv.Delete(k)
+						}
+					}
+				}
+				source.Commit()
+			}
+			commitID := source.LastCommitID()
+
+			opts := SnapshotOptions{ChunkSize: uint64(64 + r.Intn(8192)), Workers: r.Intn(4)}
+			chunks, err := source.SnapshotWithOptions(uint64(commitID.Version), snapshottypes.CurrentFormat, opts)
+			require.NoError(t, err)
+			snapshotStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+			require.NoError(t, err)
+			_, err = snapshotStore.Save(uint64(commitID.Version), snapshottypes.CurrentFormat, chunks)
+			require.NoError(t, err)
+
+			target := newStore()
+			restored, err := target.RestoreFromSnapshotStore(snapshotStore, uint64(commitID.Version), snapshottypes.CurrentFormat, commitID.Hash)
+			require.NoError(t, err)
+			require.Equal(t, commitID, restored)
+
+			for _, key := range keys {
+				sourceIter := source.GetKVStore(key).Iterator(nil, nil)
+				targetIter := target.GetKVStore(key).Iterator(nil, nil)
+				for ; sourceIter.Valid(); sourceIter.Next() {
+					require.True(t, targetIter.Valid(), "store %s is missing key %X", key.Name(), sourceIter.Key())
+					require.Equal(t, sourceIter.Key(), targetIter.Key())
+					require.Equal(t, sourceIter.Value(), targetIter.Value())
+					targetIter.Next()
+				}
+				require.False(t, targetIter.Valid(), "store %s has extra keys", key.Name())
+				require.NoError(t, sourceIter.Close())
+				require.NoError(t, targetIter.Close())
+			}
+		})
+	}
+}
+
+func TestMultistoreSnapshotLatest(t *testing.T) {
+	snapshotStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+	require.NoError(t, err)
+
+	source := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	_, err = source.SnapshotLatest(snapshotStore)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+
+	source = newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	commitID, err := source.SnapshotLatest(snapshotStore)
+	require.NoError(t, err)
+	require.Equal(t, source.LastCommitID(), commitID)
+
+	snapshot, err := snapshotStore.GetLatest()
+	require.NoError(t, err)
+	require.EqualValues(t, commitID.Version, snapshot.Height)
+	require.Equal(t, snapshottypes.CurrentFormat, snapshot.Format)
+
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	restored, err := target.RestoreFromSnapshotStore(snapshotStore, snapshot.Height, snapshot.Format, commitID.Hash)
+	require.NoError(t, err)
+	require.Equal(t, commitID, restored)
+}
+
+func TestMultistoreRestoreAndVerify(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	commitID := source.LastCommitID()
+	version := commitID.Version
+
+	dir := t.TempDir()
+	db, err := dbm.NewDB(snapshotMetadataDBName, dbm.GoLevelDBBackend, dir)
+	require.NoError(t, err)
+	snapshotStore, err := snapshots.NewStore(db, dir)
+	require.NoError(t, err)
+	chunks, err := source.Snapshot(uint64(version), snapshottypes.CurrentFormat)
+	require.NoError(t, err)
+	_, err = snapshotStore.Save(uint64(version), snapshottypes.CurrentFormat, chunks)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// a mismatching hash removes the restored data again
+	targetDB := dbm.NewMemDB()
+	target := newMultiStoreWithMixedMounts(targetDB)
+	err = target.RestoreAndVerify(dir, version, []byte("wrong"))
+	require.True(t, errors.Is(err, types.ErrInvalidProof))
+	require.Equal(t, types.CommitID{}, target.LastCommitID())
+	require.Nil(t, target.GetStoreByName("iavl1").(types.KVStore).Get([]byte("a")))
+	versions, err := getCommitInfoVersions(targetDB)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	err = target.RestoreAndVerify(dir, version+1, commitID.Hash)
+	require.True(t, errors.Is(err, sdkerrors.ErrUnknownRequest))
+	err = target.RestoreAndVerify(dir, version, nil)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+
+	require.NoError(t, target.RestoreAndVerify(dir, version, commitID.Hash))
+	require.Equal(t, commitID, target.LastCommitID())
+	require.Equal(t, []byte{1}, target.GetStoreByName("iavl1").(types.KVStore).Get([]byte("a")))
+
+	// restoring into stores holding data is refused, leaving them intact
+	err = target.RestoreAndVerify(dir, version, commitID.Hash)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+	require.Equal(t, commitID, target.LastCommitID())
+}
+
+func TestMultistoreRestoreStore(t *testing.T) {
+	db := dbm.NewMemDB()
+	store := newMultiStoreWithMixedMountsAndBasicData(db)
+	commitID := store.LastCommitID()
+	version := commitID.Version
+
+	snapshotStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+	require.NoError(t, err)
+	chunks, err := store.Snapshot(uint64(version), snapshottypes.CurrentFormat)
+	require.NoError(t, err)
+	_, err = snapshotStore.Save(uint64(version), snapshottypes.CurrentFormat, chunks)
+	require.NoError(t, err)
+
+	// a truncated snapshot fails the restore and leaves the store untouched
+	truncatedStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+	require.NoError(t, err)
+	chunks, err = store.SnapshotWithOptions(uint64(version), snapshottypes.CurrentFormat, SnapshotOptions{ChunkSize: 64})
+	require.NoError(t, err)
+	first, err := ioutil.ReadAll(<-chunks)
+	require.NoError(t, err)
+	truncated := make(chan io.ReadCloser, 1)
+	truncated <- ioutil.NopCloser(bytes.NewReader(first))
+	close(truncated)
+	for chunk := range chunks {
+		chunk.Close()
+	}
+	_, err = truncatedStore.Save(uint64(version), snapshottypes.CurrentFormat, truncated)
+	require.NoError(t, err)
+
+	iavl1 := store.keysByName["iavl1"]
+	require.Error(t, store.RestoreStore(iavl1, truncatedStore, version))
+	require.Equal(t, commitID, store.LastCommitID())
+	require.NoError(t, store.VerifyIntegrity())
+	require.Equal(t, []byte{2}, store.GetStoreByName("iavl1").(types.KVStore).Get([]byte("b")))
+
+	// wipe the data of one store from the DB
+	prefixDB := dbm.NewPrefixDB(db, store.storePrefix(iavl1, store.storesParams[iavl1]))
+	require.NoError(t, deleteKVStore(commitDBStoreAdapter{Store: dbadapter.Store{DB: prefixDB}}))
+	require.Error(t, newMultiStoreWithMixedMounts(db).LoadLatestVersion())
+
+	err = store.RestoreStore(iavl1, snapshotStore, version-1)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	err = store.RestoreStore(store.keysByName["trans1"], snapshotStore, version)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	err = store.RestoreStore(types.NewKVStoreKey("unmounted"), snapshotStore, version)
+	require.True(t, errors.Is(err, sdkerrors.ErrUnknownRequest))
+
+	require.NoError(t, store.RestoreStore(iavl1, snapshotStore, version))
+	require.Equal(t, commitID, store.LastCommitID())
+	require.NoError(t, store.VerifyIntegrity())
+
+	reloaded := newMultiStoreWithMixedMounts(db)
+	require.NoError(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+	require.Equal(t, []byte{2}, reloaded.GetStoreByName("iavl1").(types.KVStore).Get([]byte("b")))
+	require.Equal(t, []byte{103}, reloaded.GetStoreByName("iavl2").(types.KVStore).Get([]byte("C")))
+	require.EqualValues(t, version+1, reloaded.Commit().Version)
+}
+
+func TestMultistoreSnapshotToWriter(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	commitID := source.LastCommitID()
+
+	var archive bytes.Buffer
+	require.NoError(t, source.SnapshotToWriter(commitID, &archive))
+
+	targetDB := dbm.NewMemDB()
+	target := newMultiStoreWithMixedMounts(targetDB)
+	restored, err := target.RestoreFromReader(bytes.NewReader(archive.Bytes()), commitID.Hash)
+	require.NoError(t, err)
+	require.Equal(t, commitID, restored)
+	reloaded := newMultiStoreWithMixedMounts(targetDB)
+	require.NoError(t, reloaded.LoadLatestVersion())
+	require.Equal(t, commitID, reloaded.LastCommitID())
+
+	// a truncated archive fails the restore before anything is persisted
+	targetDB = dbm.NewMemDB()
+	target = newMultiStoreWithMixedMounts(targetDB)
+	_, err = target.RestoreFromReader(bytes.NewReader(archive.Bytes()[:archive.Len()/2]), nil)
+	require.Error(t, err)
+	latest, err := getLatestVersion(targetDB)
+	require.NoError(t, err)
+	require.Zero(t, latest)
+
+	err = source.SnapshotToWriter(types.CommitID{Version: commitID.Version, Hash: []byte("wrong")}, &archive)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	err = source.SnapshotToWriter(types.CommitID{Version: commitID.Version + 1}, &archive)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+}
+
+func TestMultistoreSnapshot_Workers(t *testing.T) {
+	store := newMultiStoreWithGeneratedData(dbm.NewMemDB(), 5, 1000)
+	version := uint64(store.LastCommitID().Version)
+
+	snapshot := func(workers int) []byte {
+		chunks, err := store.SnapshotWithOptions(version, snapshottypes.CurrentFormat,
+			SnapshotOptions{ChunkSize: snapshotChunkSize, Workers: workers})
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		for chunk := range chunks {
+			_, err := io.Copy(buf, chunk)
+			require.NoError(t, err)
+			chunk.Close()
+		}
+		return buf.Bytes()
+	}
+
+	// the output doesn't depend on the number of stores exported concurrently
+	expected := snapshot(1)
+	for _, workers := range []int{0, 2, 5, 8} {
+		require.Equal(t, expected, snapshot(workers), "workers %d", workers)
+	}
+}
+
+func TestMultistoreSnapshotTransform(t *testing.T) {
+	source := newMultiStoreWithMixedMountsAndBasicData(dbm.NewMemDB())
+	version := uint64(source.LastCommitID().Version)
+	opts := DefaultSnapshotOptions()
+	opts.Transform = func(store string, node iavltree.ExportNode) (iavltree.ExportNode, bool) {
+		if store == "iavl1" && string(node.Key) == "b" {
+			return node, false
+		}
+		if store == "iavl2" {
+			node.Value = []byte("redacted")
+		}
+		return node, true
+	}
+
+	// transformed snapshots must be marked by their format
+	_, err := source.SnapshotWithOptions(version, snapshottypes.CurrentFormat, opts)
+	require.True(t, errors.Is(err, snapshottypes.ErrUnknownFormat))
+	_, err = source.SnapshotWithOptions(version, TransformedSnapshotFormat, DefaultSnapshotOptions())
+	require.True(t, errors.Is(err, snapshottypes.ErrUnknownFormat))
+
+	snapshotStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+	require.NoError(t, err)
+	chunks, err := source.SnapshotWithOptions(version, TransformedSnapshotFormat, opts)
+	require.NoError(t, err)
+	snapshot, err := snapshotStore.Save(version, TransformedSnapshotFormat, chunks)
+	require.NoError(t, err)
+	require.Equal(t, TransformedSnapshotFormat, snapshot.Format)
+
+	// the restored state doesn't match the source app hash, so it can't be checked
+	target := newMultiStoreWithMixedMounts(dbm.NewMemDB())
+	_, err = target.RestoreFromSnapshotStore(snapshotStore, version, TransformedSnapshotFormat, source.LastCommitID().Hash)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	require.Zero(t, target.LastCommitID().Version)
+
+	commitID, err := target.RestoreFromSnapshotStore(snapshotStore, version, TransformedSnapshotFormat, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, version, commitID.Version)
+	require.NotEqual(t, source.LastCommitID().Hash, commitID.Hash)
+
+	iavl1 := target.GetStoreByName("iavl1").(types.KVStore)
+	require.Equal(t, []byte{1}, iavl1.Get([]byte("a")))
+	require.Nil(t, iavl1.Get([]byte("b")))
+	require.Equal(t, []byte{3}, iavl1.Get([]byte("c")))
+	iavl2 := target.GetStoreByName("iavl2").(types.KVStore)
+	require.Equal(t, []byte("redacted"), iavl2.Get([]byte("A")))
+	require.Equal(t, []byte("redacted"), iavl2.Get([]byte("C")))
+	require.Nil(t, iavl2.Get([]byte("X")))
+}
+
+func TestMultistoreEstimateSnapshotSize(t *testing.T) {
+	store := newMultiStoreWithGeneratedData(dbm.NewMemDB(), 3, 1000)
+	version := store.LastCommitID().Version
+
+	_, err := store.EstimateSnapshotSize(0)
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+	_, err = store.EstimateSnapshotSize(version + 1)
+	require.True(t, errors.Is(err, types.ErrVersionDoesNotExist))
+
+	estimate, err := store.EstimateSnapshotSize(version)
+	require.NoError(t, err)
+
+	chunks, err := store.Snapshot(uint64(version), snapshottypes.CurrentFormat)
+	require.NoError(t, err)
+	zReader, err := zlib.NewReader(snapshots.NewChunkReader(chunks))
+	require.NoError(t, err)
+	actual, err := io.Copy(ioutil.Discard, zReader)
+	require.NoError(t, err)
+
+	require.InDelta(t, actual, estimate, float64(actual)/4, "actual %d, estimated %d", actual, estimate)
+}
+
+func TestMultistoreSnapshot_CompressionLevel(t *testing.T) {
+	source := newMultiStoreWithGeneratedData(dbm.NewMemDB(), 3, 1000)
+	version := uint64(source.LastCommitID().Version)
+
+	_, err := source.SnapshotWithOptions(version, snapshottypes.CurrentFormat,
+		SnapshotOptions{ChunkSize: snapshotChunkSize, CompressionLevel: zlib.BestCompression + 1})
+	require.True(t, errors.Is(err, sdkerrors.ErrInvalidRequest))
+
+	snapshot := func(level int) []byte {
+		chunks, err := source.SnapshotWithOptions(version, snapshottypes.CurrentFormat,
+			SnapshotOptions{ChunkSize: snapshotChunkSize, CompressionLevel: level})
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		for chunk := range chunks {
+			_, err := io.Copy(buf, chunk)
+			require.NoError(t, err)
+			chunk.Close()
+		}
+		return buf.Bytes()
+	}
+
+	// 0 uses the default level
+	require.Equal(t, snapshot(snapshotCompressionLevel), snapshot(0))
+
+	fast, best := snapshot(zlib.BestSpeed), snapshot(zlib.BestCompression)
+	require.Less(t, len(best), len(fast))
+
+	// streams of any level can be restored
+	for _, body := range [][]byte{fast, best} {
+		target := NewStore(dbm.NewMemDB())
+		for key := range source.stores {
+			target.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+		}
+		require.NoError(t, target.LoadLatestVersion())
+
+		chunks := make(chan io.ReadCloser, 1)
+		chunks <- ioutil.NopCloser(bytes.NewReader(body))
+		close(chunks)
+		require.NoError(t, target.Restore(version, snapshottypes.CurrentFormat, chunks, nil))
+		require.Equal(t, source.LastCommitID(), target.LastCommitID())
+	}
+}
+
+func TestMultistoreSnapshotWithContext(t *testing.T) {
+	store := newMultiStoreWithGeneratedData(dbm.NewMemDB(), 3, 1000)
+	version := uint64(store.LastCommitID().Version)
+	opts := SnapshotOptions{ChunkSize: 1024}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := store.SnapshotWithContext(ctx, version, snapshottypes.CurrentFormat, opts)
+	require.True(t, errors.Is(err, context.Canceled))
+
+	// cancelling midway aborts the stream, and saving it leaves no chunks behind
+	snapshotStore, err := snapshots.NewStore(dbm.NewMemDB(), t.TempDir())
+	require.NoError(t, err)
+	chunks, err := store.SnapshotWithContext(&cancelAfterContext{Context: context.Background(), calls: 100},
+		version, snapshottypes.CurrentFormat, opts)
+	require.NoError(t, err)
+	_, err = snapshotStore.Save(version, snapshottypes.CurrentFormat, chunks)
+	require.True(t, errors.Is(err, context.Canceled))
+	chunk, err := snapshotStore.LoadChunk(version, snapshottypes.CurrentFormat, 0)
+	require.NoError(t, err)
+	require.Nil(t, chunk)
+}
+
+// cancelAfterContext is a context that is canceled after Err has been called the given number of
+// times, to cancel a snapshot at a deterministic point.
+type cancelAfterContext struct {
+	context.Context
+	calls int32
+}
+
+func (ctx *cancelAfterContext) Err() error {
+	if atomic.AddInt32(&ctx.calls, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestMultistoreSnapshotRestore_ChunkSize(t *testing.T) {
+	source := newMultiStoreWithGeneratedData(dbm.NewMemDB(), 3, 1000)
+	target := NewStore(dbm.NewMemDB())
+	for key := range source.stores {
+		target.MountStoreWithDB(key, types.StoreTypeIAVL, nil)
+	}
+	require.NoError(t, target.LoadLatestVersion())
+	version := uint64(source.LastCommitID().Version)
+
+	_, err := source.SnapshotWithOptions(version, snapshottypes.CurrentFormat, SnapshotOptions{})
+	require.Error(t, err)
+
+	chunks, err := source.SnapshotWithOptions(version, snapshottypes.CurrentFormat, SnapshotOptions{ChunkSize: 4096})
+	require.NoError(t, err)
+
+	bodies := [][]byte{}
+	for chunk := range chunks {
+		body, err := ioutil.ReadAll(chunk)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(body), 4096)
+		bodies = append(bodies, body)
+	}
+	require.Greater(t, len(bodies), 1)
+
+	restoreChunks := make(chan io.ReadCloser, len(bodies))
+	for _, body := range bodies {
+		restoreChunks <- ioutil.NopCloser(bytes.NewReader(body))
+	}
+	close(restoreChunks)
+
+	err = target.Restore(version, snapshottypes.CurrentFormat, restoreChunks, nil)
+	require.NoError(t, err)
+	assert.Equal(t, source.LastCommitID(), target.LastCommitID())
+}
+
 func TestSetInitialVersion(t *testing.T) {
 	db := dbm.NewMemDB()
 	multi := newMultiStoreWithMounts(db, types.PruneNothing)
@@ -670,6 +3714,26 @@ func TestSetInitialVersion(t *testing.T) {
 	iavlStore, ok := ckvs.(*iavl.Store)
 	require.True(t, ok)
 	require.True(t, iavlStore.VersionExists(5))
+
+	err := multi.SetInitialVersion(10)
+	require.True(t, errors.Is(err, sdkerrors.ErrLogic))
+	require.Equal(t, int64(5), multi.initialVersion)
+	require.Error(t, newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing).SetInitialVersion(-1))
+}
+
+func TestSetInitialVersionBeforeLoad(t *testing.T) {
+	multi := newMultiStoreWithMounts(dbm.NewMemDB(), types.PruneNothing)
+	require.NoError(t, multi.SetInitialVersion(100))
+	require.NoError(t, multi.LoadLatestVersion())
+
+	multi.getStoreByName("store1").(types.KVStore).Set([]byte("a"), []byte{1})
+	cid := multi.Commit()
+	require.Equal(t, int64(100), cid.Version)
+
+	for _, si := range multi.lastCommitInfo.StoreInfos {
+		require.Equal(t, int64(100), si.CommitId.Version, si.Name)
+	}
+	require.NoError(t, multi.VerifyIntegrity())
 }
 
 func BenchmarkMultistoreSnapshot100K(b *testing.B) {
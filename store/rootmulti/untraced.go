@@ -0,0 +1,44 @@
+package rootmulti
+
+import (
+	"io"
+
+	"github.com/cosmos/cosmos-sdk/store/cachekv"
+	"github.com/cosmos/cosmos-sdk/store/types"
+)
+
+var (
+	_ types.KVStore      = untracedKVStore{}
+	_ types.CacheKVStore = untracedCacheKVStore{}
+)
+
+//----------------------------------------
+// untracedKVStore is used to hand stores excluded from tracing to a cache
+// multi-store, so that neither it nor any cache layer branched off it wraps
+// the store with a tracer.
+
+// Wrapper type for a KVStore which ignores the tracer when cache wrapped
+type untracedKVStore struct {
+	types.KVStore
+}
+
+func (us untracedKVStore) CacheWrap() types.CacheWrap {
+	return untracedCacheKVStore{cachekv.NewStore(us.KVStore)}
+}
+
+func (us untracedKVStore) CacheWrapWithTrace(_ io.Writer, _ types.TraceContext) types.CacheWrap {
+	return us.CacheWrap()
+}
+
+// Wrapper type for a cache layer of an untracedKVStore
+type untracedCacheKVStore struct {
+	types.CacheKVStore
+}
+
+func (us untracedCacheKVStore) CacheWrap() types.CacheWrap {
+	return untracedCacheKVStore{cachekv.NewStore(us.CacheKVStore)}
+}
+
+func (us untracedCacheKVStore) CacheWrapWithTrace(_ io.Writer, _ types.TraceContext) types.CacheWrap {
+	return us.CacheWrap()
+}
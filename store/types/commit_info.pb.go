@@ -82,6 +82,10 @@ func (m *CommitInfo) GetStoreInfos() []StoreInfo {
 type StoreInfo struct {
 	Name     string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
 	CommitId CommitID `protobuf:"bytes,2,opt,name=commit_id,json=commitId,proto3" json:"commit_id"`
+	// store_type is the type of the store at commit time. It is not part of the
+	// commit hash, and is unset (StoreTypeMulti) for commits written before it
+	// was introduced.
+	StoreType StoreType `protobuf:"varint,3,opt,name=store_type,json=storeType,proto3,casttype=StoreType" json:"store_type,omitempty"`
 }
 
 func (m *StoreInfo) Reset()         { *m = StoreInfo{} }
@@ -131,6 +135,13 @@ func (m *StoreInfo) GetCommitId() CommitID {
 	return CommitID{}
 }
 
+func (m *StoreInfo) GetStoreType() StoreType {
+	if m != nil {
+		return m.StoreType
+	}
+	return 0
+}
+
 // CommitID defines the committment information when a specific store is
 // committed.
 type CommitID struct {
@@ -195,26 +206,28 @@ func init() {
 }
 
 var fileDescriptor_83f4097f6265b52f = []byte{
-	// 301 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xd2, 0x4e, 0xce, 0x2f, 0xce,
-	0xcd, 0x2f, 0xd6, 0x4f, 0x4a, 0x2c, 0x4e, 0xd5, 0x2f, 0x2e, 0xc9, 0x2f, 0x4a, 0xd5, 0x2f, 0x33,
-	0x4c, 0x4a, 0x2d, 0x49, 0x34, 0xd4, 0x4f, 0xce, 0xcf, 0xcd, 0xcd, 0x2c, 0x89, 0xcf, 0xcc, 0x4b,
-	0xcb, 0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x92, 0x84, 0x28, 0xd6, 0x03, 0x29, 0xd6, 0x03,
-	0x2b, 0xd6, 0x83, 0x2a, 0x96, 0x12, 0x49, 0xcf, 0x4f, 0xcf, 0x07, 0xab, 0xd2, 0x07, 0xb1, 0x20,
-	0x1a, 0x94, 0x8a, 0xb9, 0xb8, 0x9c, 0xc1, 0xa6, 0x78, 0xe6, 0xa5, 0xe5, 0x0b, 0x49, 0x70, 0xb1,
-	0x97, 0xa5, 0x16, 0x15, 0x67, 0xe6, 0xe7, 0x49, 0x30, 0x2a, 0x30, 0x6a, 0x30, 0x07, 0xc1, 0xb8,
-	0x42, 0xde, 0x5c, 0xdc, 0x60, 0xe3, 0xc0, 0x96, 0x15, 0x4b, 0x30, 0x29, 0x30, 0x6b, 0x70, 0x1b,
-	0xa9, 0xe8, 0xe1, 0xb4, 0x4e, 0x2f, 0x18, 0xc4, 0x03, 0x19, 0xea, 0xc4, 0x72, 0xe2, 0x9e, 0x3c,
-	0x43, 0x10, 0x57, 0x31, 0x4c, 0xa0, 0x58, 0x29, 0x9d, 0x8b, 0x13, 0x2e, 0x2d, 0x24, 0xc4, 0xc5,
-	0x92, 0x97, 0x98, 0x9b, 0x0a, 0xb6, 0x90, 0x33, 0x08, 0xcc, 0x16, 0x72, 0xe3, 0xe2, 0x84, 0xf9,
-	0x2d, 0x45, 0x82, 0x49, 0x81, 0x51, 0x83, 0xdb, 0x48, 0x19, 0x8f, 0x5d, 0x50, 0x1f, 0xb8, 0x40,
-	0xad, 0xe2, 0x80, 0xe8, 0xf5, 0x4c, 0x51, 0xb2, 0xe3, 0xe2, 0x80, 0xc9, 0xe1, 0xf1, 0x9b, 0x10,
-	0x17, 0x4b, 0x46, 0x62, 0x71, 0x06, 0xd8, 0x22, 0x9e, 0x20, 0x30, 0xdb, 0x8a, 0x65, 0xc6, 0x02,
-	0x79, 0x06, 0x27, 0xa7, 0x13, 0x8f, 0xe4, 0x18, 0x2f, 0x3c, 0x92, 0x63, 0x7c, 0xf0, 0x48, 0x8e,
-	0x71, 0xc2, 0x63, 0x39, 0x86, 0x0b, 0x8f, 0xe5, 0x18, 0x6e, 0x3c, 0x96, 0x63, 0x88, 0xd2, 0x48,
-	0xcf, 0x2c, 0xc9, 0x28, 0x4d, 0xd2, 0x4b, 0xce, 0xcf, 0xd5, 0x87, 0x46, 0x10, 0x84, 0xd2, 0x2d,
-	0x4e, 0xc9, 0x86, 0x46, 0x53, 0x49, 0x65, 0x41, 0x6a, 0x71, 0x12, 0x1b, 0x38, 0xa0, 0x8d, 0x01,
-	0x01, 0x00, 0x00, 0xff, 0xff, 0x00, 0xc0, 0xc7, 0x12, 0xc8, 0x01, 0x00, 0x00,
+	// 329 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x91, 0xb1, 0x4e, 0xfa, 0x50,
+	0x14, 0xc6, 0x7b, 0xa1, 0xff, 0xbf, 0xf4, 0xa0, 0xcb, 0x8d, 0x43, 0x75, 0x28, 0x0d, 0x3a, 0x34,
+	0x51, 0x6f, 0x03, 0x6e, 0x0e, 0x0e, 0xd5, 0x98, 0x10, 0xb7, 0xea, 0xe4, 0x42, 0x5a, 0xb8, 0x40,
+	0x63, 0xda, 0x43, 0x38, 0x95, 0x84, 0xb7, 0x70, 0x31, 0x71, 0xf4, 0x71, 0x18, 0x19, 0x9d, 0x88,
+	0x81, 0xb7, 0x70, 0x32, 0xbd, 0xb7, 0x75, 0x93, 0xa9, 0xdf, 0x69, 0xbf, 0xf3, 0xfd, 0xce, 0xe9,
+	0x81, 0xb3, 0x01, 0x52, 0x8a, 0xe4, 0xc7, 0x11, 0x49, 0x9f, 0x72, 0x9c, 0x49, 0x7f, 0xde, 0x89,
+	0x65, 0x1e, 0x75, 0xfc, 0x01, 0xa6, 0x69, 0x92, 0xf7, 0x93, 0x6c, 0x84, 0x62, 0x3a, 0xc3, 0x1c,
+	0xf9, 0x91, 0x36, 0x8b, 0xc2, 0x2c, 0x94, 0x59, 0x94, 0xe6, 0xe3, 0xc3, 0x31, 0x8e, 0x51, 0xb9,
+	0xfc, 0x42, 0xe9, 0x86, 0x36, 0x01, 0xdc, 0xa8, 0x94, 0x5e, 0x36, 0x42, 0x6e, 0xc3, 0xde, 0x5c,
+	0xce, 0x28, 0xc1, 0xcc, 0x66, 0x2e, 0xf3, 0xea, 0x61, 0x55, 0xf2, 0x7b, 0x68, 0xaa, 0x38, 0x05,
+	0x23, 0xbb, 0xe6, 0xd6, 0xbd, 0x66, 0xf7, 0x54, 0xfc, 0x89, 0x13, 0x0f, 0x45, 0x55, 0x84, 0x06,
+	0xe6, 0x72, 0xdd, 0x32, 0x42, 0xa0, 0xea, 0x05, 0xb5, 0xdf, 0x18, 0x58, 0xbf, 0xdf, 0x39, 0x07,
+	0x33, 0x8b, 0x52, 0xa9, 0x88, 0x56, 0xa8, 0x34, 0xbf, 0x03, 0xab, 0x5a, 0x6e, 0x68, 0xd7, 0x5c,
+	0xe6, 0x35, 0xbb, 0x27, 0x3b, 0x60, 0xe5, 0x0a, 0xb7, 0x25, 0xab, 0xa1, 0x7b, 0x7b, 0x43, 0x7e,
+	0x0e, 0x9a, 0xdb, 0xcf, 0x17, 0x53, 0x69, 0xd7, 0x5d, 0xe6, 0xfd, 0x0b, 0x0e, 0xbe, 0xd7, 0x2d,
+	0x8d, 0x7f, 0x5c, 0x4c, 0x65, 0x68, 0x51, 0x25, 0xdb, 0xd7, 0xd0, 0xa8, 0x92, 0x76, 0xfc, 0x0a,
+	0x0e, 0xe6, 0x24, 0xa2, 0x89, 0x1a, 0x6b, 0x3f, 0x54, 0xfa, 0xca, 0x7c, 0xff, 0x68, 0x19, 0x41,
+	0xb0, 0xdc, 0x38, 0x6c, 0xb5, 0x71, 0xd8, 0xd7, 0xc6, 0x61, 0xaf, 0x5b, 0xc7, 0x58, 0x6d, 0x1d,
+	0xe3, 0x73, 0xeb, 0x18, 0x4f, 0xde, 0x38, 0xc9, 0x27, 0x2f, 0xb1, 0x18, 0x60, 0xea, 0x97, 0xf7,
+	0xd4, 0x8f, 0x0b, 0x1a, 0x3e, 0x97, 0x57, 0x2d, 0x46, 0xa4, 0xf8, 0xbf, 0xba, 0xcb, 0xe5, 0xcf,
+	0x00, 0xe9, 0x8f, 0x9d, 0xf4, 0xf7, 0x01, 0x00, 0x00,
 }
 
 func (m *CommitInfo) Marshal() (dAtA []byte, err error) {
@@ -279,6 +292,11 @@ func (m *StoreInfo) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.StoreType != 0 {
+		i = encodeVarintCommitInfo(dAtA, i, uint64(m.StoreType))
+		i--
+		dAtA[i] = 0x18
+	}
 	{
 		size, err := m.CommitId.MarshalToSizedBuffer(dAtA[:i])
 		if err != nil {
@@ -375,6 +393,9 @@ func (m *StoreInfo) Size() (n int) {
 	}
 	l = m.CommitId.Size()
 	n += 1 + l + sovCommitInfo(uint64(l))
+	if m.StoreType != 0 {
+		n += 1 + sovCommitInfo(uint64(m.StoreType))
+	}
 	return n
 }
 
@@ -600,6 +621,25 @@ func (m *StoreInfo) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StoreType", wireType)
+			}
+			m.StoreType = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowCommitInfo
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.StoreType |= StoreType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipCommitInfo(dAtA[iNdEx:])
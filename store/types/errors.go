@@ -7,5 +7,10 @@ import (
 const StoreCodespace = "store"
 
 var (
-	ErrInvalidProof = sdkerrors.Register(StoreCodespace, 2, "invalid proof")
+	ErrInvalidProof        = sdkerrors.Register(StoreCodespace, 2, "invalid proof")
+	ErrVersionPruned       = sdkerrors.Register(StoreCodespace, 3, "version has been pruned")
+	ErrVersionDoesNotExist = sdkerrors.Register(StoreCodespace, 4, "version does not exist")
+	ErrReadOnly            = sdkerrors.Register(StoreCodespace, 5, "store is read-only")
+	ErrStoreClosed         = sdkerrors.Register(StoreCodespace, 6, "store is closed")
+	ErrCorruptCommitInfo   = sdkerrors.Register(StoreCodespace, 7, "corrupt commit info")
 )
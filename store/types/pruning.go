@@ -60,6 +60,12 @@ func (po PruningOptions) Validate() error {
 	return nil
 }
 
+// NewPruneKeepRecent returns a pruning strategy where only the latest keepRecent
+// heights are kept on disk, and every older height is pruned on each commit.
+func NewPruneKeepRecent(keepRecent uint64) PruningOptions {
+	return NewPruningOptions(keepRecent, 0, 1)
+}
+
 func NewPruningOptionsFromString(strategy string) PruningOptions {
 	switch strategy {
 	case PruningOptionEverything:
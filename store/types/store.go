@@ -59,10 +59,16 @@ type UpgradeInfo struct {
 
 // StoreRename defines a name change of a sub-store.
 // All data previously under a PrefixStore with OldKey will be copied
-// to a PrefixStore with NewKey, then deleted from OldKey store.
+// to a PrefixStore with NewKey, then deleted from OldKey store once the
+// copy has been committed.
+//
+// OldStoreType optionally sets the type the store had under OldKey, allowing a
+// store to change its type (e.g. from StoreTypeDB to StoreTypeIAVL) as it is
+// renamed. If nil, the old store is assumed to have the same type as the new one.
 type StoreRename struct {
-	OldKey string `json:"old_key"`
-	NewKey string `json:"new_key"`
+	OldKey       string     `json:"old_key"`
+	NewKey       string     `json:"new_key"`
+	OldStoreType *StoreType `json:"old_store_type,omitempty"`
 }
 
 // IsDeleted returns true if the given key should be added
@@ -101,6 +107,21 @@ func (s *StoreUpgrades) RenamedFrom(key string) string {
 
 }
 
+// RenamedFromStoreType returns the store type of the store the given key was
+// renamed from, and whether it was given. Returns false if the key was not
+// renamed or no old store type was given.
+func (s *StoreUpgrades) RenamedFromStoreType(key string) (StoreType, bool) {
+	if s == nil {
+		return 0, false
+	}
+	for _, re := range s.Renamed {
+		if re.NewKey == key && re.OldStoreType != nil {
+			return *re.OldStoreType, true
+		}
+	}
+	return 0, false
+}
+
 type MultiStore interface {
 	Store
 
@@ -411,6 +432,25 @@ type MultiStorePersistentCache interface {
 	Reset()
 }
 
+// MultiStorePersistentCacheWithStats is a MultiStorePersistentCache that keeps
+// statistics of its per-store caches, e.g. to size the caches.
+type MultiStorePersistentCacheWithStats interface {
+	MultiStorePersistentCache
+
+	// Return the statistics of the cache of each store, by store name.
+	Stats() map[string]PersistentCacheStats
+}
+
+// PersistentCacheStats are the statistics of the inter-block cache of a store.
+// Counters are cumulative since the cache was created.
+type PersistentCacheStats struct {
+	Entries   int   // number of cached entries
+	Bytes     int64 // approximate size of the cached keys and values
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
 // StoreWithInitialVersion is a store that can have an arbitrary initial
 // version.
 type StoreWithInitialVersion interface {
@@ -31,7 +31,7 @@ func TestStoreUpgrades(t *testing.T) {
 		"simple matches": {
 			upgrades: &StoreUpgrades{
 				Deleted: []string{"foo"},
-				Renamed: []StoreRename{{"bar", "baz"}},
+				Renamed: []StoreRename{{OldKey: "bar", NewKey: "baz"}},
 			},
 			expectDelete: []toDelete{{"foo", true}, {"bar", false}, {"baz", false}},
 			expectRename: []toRename{{"foo", ""}, {"bar", ""}, {"baz", "bar"}},
@@ -39,7 +39,12 @@ func TestStoreUpgrades(t *testing.T) {
 		"many data points": {
 			upgrades: &StoreUpgrades{
 				Deleted: []string{"one", "two", "three", "four", "five"},
-				Renamed: []StoreRename{{"old", "new"}, {"white", "blue"}, {"black", "orange"}, {"fun", "boring"}},
+				Renamed: []StoreRename{
+					{OldKey: "old", NewKey: "new"},
+					{OldKey: "white", NewKey: "blue"},
+					{OldKey: "black", NewKey: "orange"},
+					{OldKey: "fun", NewKey: "boring"},
+				},
 			},
 			expectDelete: []toDelete{{"four", true}, {"six", false}, {"baz", false}},
 			expectRename: []toRename{{"white", ""}, {"blue", "white"}, {"boring", "fun"}, {"missing", ""}},
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	yaml "gopkg.in/yaml.v2"
@@ -613,21 +614,24 @@ const (
 // prefix based on the key type provided for a given PublicKey.
 // TODO: Remove Bech32ifyPubKey and all usages (cosmos/cosmos-sdk/issues/#7357)
 func Bech32ifyPubKey(pkt Bech32PubKeyType, pubkey cryptotypes.PubKey) (string, error) {
-	var bech32Prefix string
-
-	switch pkt {
-	case Bech32PubKeyTypeAccPub:
-		bech32Prefix = GetConfig().GetBech32AccountPubPrefix()
-
-	case Bech32PubKeyTypeValPub:
-		bech32Prefix = GetConfig().GetBech32ValidatorPubPrefix()
+	bech32Prefix, err := bech32PubPrefix(pkt)
+	if err != nil {
+		return "", err
+	}
 
-	case Bech32PubKeyTypeConsPub:
-		bech32Prefix = GetConfig().GetBech32ConsensusPubPrefix()
+	return Bech32ifyPubKeyWithPrefix(bech32Prefix, pubkey)
+}
 
+// Bech32ifyPubKeyWithPrefix returns a Bech32 encoded string of a PublicKey
+// with the given prefix instead of one taken from the global config, e.g. to
+// encode a PublicKey for another chain. It returns an error if the prefix is
+// empty.
+func Bech32ifyPubKeyWithPrefix(prefix string, pubkey cryptotypes.PubKey) (string, error) {
+	if len(prefix) == 0 {
+		return "", errors.New("prefix cannot be empty")
 	}
 
-	return bech32.ConvertAndEncode(bech32Prefix, legacy.Cdc.MustMarshalBinaryBare(pubkey))
+	return bech32.ConvertAndEncode(prefix, legacy.Cdc.MustMarshalBinaryBare(pubkey))
 }
 
 // MustBech32ifyPubKey calls Bech32ifyPubKey except it panics on error.
@@ -643,21 +647,28 @@ func MustBech32ifyPubKey(pkt Bech32PubKeyType, pubkey cryptotypes.PubKey) string
 // GetPubKeyFromBech32 returns a PublicKey from a bech32-encoded PublicKey with
 // a given key type.
 func GetPubKeyFromBech32(pkt Bech32PubKeyType, pubkeyStr string) (cryptotypes.PubKey, error) {
-	var bech32Prefix string
-
-	switch pkt {
-	case Bech32PubKeyTypeAccPub:
-		bech32Prefix = GetConfig().GetBech32AccountPubPrefix()
+	bech32Prefix, err := bech32PubPrefix(pkt)
+	if err != nil {
+		return nil, err
+	}
 
-	case Bech32PubKeyTypeValPub:
-		bech32Prefix = GetConfig().GetBech32ValidatorPubPrefix()
+	bz, err := getPubKeyBytesFromBech32(pkt, pubkeyStr, bech32Prefix)
+	if err != nil {
+		return nil, err
+	}
 
-	case Bech32PubKeyTypeConsPub:
-		bech32Prefix = GetConfig().GetBech32ConsensusPubPrefix()
+	return legacy.PubKeyFromBytes(bz)
+}
 
+// GetPubKeyFromBech32WithPrefix returns a PublicKey from a bech32-encoded
+// PublicKey with the given prefix instead of one taken from the global config.
+// It is the inverse of Bech32ifyPubKeyWithPrefix.
+func GetPubKeyFromBech32WithPrefix(prefix, pubkeyStr string) (cryptotypes.PubKey, error) {
+	if len(prefix) == 0 {
+		return nil, errors.New("prefix cannot be empty")
 	}
 
-	bz, err := GetFromBech32(pubkeyStr, bech32Prefix)
+	bz, err := GetFromBech32(pubkeyStr, prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -675,6 +686,146 @@ func MustGetPubKeyFromBech32(pkt Bech32PubKeyType, pubkeyStr string) cryptotypes
 	return res
 }
 
+// MarshalAddress returns a Bech32 encoded string of the given raw address
+// bytes, using the address prefix that corresponds to the key type provided
+// (i.e. accpub maps to the account address prefix, valpub to the validator
+// operator address prefix and conspub to the consensus node address prefix).
+func MarshalAddress(pkt Bech32PubKeyType, addr []byte) (string, error) {
+	bech32Prefix, err := bech32AddrPrefix(pkt)
+	if err != nil {
+		return "", err
+	}
+
+	return bech32.ConvertAndEncode(bech32Prefix, addr)
+}
+
+// UnmarshalAddress returns the raw address bytes from a Bech32 encoded address
+// string, with a prefix determined by the given key type. It is the inverse of
+// MarshalAddress.
+func UnmarshalAddress(pkt Bech32PubKeyType, addrStr string) ([]byte, error) {
+	bech32Prefix, err := bech32AddrPrefix(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetFromBech32(addrStr, bech32Prefix)
+}
+
+// bech32AddrPrefix returns the configured address prefix for a key type.
+func bech32AddrPrefix(pkt Bech32PubKeyType) (string, error) {
+	switch pkt {
+	case Bech32PubKeyTypeAccPub:
+		return GetConfig().GetBech32AccountAddrPrefix(), nil
+
+	case Bech32PubKeyTypeValPub:
+		return GetConfig().GetBech32ValidatorAddrPrefix(), nil
+
+	case Bech32PubKeyTypeConsPub:
+		return GetConfig().GetBech32ConsensusAddrPrefix(), nil
+
+	}
+
+	return "", fmt.Errorf("unknown pubkey type: %s", pkt)
+}
+
+// GetPubKeysFromBech32 decodes a slice of bech32-encoded PublicKeys with a
+// given key type. The prefix is resolved once for the whole slice. If any
+// string fails to decode, a *Bech32PubKeysError is returned reporting every
+// failed index; the returned slice then holds nil at those indices.
+func GetPubKeysFromBech32(pkt Bech32PubKeyType, pubkeyStrs []string) ([]cryptotypes.PubKey, error) {
+	bech32Prefix, err := bech32PubPrefix(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkeys := make([]cryptotypes.PubKey, len(pubkeyStrs))
+	failed := make(map[int]error)
+
+	for i, pubkeyStr := range pubkeyStrs {
+		bz, err := getPubKeyBytesFromBech32(pkt, pubkeyStr, bech32Prefix)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		pk, err := legacy.PubKeyFromBytes(bz)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		pubkeys[i] = pk
+	}
+
+	if len(failed) > 0 {
+		return pubkeys, &Bech32PubKeysError{Errors: failed}
+	}
+
+	return pubkeys, nil
+}
+
+// Bech32PubKeysError is returned by GetPubKeysFromBech32 and maps the index of
+// every PublicKey string that failed to decode to its error.
+type Bech32PubKeysError struct {
+	Errors map[int]error
+}
+
+// Error implements the error interface, listing failures by ascending index.
+func (e *Bech32PubKeysError) Error() string {
+	indices := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	msgs := make([]string, len(indices))
+	for j, i := range indices {
+		msgs[j] = fmt.Sprintf("%d: %v", i, e.Errors[i])
+	}
+
+	return fmt.Sprintf("failed to decode %d pubkey(s): %s", len(indices), strings.Join(msgs, "; "))
+}
+
+// getPubKeyBytesFromBech32 decodes a bech32-encoded PublicKey like
+// GetFromBech32, but reports a prefix mismatch in terms of the requested key
+// type so that e.g. a consensus key passed where an account key is expected
+// is easy to spot.
+func getPubKeyBytesFromBech32(pkt Bech32PubKeyType, pubkeyStr, prefix string) ([]byte, error) {
+	if len(pubkeyStr) == 0 {
+		return nil, errors.New("decoding Bech32 pubkey failed: must provide a pubkey")
+	}
+
+	hrp, bz, err := bech32.DecodeAndConvert(pubkeyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hrp != prefix {
+		return nil, fmt.Errorf("invalid Bech32 prefix for %s pubkey; expected %s, got %s", pkt, prefix, hrp)
+	}
+
+	return bz, nil
+}
+
+// bech32PubPrefix returns the configured PublicKey prefix for a key type. An
+// unknown key type is rejected rather than mapped to an empty prefix, which
+// would otherwise produce a valid-looking but meaningless bech32 string.
+func bech32PubPrefix(pkt Bech32PubKeyType) (string, error) {
+	switch pkt {
+	case Bech32PubKeyTypeAccPub:
+		return GetConfig().GetBech32AccountPubPrefix(), nil
+
+	case Bech32PubKeyTypeValPub:
+		return GetConfig().GetBech32ValidatorPubPrefix(), nil
+
+	case Bech32PubKeyTypeConsPub:
+		return GetConfig().GetBech32ConsensusPubPrefix(), nil
+
+	}
+
+	return "", fmt.Errorf("unknown pubkey type: %s", pkt)
+}
+
 // GetFromBech32 decodes a bytestring from a Bech32 encoded string.
 func GetFromBech32(bech32str, prefix string) ([]byte, error) {
 	if len(bech32str) == 0 {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -520,3 +521,146 @@ func (s *addressTestSuite) TestGetFromBech32() {
 	s.Require().Error(err)
 	s.Require().Equal("invalid Bech32 prefix; expected x, got cosmos", err.Error())
 }
+
+func (s *addressTestSuite) TestMarshalAddress() {
+	addr := secp256k1.GenPrivKey().PubKey().Address()
+
+	accStr, err := types.MarshalAddress(types.Bech32PubKeyTypeAccPub, addr)
+	s.Require().NoError(err)
+	s.Require().Equal(types.AccAddress(addr).String(), accStr)
+
+	valStr, err := types.MarshalAddress(types.Bech32PubKeyTypeValPub, addr)
+	s.Require().NoError(err)
+	s.Require().Equal(types.ValAddress(addr).String(), valStr)
+
+	consStr, err := types.MarshalAddress(types.Bech32PubKeyTypeConsPub, addr)
+	s.Require().NoError(err)
+	s.Require().Equal(types.ConsAddress(addr).String(), consStr)
+
+	bz, err := types.UnmarshalAddress(types.Bech32PubKeyTypeValPub, valStr)
+	s.Require().NoError(err)
+	s.Require().Equal(addr.Bytes(), bz)
+
+	_, err = types.UnmarshalAddress(types.Bech32PubKeyTypeAccPub, valStr)
+	s.Require().Error(err)
+
+	_, err = types.MarshalAddress("unknown", addr)
+	s.Require().Error(err)
+	_, err = types.UnmarshalAddress("unknown", accStr)
+	s.Require().Error(err)
+}
+
+func (s *addressTestSuite) TestGetPubKeysFromBech32() {
+	pk1 := ed25519.GenPrivKey().PubKey()
+	pk2 := secp256k1.GenPrivKey().PubKey()
+	strs := []string{
+		types.MustBech32ifyPubKey(types.Bech32PubKeyTypeConsPub, pk1),
+		types.MustBech32ifyPubKey(types.Bech32PubKeyTypeConsPub, pk2),
+	}
+
+	pks, err := types.GetPubKeysFromBech32(types.Bech32PubKeyTypeConsPub, strs)
+	s.Require().NoError(err)
+	s.Require().Len(pks, 2)
+	s.Require().True(pk1.Equals(pks[0]))
+	s.Require().True(pk2.Equals(pks[1]))
+
+	strs = append(strs, "", types.MustBech32ifyPubKey(types.Bech32PubKeyTypeAccPub, pk1))
+	pks, err = types.GetPubKeysFromBech32(types.Bech32PubKeyTypeConsPub, strs)
+	s.Require().Error(err)
+	s.Require().Len(pks, 4)
+	s.Require().True(pk1.Equals(pks[0]))
+	s.Require().Nil(pks[2])
+	s.Require().Nil(pks[3])
+
+	pksErr, ok := err.(*types.Bech32PubKeysError)
+	s.Require().True(ok)
+	s.Require().Len(pksErr.Errors, 2)
+	s.Require().Contains(pksErr.Errors, 2)
+	s.Require().Contains(pksErr.Errors, 3)
+	s.Require().Contains(err.Error(), "failed to decode 2 pubkey(s)")
+}
+
+func (s *addressTestSuite) TestGetPubKeyFromBech32WrongType() {
+	pk := ed25519.GenPrivKey().PubKey()
+	consPub := types.MustBech32ifyPubKey(types.Bech32PubKeyTypeConsPub, pk)
+
+	_, err := types.GetPubKeyFromBech32(types.Bech32PubKeyTypeAccPub, consPub)
+	s.Require().Error(err)
+	s.Require().Equal(fmt.Sprintf(
+		"invalid Bech32 prefix for accpub pubkey; expected %s, got %s",
+		types.GetConfig().GetBech32AccountPubPrefix(), types.GetConfig().GetBech32ConsensusPubPrefix(),
+	), err.Error())
+
+	_, err = types.GetPubKeyFromBech32(types.Bech32PubKeyTypeAccPub, "")
+	s.Require().Error(err)
+}
+
+func (s *addressTestSuite) TestUnknownBech32PubKeyType() {
+	pk := ed25519.GenPrivKey().PubKey()
+
+	_, err := types.Bech32ifyPubKey("unknown", pk)
+	s.Require().EqualError(err, "unknown pubkey type: unknown")
+	s.Require().PanicsWithError("unknown pubkey type: unknown", func() {
+		types.MustBech32ifyPubKey("unknown", pk)
+	})
+
+	accPub := types.MustBech32ifyPubKey(types.Bech32PubKeyTypeAccPub, pk)
+	_, err = types.GetPubKeyFromBech32("unknown", accPub)
+	s.Require().EqualError(err, "unknown pubkey type: unknown")
+	_, err = types.GetPubKeysFromBech32("unknown", []string{accPub})
+	s.Require().EqualError(err, "unknown pubkey type: unknown")
+}
+
+func (s *addressTestSuite) TestBech32ifyPubKeyWithPrefix() {
+	pk := ed25519.GenPrivKey().PubKey()
+
+	pubStr, err := types.Bech32ifyPubKeyWithPrefix("otherpub", pk)
+	s.Require().NoError(err)
+	s.Require().True(strings.HasPrefix(pubStr, "otherpub1"))
+
+	res, err := types.GetPubKeyFromBech32WithPrefix("otherpub", pubStr)
+	s.Require().NoError(err)
+	s.Require().Equal(pk, res)
+
+	// the global config prefix is neither used nor accepted
+	accPub := types.MustBech32ifyPubKey(types.Bech32PubKeyTypeAccPub, pk)
+	s.Require().NotEqual(accPub, pubStr)
+	_, err = types.GetPubKeyFromBech32WithPrefix("otherpub", accPub)
+	s.Require().Error(err)
+
+	withConfigPrefix, err := types.Bech32ifyPubKeyWithPrefix(types.GetConfig().GetBech32AccountPubPrefix(), pk)
+	s.Require().NoError(err)
+	s.Require().Equal(accPub, withConfigPrefix)
+
+	_, err = types.Bech32ifyPubKeyWithPrefix("", pk)
+	s.Require().EqualError(err, "prefix cannot be empty")
+	_, err = types.GetPubKeyFromBech32WithPrefix("", pubStr)
+	s.Require().EqualError(err, "prefix cannot be empty")
+}
+
+func (s *addressTestSuite) TestBech32PubKeyConcurrentUse() {
+	pks := make([]cryptotypes.PubKey, 8)
+	for i := range pks {
+		pks[i] = ed25519.GenPrivKey().PubKey()
+	}
+
+	var wg sync.WaitGroup
+	for _, pk := range pks {
+		wg.Add(1)
+		go func(pk cryptotypes.PubKey) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, pkt := range []types.Bech32PubKeyType{
+					types.Bech32PubKeyTypeAccPub, types.Bech32PubKeyTypeValPub, types.Bech32PubKeyTypeConsPub,
+				} {
+					str, err := types.Bech32ifyPubKey(pkt, pk)
+					s.Assert().NoError(err)
+					res, err := types.GetPubKeyFromBech32(pkt, str)
+					s.Assert().NoError(err)
+					s.Assert().Equal(pk, res)
+				}
+			}
+		}(pk)
+	}
+	wg.Wait()
+}
@@ -12,6 +12,9 @@ const DefaultKeyringServiceName = "cosmos"
 
 // Config is the structure that holds the SDK configuration parameters.
 // This could be used to initialize certain configuration parameters for the SDK.
+// It is safe for concurrent use. Every getter returns the value at the time of
+// the call though, so code that may run while the config is still being set up
+// should obtain it with GetSealedConfig to be guaranteed the final values.
 type Config struct {
 	fullFundraiserPath  string
 	bech32AddressPrefix map[string]string
@@ -66,62 +69,73 @@ func GetSealedConfig(ctx context.Context) (*Config, error) {
 	}
 }
 
-func (config *Config) assertNotSealed() {
+// update applies a change to the config while holding its lock, so that it
+// can't race with concurrent reads. It panics if the config is sealed.
+func (config *Config) update(fn func()) {
 	config.mtx.Lock()
 	defer config.mtx.Unlock()
 
 	if config.sealed {
 		panic("Config is sealed")
 	}
+
+	fn()
 }
 
 // SetBech32PrefixForAccount builds the Config with Bech32 addressPrefix and publKeyPrefix for accounts
 // and returns the config instance
 func (config *Config) SetBech32PrefixForAccount(addressPrefix, pubKeyPrefix string) {
-	config.assertNotSealed()
-	config.bech32AddressPrefix["account_addr"] = addressPrefix
-	config.bech32AddressPrefix["account_pub"] = pubKeyPrefix
+	config.update(func() {
+		config.bech32AddressPrefix["account_addr"] = addressPrefix
+		config.bech32AddressPrefix["account_pub"] = pubKeyPrefix
+	})
 }
 
 // SetBech32PrefixForValidator builds the Config with Bech32 addressPrefix and publKeyPrefix for validators
 //  and returns the config instance
 func (config *Config) SetBech32PrefixForValidator(addressPrefix, pubKeyPrefix string) {
-	config.assertNotSealed()
-	config.bech32AddressPrefix["validator_addr"] = addressPrefix
-	config.bech32AddressPrefix["validator_pub"] = pubKeyPrefix
+	config.update(func() {
+		config.bech32AddressPrefix["validator_addr"] = addressPrefix
+		config.bech32AddressPrefix["validator_pub"] = pubKeyPrefix
+	})
 }
 
 // SetBech32PrefixForConsensusNode builds the Config with Bech32 addressPrefix and publKeyPrefix for consensus nodes
 // and returns the config instance
 func (config *Config) SetBech32PrefixForConsensusNode(addressPrefix, pubKeyPrefix string) {
-	config.assertNotSealed()
-	config.bech32AddressPrefix["consensus_addr"] = addressPrefix
-	config.bech32AddressPrefix["consensus_pub"] = pubKeyPrefix
+	config.update(func() {
+		config.bech32AddressPrefix["consensus_addr"] = addressPrefix
+		config.bech32AddressPrefix["consensus_pub"] = pubKeyPrefix
+	})
 }
 
 // SetTxEncoder builds the Config with TxEncoder used to marshal StdTx to bytes
 func (config *Config) SetTxEncoder(encoder TxEncoder) {
-	config.assertNotSealed()
-	config.txEncoder = encoder
+	config.update(func() {
+		config.txEncoder = encoder
+	})
 }
 
 // SetAddressVerifier builds the Config with the provided function for verifying that addresses
 // have the correct format
 func (config *Config) SetAddressVerifier(addressVerifier func([]byte) error) {
-	config.assertNotSealed()
-	config.addressVerifier = addressVerifier
+	config.update(func() {
+		config.addressVerifier = addressVerifier
+	})
 }
 
 // Set the BIP-0044 CoinType code on the config
 func (config *Config) SetCoinType(coinType uint32) {
-	config.assertNotSealed()
-	config.coinType = coinType
+	config.update(func() {
+		config.coinType = coinType
+	})
 }
 
 // Set the FullFundraiserPath (BIP44Prefix) on the config
 func (config *Config) SetFullFundraiserPath(fullFundraiserPath string) {
-	config.assertNotSealed()
-	config.fullFundraiserPath = fullFundraiserPath
+	config.update(func() {
+		config.fullFundraiserPath = fullFundraiserPath
+	})
 }
 
 // Seal seals the config such that the config state could not be modified further
@@ -143,51 +157,81 @@ func (config *Config) Seal() *Config {
 
 // GetBech32AccountAddrPrefix returns the Bech32 prefix for account address
 func (config *Config) GetBech32AccountAddrPrefix() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.bech32AddressPrefix["account_addr"]
 }
 
 // GetBech32ValidatorAddrPrefix returns the Bech32 prefix for validator address
 func (config *Config) GetBech32ValidatorAddrPrefix() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.bech32AddressPrefix["validator_addr"]
 }
 
 // GetBech32ConsensusAddrPrefix returns the Bech32 prefix for consensus node address
 func (config *Config) GetBech32ConsensusAddrPrefix() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.bech32AddressPrefix["consensus_addr"]
 }
 
 // GetBech32AccountPubPrefix returns the Bech32 prefix for account public key
 func (config *Config) GetBech32AccountPubPrefix() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.bech32AddressPrefix["account_pub"]
 }
 
 // GetBech32ValidatorPubPrefix returns the Bech32 prefix for validator public key
 func (config *Config) GetBech32ValidatorPubPrefix() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.bech32AddressPrefix["validator_pub"]
 }
 
 // GetBech32ConsensusPubPrefix returns the Bech32 prefix for consensus node public key
 func (config *Config) GetBech32ConsensusPubPrefix() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.bech32AddressPrefix["consensus_pub"]
 }
 
 // GetTxEncoder return function to encode transactions
 func (config *Config) GetTxEncoder() TxEncoder {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.txEncoder
 }
 
 // GetAddressVerifier returns the function to verify that addresses have the correct format
 func (config *Config) GetAddressVerifier() func([]byte) error {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.addressVerifier
 }
 
 // GetCoinType returns the BIP-0044 CoinType code on the config.
 func (config *Config) GetCoinType() uint32 {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.coinType
 }
 
 // GetFullFundraiserPath returns the BIP44Prefix.
 func (config *Config) GetFullFundraiserPath() string {
+	config.mtx.RLock()
+	defer config.mtx.RUnlock()
+
 	return config.fullFundraiserPath
 }
 
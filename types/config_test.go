@@ -2,6 +2,7 @@ package types_test
 
 import (
 	"errors"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -53,6 +54,36 @@ func (s *configTestSuite) TestConfig_SetFullFundraiserPath() {
 	s.Require().Panics(func() { config.SetFullFundraiserPath("x/test/path") })
 }
 
+func (s *configTestSuite) TestConfig_ConcurrentAccess() {
+	config := sdk.NewConfig()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				config.SetBech32PrefixForAccount("addr", "pub")
+				config.SetCoinType(uint32(j))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Assert().Contains([]string{sdk.Bech32PrefixAccAddr, "addr"}, config.GetBech32AccountAddrPrefix())
+				config.GetBech32AccountPubPrefix()
+				config.GetCoinType()
+			}
+		}()
+	}
+	wg.Wait()
+
+	config.Seal()
+	s.Require().Equal("addr", config.GetBech32AccountAddrPrefix())
+	s.Require().Equal("pub", config.GetBech32AccountPubPrefix())
+	s.Require().Panics(func() { config.SetBech32PrefixForAccount("x", "y") })
+}
+
 func (s *configTestSuite) TestKeyringServiceName() {
 	s.Require().Equal(sdk.DefaultKeyringServiceName, sdk.KeyringServiceName())
 }